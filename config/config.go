@@ -4,16 +4,57 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
+// OIDCProvider is an OpenID Connect identity provider users can log in with.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+}
+
 type Config struct {
-	Environment         string
-	Port                int
-	DSN                 string
-	JwtSecret           string
-	JwtExpirationSecond int
+	Environment                   string
+	Port                          int
+	DSN                           string
+	JwtSecret                     string
+	JwtSigningKeyFile             string
+	JwtVerificationKeyFiles       []string
+	JwtExpirationSecond           int
+	RefreshTokenExpirationSecond  int
+	EventBus                      string
+	SigningSecret                 string
+	AppURL                        string
+	MailDriver                    string
+	MailFrom                      string
+	MailDir                       string
+	SMTPHost                      string
+	SMTPPort                      int
+	SMTPUsername                  string
+	SMTPPassword                  string
+	TrustedProxies                []string
+	Argon2MemoryKiB               int
+	Argon2Iterations              int
+	Argon2Parallelism             int
+	OIDCProviders                 []OIDCProvider
+	BlobDriver                    string
+	BlobDir                       string
+	BlobPublicURL                 string
+	S3Endpoint                    string
+	S3Region                      string
+	S3Bucket                      string
+	S3AccessKeyID                 string
+	S3SecretAccessKey             string
+	AccountDeletionGraceSecond    int
+	AccountDeletionIntervalSecond int
+	DataExportIntervalSecond      int
+	DataExportTTLSecond           int
 }
 
 func New() (*Config, error) {
@@ -37,15 +78,130 @@ func New() (*Config, error) {
 	}
 
 	cfg.JwtSecret = getEnv("JWT_SECRET", "")
-	if cfg.JwtSecret == "" {
-		return nil, fmt.Errorf("JWT_SECRET is required")
+	cfg.JwtSigningKeyFile = getEnv("JWT_SIGNING_KEY_FILE", "")
+	if cfg.JwtSecret == "" && cfg.JwtSigningKeyFile == "" {
+		return nil, fmt.Errorf("either JWT_SECRET or JWT_SIGNING_KEY_FILE is required")
 	}
 
+	cfg.JwtVerificationKeyFiles = getEnvAsList("JWT_VERIFICATION_KEY_FILES")
+
 	cfg.JwtExpirationSecond = getEnvAsInt("JWT_EXPIRATION_SECOND", 3600)
 
+	cfg.RefreshTokenExpirationSecond = getEnvAsInt("REFRESH_TOKEN_EXPIRATION_SECOND", 30*24*3600)
+
+	cfg.EventBus = getEnv("EVENT_BUS", "postgres")
+	if cfg.EventBus != "postgres" && cfg.EventBus != "local" {
+		return nil, fmt.Errorf("EVENT_BUS must be either postgres or local")
+	}
+
+	// Signs the tokens in links sent to users; falls back to the JWT secret
+	cfg.SigningSecret = getEnv("SIGNING_SECRET", cfg.JwtSecret)
+	if cfg.SigningSecret == "" {
+		return nil, fmt.Errorf("SIGNING_SECRET is required when JWT_SECRET is not set")
+	}
+
+	cfg.AppURL = strings.TrimSuffix(getEnv("APP_URL", "http://localhost:3000"), "/")
+
+	cfg.MailDriver = getEnv("MAIL_DRIVER", "log")
+	cfg.MailFrom = getEnv("MAIL_FROM", "Relay <no-reply@localhost>")
+	cfg.MailDir = getEnv("MAIL_DIR", "tmp/mail")
+	cfg.SMTPHost = getEnv("SMTP_HOST", "localhost")
+	cfg.SMTPPort = getEnvAsInt("SMTP_PORT", 587)
+	cfg.SMTPUsername = getEnv("SMTP_USERNAME", "")
+	cfg.SMTPPassword = getEnv("SMTP_PASSWORD", "")
+
+	// Addresses or CIDRs of reverse proxies whose X-Forwarded-For header is
+	// trusted; none by default
+	cfg.TrustedProxies = getEnvAsList("TRUSTED_PROXIES")
+
+	// Cost of new password hashes. Existing hashes are upgraded when their
+	// users next log in, so these can be raised at any time.
+	cfg.Argon2MemoryKiB = getEnvAsInt("ARGON2_MEMORY_KIB", 64*1024)
+	cfg.Argon2Iterations = getEnvAsInt("ARGON2_ITERATIONS", 1)
+	cfg.Argon2Parallelism = getEnvAsInt("ARGON2_PARALLELISM", 2)
+	if cfg.Argon2Iterations < 1 || cfg.Argon2Parallelism < 1 || cfg.Argon2Parallelism > 255 {
+		return nil, fmt.Errorf("ARGON2_ITERATIONS must be at least 1 and ARGON2_PARALLELISM between 1 and 255")
+	}
+	if cfg.Argon2MemoryKiB < 8*cfg.Argon2Parallelism {
+		return nil, fmt.Errorf("ARGON2_MEMORY_KIB must be at least 8 times ARGON2_PARALLELISM")
+	}
+
+	// Uploaded files are kept on disk or in an S3 compatible bucket. The
+	// public URL is where blobs under blob.PublicPrefix can be downloaded.
+	cfg.BlobDriver = getEnv("BLOB_DRIVER", "local")
+	cfg.BlobDir = getEnv("BLOB_DIR", "tmp/blobs")
+	cfg.S3Endpoint = getEnv("S3_ENDPOINT", "")
+	cfg.S3Region = getEnv("S3_REGION", "us-east-1")
+	cfg.S3Bucket = getEnv("S3_BUCKET", "")
+	cfg.S3AccessKeyID = getEnv("S3_ACCESS_KEY_ID", "")
+	cfg.S3SecretAccessKey = getEnv("S3_SECRET_ACCESS_KEY", "")
+	switch cfg.BlobDriver {
+	case "local":
+		cfg.BlobPublicURL = getEnv("BLOB_PUBLIC_URL", fmt.Sprintf("http://localhost:%d/blobs", cfg.Port))
+	case "s3":
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" || cfg.S3AccessKeyID == "" || cfg.S3SecretAccessKey == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for the s3 blob driver")
+		}
+		cfg.BlobPublicURL = getEnv("BLOB_PUBLIC_URL", "")
+	default:
+		return nil, fmt.Errorf("BLOB_DRIVER must be either local or s3")
+	}
+
+	// Users who ask for their account to be deleted have this long to change
+	// their mind. A background job looks for accounts that are due every
+	// interval.
+	cfg.AccountDeletionGraceSecond = getEnvAsInt("ACCOUNT_DELETION_GRACE_SECOND", 30*24*3600)
+	cfg.AccountDeletionIntervalSecond = getEnvAsInt("ACCOUNT_DELETION_INTERVAL_SECOND", 3600)
+	if cfg.AccountDeletionGraceSecond < 0 || cfg.AccountDeletionIntervalSecond < 1 {
+		return nil, fmt.Errorf("ACCOUNT_DELETION_GRACE_SECOND must not be negative and ACCOUNT_DELETION_INTERVAL_SECOND must be at least 1")
+	}
+
+	// Data exports are built by a background job that looks for requested
+	// exports every interval. Archives nobody downloaded are removed after
+	// the TTL.
+	cfg.DataExportIntervalSecond = getEnvAsInt("DATA_EXPORT_INTERVAL_SECOND", 10)
+	cfg.DataExportTTLSecond = getEnvAsInt("DATA_EXPORT_TTL_SECOND", 7*24*3600)
+	if cfg.DataExportIntervalSecond < 1 || cfg.DataExportTTLSecond < 1 {
+		return nil, fmt.Errorf("DATA_EXPORT_INTERVAL_SECOND and DATA_EXPORT_TTL_SECOND must be at least 1")
+	}
+
+	// Identity providers are listed by name in OIDC_PROVIDERS and configured
+	// with OIDC_<NAME>_* variables
+	for _, name := range getEnvAsList("OIDC_PROVIDERS") {
+		provider, err := getOIDCProvider(name, cfg.AppURL)
+		if err != nil {
+			return nil, err
+		}
+		cfg.OIDCProviders = append(cfg.OIDCProviders, *provider)
+	}
+
 	return &cfg, nil
 }
 
+func getOIDCProvider(name, appURL string) (*OIDCProvider, error) {
+	name = strings.ToLower(name)
+	prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+
+	provider := &OIDCProvider{
+		Name:         name,
+		Issuer:       getEnv(prefix+"ISSUER", ""),
+		ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+		ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+		Scopes:       getEnvAsList(prefix + "SCOPES"),
+		RedirectURL:  getEnv(prefix+"REDIRECT_URL", appURL+"/oidc/"+name+"/callback"),
+	}
+
+	if provider.Issuer == "" || provider.ClientID == "" {
+		return nil, fmt.Errorf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+	}
+
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return provider, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -61,3 +217,13 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvAsList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
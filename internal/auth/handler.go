@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal"
+)
+
+type AuthHandler struct {
+	service AuthService
+}
+
+func NewAuthHandler(service AuthService) *AuthHandler {
+	return &AuthHandler{service: service}
+}
+
+// NewClientInfo describes the device a request comes from.
+func NewClientInfo(c *gin.Context) *ClientInfo {
+	return &ClientInfo{
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+}
+
+func (h *AuthHandler) Refresh(c *gin.Context) {
+
+	var req *RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := h.service.RefreshTokens(c.Request.Context(), req.RefreshToken)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": &RefreshResponse{
+			AccessToken:  tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+		},
+	})
+
+}
+
+func (h *AuthHandler) Logout(c *gin.Context) {
+
+	claims, ok := c.Get("token_claims")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	// The refresh token is optional, so an empty body is fine
+	var req LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := h.service.Logout(c.Request.Context(), claims.(*internal.JWTClaims), req.RefreshToken); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("auth: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	if err := h.service.RevokeAllCredentials(c.Request.Context(), userID); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("auth: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	sessions, err := h.service.GetSessions(c.Request.Context(), userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	var currentSessionID string
+	if claims, ok := c.Get("token_claims"); ok {
+		currentSessionID = claims.(*internal.JWTClaims).SessionId
+	}
+
+	resp := make([]*SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, &SessionResponse{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			Current:    session.ID.String() == currentSessionID,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": resp,
+	})
+}
+
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("auth: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	sessionID, err := uuid.Parse(c.Param("session_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid session id"))
+		return
+	}
+
+	if err := h.service.RevokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *AuthHandler) CreateAPIToken(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("auth: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validator.New().Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	token, err := h.service.CreateAPIToken(c.Request.Context(), userID, req)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token": token,
+	})
+}
+
+func (h *AuthHandler) GetAPITokens(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("auth: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	tokens, err := h.service.GetAPITokens(c.Request.Context(), userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	resp := make([]*APITokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		resp = append(resp, NewAPITokenResponse(token))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": resp,
+	})
+}
+
+func (h *AuthHandler) RevokeAPIToken(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("auth: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	tokenID, err := uuid.Parse(c.Param("token_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid token id"))
+		return
+	}
+
+	if err := h.service.RevokeAPIToken(c.Request.Context(), userID, tokenID); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetJWKS serves the public keys access tokens are signed with, so other
+// services can verify them without sharing a secret.
+func (h *AuthHandler) GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.service.GetJWKS())
+}
@@ -0,0 +1,495 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type AuthRepo interface {
+	SaveSession(ctx context.Context, session *Session, token *RefreshToken) (*Session, error)
+	FindActiveSessionsByUserID(ctx context.Context, userID uuid.UUID) ([]*Session, error)
+	TouchSession(ctx context.Context, sessionID uuid.UUID) error
+	RevokeSession(ctx context.Context, sessionID, userID uuid.UUID) (bool, error)
+	RevokeUserSessions(ctx context.Context, userID uuid.UUID, exceptSessionID uuid.UUID) error
+	FindRefreshTokenByHash(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, oldTokenID uuid.UUID, newToken *RefreshToken) (bool, error)
+	SaveRevokedAccessToken(ctx context.Context, tokenID, userID uuid.UUID, expiresAt time.Time) error
+	SaveUserTokenRevocation(ctx context.Context, userID uuid.UUID, revokedAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, tokenID, sessionID, userID uuid.UUID, issuedAt time.Time) (bool, error)
+	SaveAPIToken(ctx context.Context, token *APIToken) (*APIToken, error)
+	FindActiveAPITokensByUserID(ctx context.Context, userID uuid.UUID) ([]*APIToken, error)
+	FindActiveAPITokenByHash(ctx context.Context, tokenHash string) (*APIToken, error)
+	TouchAPIToken(ctx context.Context, tokenID uuid.UUID) error
+	RevokeAPIToken(ctx context.Context, tokenID, userID uuid.UUID) (bool, error)
+	RevokeUserAPITokens(ctx context.Context, userID uuid.UUID) error
+}
+
+type authRepo struct {
+	db *sql.DB
+}
+
+func NewAuthRepo(db *sql.DB) AuthRepo {
+	return &authRepo{db: db}
+}
+
+// SaveSession starts a session together with its first refresh token.
+func (r *authRepo) SaveSession(ctx context.Context, session *Session, token *RefreshToken) (*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	query := `
+		INSERT INTO sessions (user_id, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, last_seen_at
+	`
+	err = tx.QueryRowContext(ctx, query, session.UserID, session.UserAgent, session.IPAddress, session.ExpiresAt).Scan(
+		&session.ID,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save session: %w", err)
+	}
+
+	token.SessionID = session.ID
+	if _, err := r.saveRefreshToken(ctx, tx, token); err != nil {
+		return nil, fmt.Errorf("failed to save refresh token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return session, nil
+}
+
+func (r *authRepo) FindActiveSessionsByUserID(ctx context.Context, userID uuid.UUID) ([]*Session, error) {
+	query := `
+		SELECT id, user_id, user_agent, ip_address, created_at, last_seen_at, expires_at, revoked_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+		ORDER BY last_seen_at DESC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IPAddress,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+			&session.RevokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// TouchSession records that the session was just used. It is called on
+// every authenticated request, so the row is only written once a minute.
+func (r *authRepo) TouchSession(ctx context.Context, sessionID uuid.UUID) error {
+	query := `
+		UPDATE sessions SET last_seen_at = now()
+		WHERE id = $1 AND last_seen_at < now() - INTERVAL '1 minute'
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, sessionID)
+	return err
+}
+
+// RevokeSession ends one of the user's sessions and revokes its refresh
+// tokens. It returns false if the user has no such active session.
+func (r *authRepo) RevokeSession(ctx context.Context, sessionID, userID uuid.UUID) (bool, error) {
+	query := `
+		WITH revoked AS (
+			UPDATE sessions SET revoked_at = now()
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+			RETURNING id
+		), revoked_tokens AS (
+			UPDATE refresh_tokens SET revoked_at = now()
+			WHERE session_id IN (SELECT id FROM revoked) AND revoked_at IS NULL
+		)
+		SELECT COUNT(*) FROM revoked
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var revoked int
+	if err := r.db.QueryRowContext(ctx, query, sessionID, userID).Scan(&revoked); err != nil {
+		return false, err
+	}
+
+	return revoked > 0, nil
+}
+
+// RevokeUserSessions ends every session of the user apart from
+// exceptSessionID, which may be uuid.Nil to end them all.
+func (r *authRepo) RevokeUserSessions(ctx context.Context, userID uuid.UUID, exceptSessionID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		WITH revoked_sessions AS (
+			UPDATE sessions SET revoked_at = now()
+			WHERE user_id = $1 AND id != $2 AND revoked_at IS NULL
+		)
+		UPDATE refresh_tokens SET revoked_at = now()
+		WHERE user_id = $1 AND session_id != $2 AND revoked_at IS NULL
+	`
+	_, err := r.db.ExecContext(ctx, query, userID, exceptSessionID)
+	return err
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (r *authRepo) saveRefreshToken(ctx context.Context, q queryRower, token *RefreshToken) (*RefreshToken, error) {
+	query := `
+		INSERT INTO refresh_tokens (user_id, session_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+
+	err := q.QueryRowContext(ctx, query, token.UserID, token.SessionID, token.TokenHash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (r *authRepo) FindRefreshTokenByHash(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	query := `
+		SELECT id, user_id, session_id, token_hash, expires_at, revoked_at, created_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var token RefreshToken
+
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.SessionID,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// RotateRefreshToken revokes the old token, saves its replacement and
+// extends the session in one transaction. It returns false without saving
+// anything if the old token was already revoked, e.g. by a concurrent
+// refresh with the same token.
+func (r *authRepo) RotateRefreshToken(ctx context.Context, oldTokenID uuid.UUID, newToken *RefreshToken) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	query := `UPDATE refresh_tokens SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`
+	result, err := tx.ExecContext(ctx, query, oldTokenID)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows == 0 {
+		return false, nil
+	}
+
+	if _, err := r.saveRefreshToken(ctx, tx, newToken); err != nil {
+		return false, fmt.Errorf("failed to save refresh token: %w", err)
+	}
+
+	query = `UPDATE sessions SET last_seen_at = now(), expires_at = $2 WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, newToken.SessionID, newToken.ExpiresAt); err != nil {
+		return false, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
+
+func (r *authRepo) SaveRevokedAccessToken(ctx context.Context, tokenID, userID uuid.UUID, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		INSERT INTO revoked_access_tokens (jti, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING
+	`
+	if _, err := r.db.ExecContext(ctx, query, tokenID, userID, expiresAt); err != nil {
+		return err
+	}
+
+	// Expired tokens are rejected anyway, so their rows are no longer needed
+	cleanup := `DELETE FROM revoked_access_tokens WHERE expires_at < now()`
+	if _, err := r.db.ExecContext(ctx, cleanup); err != nil {
+		log.Printf("failed to delete expired revoked access tokens: %v", err)
+	}
+
+	return nil
+}
+
+func (r *authRepo) SaveUserTokenRevocation(ctx context.Context, userID uuid.UUID, revokedAt time.Time) error {
+	query := `
+		INSERT INTO user_token_revocations (user_id, revoked_at)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_at = EXCLUDED.revoked_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, userID, revokedAt)
+	return err
+}
+
+// IsAccessTokenRevoked tells whether the token was revoked by its jti, its
+// session or, for tokens without a session, a revocation of every token of
+// the user. issuedAt only has second precision, so the revocation time is
+// compared at that precision too: a token issued in the same second as the
+// revocation or earlier is revoked.
+func (r *authRepo) IsAccessTokenRevoked(ctx context.Context, tokenID, sessionID, userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	query := `
+		SELECT
+			EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = $1)
+			OR EXISTS (SELECT 1 FROM sessions WHERE id = $2 AND revoked_at IS NOT NULL)
+			OR (
+				-- Tokens with a session are revoked through it
+				$2 = '00000000-0000-0000-0000-000000000000'
+				AND EXISTS (
+					SELECT 1 FROM user_token_revocations
+					WHERE user_id = $3 AND date_trunc('second', revoked_at) >= $4
+				)
+			)
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var revoked bool
+	if err := r.db.QueryRowContext(ctx, query, tokenID, sessionID, userID, issuedAt.Truncate(time.Second)).Scan(&revoked); err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+func (r *authRepo) SaveAPIToken(ctx context.Context, token *APIToken) (*APIToken, error) {
+	query := `
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := r.db.QueryRowContext(ctx, query, token.UserID, token.Name, token.TokenHash, pq.Array(token.Scopes), token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (r *authRepo) FindActiveAPITokensByUserID(ctx context.Context, userID uuid.UUID) ([]*APIToken, error) {
+	query := `
+		SELECT id, user_id, name, token_hash, scopes, expires_at, last_used_at, revoked_at, created_at
+		FROM api_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY created_at DESC
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		var token APIToken
+		err := rows.Scan(
+			&token.ID,
+			&token.UserID,
+			&token.Name,
+			&token.TokenHash,
+			pq.Array(&token.Scopes),
+			&token.ExpiresAt,
+			&token.LastUsedAt,
+			&token.RevokedAt,
+			&token.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// FindActiveAPITokenByHash ignores tokens of deactivated users and of bots
+// whose owner is deactivated or deleted. They work again once the user is
+// reactivated.
+func (r *authRepo) FindActiveAPITokenByHash(ctx context.Context, tokenHash string) (*APIToken, error) {
+	query := `
+		SELECT t.id, t.user_id, t.name, t.token_hash, t.scopes, t.expires_at, t.last_used_at, t.revoked_at, t.created_at
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		LEFT JOIN users o ON o.id = u.bot_owner_id
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL AND (t.expires_at IS NULL OR t.expires_at > now())
+			AND u.deactivated_at IS NULL
+			AND (u.bot_owner_id IS NULL OR (o.deactivated_at IS NULL AND o.deleted_at IS NULL))
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var token APIToken
+
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.TokenHash,
+		pq.Array(&token.Scopes),
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// TouchAPIToken records that the token was just used. Like TouchSession, the
+// row is only written once a minute.
+func (r *authRepo) TouchAPIToken(ctx context.Context, tokenID uuid.UUID) error {
+	query := `
+		UPDATE api_tokens SET last_used_at = now()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - INTERVAL '1 minute')
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, tokenID)
+	return err
+}
+
+func (r *authRepo) RevokeAPIToken(ctx context.Context, tokenID, userID uuid.UUID) (bool, error) {
+	query := `
+		UPDATE api_tokens SET revoked_at = now()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, query, tokenID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// RevokeUserAPITokens revokes the API tokens of the user and of every bot
+// the user owns.
+func (r *authRepo) RevokeUserAPITokens(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		UPDATE api_tokens SET revoked_at = now()
+		WHERE revoked_at IS NULL AND user_id IN (
+			SELECT id FROM users WHERE id = $1 OR bot_owner_id = $1
+		)
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,372 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/events"
+)
+
+type AuthService interface {
+	IssueTokens(ctx context.Context, userID uuid.UUID, client *ClientInfo) (*TokenPair, error)
+	RefreshTokens(ctx context.Context, refreshToken string) (*TokenPair, error)
+	Logout(ctx context.Context, claims *internal.JWTClaims, refreshToken string) error
+	LogoutAll(ctx context.Context, userID uuid.UUID) error
+	RevokeAllCredentials(ctx context.Context, userID uuid.UUID) error
+	LogoutOtherSessions(ctx context.Context, claims *internal.JWTClaims) error
+	GetSessions(ctx context.Context, userID uuid.UUID) ([]*Session, error)
+	RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error
+	IsTokenRevoked(ctx context.Context, claims *internal.JWTClaims) (bool, error)
+	CreateAPIToken(ctx context.Context, userID uuid.UUID, req *CreateAPITokenRequest) (*CreateAPITokenResponse, error)
+	GetAPITokens(ctx context.Context, userID uuid.UUID) ([]*APIToken, error)
+	RevokeAPIToken(ctx context.Context, userID, tokenID uuid.UUID) error
+	AuthenticateAPIToken(ctx context.Context, token string) (*internal.JWTClaims, error)
+	GetJWKS() *internal.JWKS
+}
+
+type authService struct {
+	repo      AuthRepo
+	keys      *internal.KeySet
+	publisher events.Publisher
+	cfg       config.Config
+}
+
+func NewAuthService(repo AuthRepo, keys *internal.KeySet, publisher events.Publisher, cfg config.Config) AuthService {
+	return &authService{
+		repo:      repo,
+		keys:      keys,
+		publisher: publisher,
+		cfg:       cfg,
+	}
+}
+
+// IssueTokens starts a new session for a user who has just proven who they
+// are, e.g. by logging in.
+func (s *authService) IssueTokens(ctx context.Context, userID uuid.UUID, client *ClientInfo) (*TokenPair, error) {
+	refreshToken, newToken, err := s.newRefreshToken(userID, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.repo.SaveSession(ctx, &Session{
+		UserID:    userID,
+		UserAgent: client.UserAgent,
+		IPAddress: client.IPAddress,
+		ExpiresAt: newToken.ExpiresAt,
+	}, newToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.tokenPair(userID, session.ID, refreshToken)
+}
+
+// RefreshTokens exchanges a refresh token for a new token pair. Each refresh
+// token can be used once. Presenting one that was already rotated means it
+// has leaked, so its whole session is revoked and the user must log in again.
+func (s *authService) RefreshTokens(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	token, err := s.repo.FindRefreshTokenByHash(ctx, internal.HashOpaqueToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil || time.Now().After(token.ExpiresAt) {
+		return nil, internal.NewUnauthorizedError("Invalid refresh token")
+	}
+
+	if token.RevokedAt != nil {
+		s.revokeReusedSession(ctx, token)
+		return nil, internal.NewUnauthorizedError("Invalid refresh token")
+	}
+
+	newRefreshToken, newToken, err := s.newRefreshToken(token.UserID, token.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.repo.RotateRefreshToken(ctx, token.ID, newToken)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Someone else rotated the token between our read and write.
+		s.revokeReusedSession(ctx, token)
+		return nil, internal.NewUnauthorizedError("Invalid refresh token")
+	}
+
+	return s.tokenPair(token.UserID, token.SessionID, newRefreshToken)
+}
+
+// Logout ends the session the request was made with. The refresh token,
+// when given, is used to find the session of tokens issued without one.
+func (s *authService) Logout(ctx context.Context, claims *internal.JWTClaims, refreshToken string) error {
+	userID, err := uuid.Parse(claims.UserId)
+	if err != nil {
+		return internal.NewUnauthorizedError("Unauthorized")
+	}
+
+	if sessionID, err := uuid.Parse(claims.SessionId); err == nil {
+		if _, err := s.repo.RevokeSession(ctx, sessionID, userID); err != nil {
+			return err
+		}
+	}
+
+	if refreshToken != "" {
+		token, err := s.repo.FindRefreshTokenByHash(ctx, internal.HashOpaqueToken(refreshToken))
+		if err != nil {
+			return err
+		}
+		// RevokeSession ignores sessions of other users
+		if token != nil {
+			if _, err := s.repo.RevokeSession(ctx, token.SessionID, userID); err != nil {
+				return err
+			}
+		}
+	}
+
+	tokenID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		// Tokens issued before jti was added can only be revoked all at once
+		return internal.NewBadRequestError("Access token cannot be revoked individually")
+	}
+
+	return s.repo.SaveRevokedAccessToken(ctx, tokenID, userID, claims.ExpiresAt.Time)
+}
+
+// LogoutAll ends every session of the user and revokes all access tokens
+// issued so far. Open gateway connections of the user are closed too.
+func (s *authService) LogoutAll(ctx context.Context, userID uuid.UUID) error {
+	if err := s.repo.RevokeUserSessions(ctx, userID, uuid.Nil); err != nil {
+		return err
+	}
+
+	if err := s.repo.SaveUserTokenRevocation(ctx, userID, time.Now()); err != nil {
+		return err
+	}
+
+	// The tokens are already revoked, so a failure only delays closing the
+	// connections until they reconnect
+	err := s.publisher.Publish(ctx, &events.Event{
+		Type:       events.EventTypeSessionsRevoked,
+		Recipients: []uuid.UUID{userID},
+	})
+	if err != nil {
+		log.Printf("auth: failed to publish %s event: %v", events.EventTypeSessionsRevoked, err)
+	}
+
+	return nil
+}
+
+// RevokeAllCredentials logs the user out everywhere and also revokes the API
+// tokens of the user and their bots, which a compromised account may have
+// been given. LogoutAll alone keeps API tokens, so that they work again when
+// a deactivated account is reactivated.
+func (s *authService) RevokeAllCredentials(ctx context.Context, userID uuid.UUID) error {
+	if err := s.LogoutAll(ctx, userID); err != nil {
+		return err
+	}
+
+	return s.repo.RevokeUserAPITokens(ctx, userID)
+}
+
+// LogoutOtherSessions ends every session of the user except the one the
+// request was made with.
+func (s *authService) LogoutOtherSessions(ctx context.Context, claims *internal.JWTClaims) error {
+	userID, err := uuid.Parse(claims.UserId)
+	if err != nil {
+		return internal.NewUnauthorizedError("Unauthorized")
+	}
+
+	sessionID, err := uuid.Parse(claims.SessionId)
+	if err != nil {
+		// Without a session there is nothing to keep
+		return s.LogoutAll(ctx, userID)
+	}
+
+	return s.repo.RevokeUserSessions(ctx, userID, sessionID)
+}
+
+func (s *authService) GetSessions(ctx context.Context, userID uuid.UUID) ([]*Session, error) {
+	return s.repo.FindActiveSessionsByUserID(ctx, userID)
+}
+
+func (s *authService) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	revoked, err := s.repo.RevokeSession(ctx, sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	if !revoked {
+		return internal.NewNotFoundError("Session not found")
+	}
+
+	return nil
+}
+
+// IsTokenRevoked also records the use of the token's session, since it runs
+// on every authenticated request.
+func (s *authService) IsTokenRevoked(ctx context.Context, claims *internal.JWTClaims) (bool, error) {
+	userID, err := uuid.Parse(claims.UserId)
+	if err != nil {
+		return true, nil
+	}
+
+	// The jti and session may be missing on tokens issued before they were
+	// introduced
+	tokenID, _ := uuid.Parse(claims.ID)
+	sessionID, _ := uuid.Parse(claims.SessionId)
+
+	// Without a session, a token can only be revoked along with every other
+	// token of the user. iat only has second precision, so such a token
+	// issued in the same second as a "log out everywhere" is revoked too.
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	revoked, err := s.repo.IsAccessTokenRevoked(ctx, tokenID, sessionID, userID, issuedAt)
+	if err != nil {
+		return false, err
+	}
+
+	if !revoked && sessionID != uuid.Nil {
+		if err := s.repo.TouchSession(ctx, sessionID); err != nil {
+			log.Printf("auth: failed to update last seen of session %s: %v", sessionID, err)
+		}
+	}
+
+	return revoked, nil
+}
+
+// CreateAPIToken issues a long-lived token for integrations. The token is
+// only returned here; afterwards just its hash is known.
+func (s *authService) CreateAPIToken(ctx context.Context, userID uuid.UUID, req *CreateAPITokenRequest) (*CreateAPITokenResponse, error) {
+	secret, err := internal.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	token := apiTokenPrefix + secret
+
+	for _, scope := range req.Scopes {
+		if !internal.IsKnownScope(scope) {
+			return nil, internal.NewUnprocessableEntityError("Unknown scope: " + scope)
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays != nil {
+		t := time.Now().AddDate(0, 0, *req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	apiToken, err := s.repo.SaveAPIToken(ctx, &APIToken{
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: internal.HashOpaqueToken(token),
+		Scopes:    req.Scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreateAPITokenResponse{
+		APITokenResponse: *NewAPITokenResponse(apiToken),
+		Token:            token,
+	}, nil
+}
+
+func (s *authService) GetAPITokens(ctx context.Context, userID uuid.UUID) ([]*APIToken, error) {
+	return s.repo.FindActiveAPITokensByUserID(ctx, userID)
+}
+
+func (s *authService) RevokeAPIToken(ctx context.Context, userID, tokenID uuid.UUID) error {
+	revoked, err := s.repo.RevokeAPIToken(ctx, tokenID, userID)
+	if err != nil {
+		return err
+	}
+
+	if !revoked {
+		return internal.NewNotFoundError("API token not found")
+	}
+
+	return nil
+}
+
+// AuthenticateAPIToken returns the claims of the user an API token belongs
+// to, with the token id as jti, or nil if the token is unknown, revoked or
+// expired.
+func (s *authService) AuthenticateAPIToken(ctx context.Context, token string) (*internal.JWTClaims, error) {
+	apiToken, err := s.repo.FindActiveAPITokenByHash(ctx, internal.HashOpaqueToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if apiToken == nil {
+		return nil, nil
+	}
+
+	if err := s.repo.TouchAPIToken(ctx, apiToken.ID); err != nil {
+		log.Printf("auth: failed to update last use of API token %s: %v", apiToken.ID, err)
+	}
+
+	// Never nil, so a token without scopes cannot do anything rather than
+	// everything
+	scopes := apiToken.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	return &internal.JWTClaims{
+		UserId: apiToken.UserID.String(),
+		Scopes: scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID: apiToken.ID.String(),
+		},
+	}, nil
+}
+
+// GetJWKS returns the public keys other services can verify access tokens
+// with.
+func (s *authService) GetJWKS() *internal.JWKS {
+	return s.keys.JWKS()
+}
+
+func (s *authService) newRefreshToken(userID, sessionID uuid.UUID) (string, *RefreshToken, error) {
+	refreshToken, err := internal.GenerateOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return refreshToken, &RefreshToken{
+		UserID:    userID,
+		SessionID: sessionID,
+		TokenHash: internal.HashOpaqueToken(refreshToken),
+		ExpiresAt: time.Now().Add(time.Duration(s.cfg.RefreshTokenExpirationSecond) * time.Second),
+	}, nil
+}
+
+func (s *authService) tokenPair(userID, sessionID uuid.UUID, refreshToken string) (*TokenPair, error) {
+	accessToken, err := internal.GenerateJWT(s.keys, userID.String(), sessionID.String(), s.cfg.JwtExpirationSecond)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *authService) revokeReusedSession(ctx context.Context, token *RefreshToken) {
+	log.Printf("auth: refresh token %s reused, revoking session %s of user %s", token.ID, token.SessionID, token.UserID)
+
+	if _, err := s.repo.RevokeSession(ctx, token.SessionID, token.UserID); err != nil {
+		log.Printf("auth: failed to revoke session %s: %v", token.SessionID, err)
+	}
+}
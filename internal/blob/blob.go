@@ -0,0 +1,60 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/jakottelaar/relay-backend/config"
+)
+
+// PublicPrefix is the part of the key space anyone may read, e.g. avatars.
+// Everything else is only handed out through the API.
+const PublicPrefix = "public/"
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps uploaded files. Keys are slash separated relative paths
+// chosen by the caller.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns ErrNotFound if there is no blob with the key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds if there is no blob with the key.
+	Delete(ctx context.Context, key string) error
+	// URL is where a blob under PublicPrefix can be downloaded.
+	URL(key string) string
+}
+
+// NewBlobStore returns the store selected by cfg.BlobDriver.
+func NewBlobStore(cfg *config.Config) (BlobStore, error) {
+	switch cfg.BlobDriver {
+	case "local":
+		return NewLocalStore(cfg.BlobDir, cfg.BlobPublicURL)
+	case "s3":
+		return NewS3Store(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKeyID, cfg.S3SecretAccessKey, cfg.BlobPublicURL)
+	default:
+		return nil, fmt.Errorf("unknown blob driver %q", cfg.BlobDriver)
+	}
+}
+
+// KeyFromURL returns the key of the blob a URL returned by store.URL points
+// to.
+func KeyFromURL(store BlobStore, url string) (string, bool) {
+	key, ok := strings.CutPrefix(url, store.URL(""))
+	if !ok || !validKey(key) {
+		return "", false
+	}
+	return key, true
+}
+
+func validKey(key string) bool {
+	return key != "" &&
+		!strings.HasPrefix(key, "/") &&
+		path.Clean(key) == key &&
+		key != ".." &&
+		!strings.HasPrefix(key, "../")
+}
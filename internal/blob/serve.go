@@ -0,0 +1,46 @@
+package blob
+
+import (
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServePublic serves the blobs under PublicPrefix, for stores that have no
+// server of their own like the local store. Keys are never reused, so the
+// responses can be cached forever.
+func ServePublic(store BlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		if !strings.HasPrefix(key, PublicPrefix) || !validKey(key) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		r, err := store.Get(c.Request.Context(), key)
+		if errors.Is(err, ErrNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("blob: failed to read %s: %v", key, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		defer r.Close()
+
+		contentType := mime.TypeByExtension(path.Ext(key))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		c.DataFromReader(http.StatusOK, -1, contentType, r, nil)
+	}
+}
@@ -0,0 +1,114 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jakottelaar/relay-backend/internal"
+)
+
+const (
+	// sniffLen is how much of a file http.DetectContentType looks at
+	sniffLen = 512
+	// formOverhead leaves room for the multipart headers and other fields
+	// of an upload request
+	formOverhead = 64 << 10
+)
+
+// extensions maps the content types http.DetectContentType recognizes to
+// the extension their blob keys get, so they are served with the right
+// type.
+var extensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"text/plain":      ".txt",
+}
+
+// Upload is a file received in a multipart form. ContentType is sniffed
+// from its contents; the type claimed by the client is not trusted.
+type Upload struct {
+	Filename    string
+	Size        int64
+	ContentType string
+	// Reader returns the whole file, including the part that was sniffed
+	Reader io.Reader
+	file   multipart.File
+}
+
+func (u *Upload) Close() error {
+	return u.file.Close()
+}
+
+// Rewind starts Reader over from the beginning of the file, so an upload can
+// be inspected before it is stored.
+func (u *Upload) Rewind() error {
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	u.Reader = u.file
+	return nil
+}
+
+// Extension returns the extension for the upload's content type, if it is
+// a known one.
+func (u *Upload) Extension() string {
+	mediaType, _, _ := mime.ParseMediaType(u.ContentType)
+	return extensions[mediaType]
+}
+
+// ReadUpload opens the file in a field of a multipart request. Files larger
+// than maxSize are rejected, and the request body is cut off soon after, so
+// clients cannot make the server read arbitrarily much.
+func ReadUpload(c *gin.Context, field string, maxSize int64) (*Upload, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+formOverhead)
+
+	header, err := c.FormFile(field)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, tooLarge(maxSize)
+		}
+		return nil, internal.NewBadRequestError("Missing file in form field " + field)
+	}
+
+	if header.Size > maxSize {
+		return nil, tooLarge(maxSize)
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		file.Close()
+		return nil, err
+	}
+	head = head[:n]
+
+	return &Upload{
+		Filename:    filepath.Base(header.Filename),
+		Size:        header.Size,
+		ContentType: http.DetectContentType(head),
+		Reader:      io.MultiReader(bytes.NewReader(head), file),
+		file:        file,
+	}, nil
+}
+
+func tooLarge(maxSize int64) error {
+	return internal.NewPayloadTooLargeError(fmt.Sprintf("File is larger than %d bytes", maxSize))
+}
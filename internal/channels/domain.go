@@ -50,3 +50,12 @@ type CreateGroupChannelResponse struct {
 	ChannelMembers uuid.UUIDs  `json:"channel_members"`
 	CreatedAt      time.Time   `json:"created_at"`
 }
+
+type AddChannelMemberRequest struct {
+	UserID uuid.UUID `json:"user_id" binding:"required"`
+}
+
+type ChannelMemberResponse struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	UserID    uuid.UUID `json:"user_id"`
+}
@@ -127,3 +127,42 @@ func (h *ChannelsHandler) GetAllChannels(c *gin.Context) {
 		"channels": channelsResponse,
 	})
 }
+
+func (h *ChannelsHandler) AddChannelMember(c *gin.Context) {
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userId, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("channels: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	channelID, err := uuid.Parse(c.Param("channel_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid channel id"))
+		return
+	}
+
+	var req AddChannelMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid request body"))
+		return
+	}
+
+	if err := h.service.AddChannelMember(c.Request.Context(), userId, channelID, req.UserID); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"member": &ChannelMemberResponse{
+			ChannelID: channelID,
+			UserID:    req.UserID,
+		},
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal"
 )
 
 type ChannelsRepo interface {
@@ -17,6 +18,10 @@ type ChannelsRepo interface {
 	AddUserToChannel(ctx context.Context, channelID, userID uuid.UUID, tx *sql.Tx) (uuid.UUID, error)
 	SaveGroupChannel(ctx context.Context, ownerUserID uuid.UUID, name string, channelMemberIDs []uuid.UUID) (*Channel, []uuid.UUID, error)
 	FindAllChannelsByUserID(ctx context.Context, userID uuid.UUID) ([]*Channel, error)
+	IsChannelMember(ctx context.Context, channelID, userID uuid.UUID) (bool, error)
+	FindChannelByID(ctx context.Context, channelID uuid.UUID) (*Channel, error)
+	FindChannelMemberIDs(ctx context.Context, channelID uuid.UUID) ([]uuid.UUID, error)
+	IsEmailVerified(ctx context.Context, userID uuid.UUID) (bool, error)
 }
 
 type channelsRepo struct {
@@ -134,7 +139,14 @@ func (r *channelsRepo) AddUserToChannel(ctx context.Context, channelID, userID u
 		_, err = r.db.ExecContext(ctx, query, channelID, userID)
 	}
 	if err != nil {
-		return uuid.Nil, err
+		switch err.Error() {
+		case "pq: duplicate key value violates unique constraint \"channel_members_channel_id_user_id_key\"":
+			return uuid.Nil, internal.NewDuplicateError("User is already a member of this channel")
+		case "pq: insert or update on table \"channel_members\" violates foreign key constraint \"channel_members_user_id_fkey\"":
+			return uuid.Nil, internal.NewNotFoundError("User not found")
+		default:
+			return uuid.Nil, err
+		}
 	}
 	return userID, nil
 }
@@ -221,3 +233,93 @@ func (r *channelsRepo) FindAllChannelsByUserID(ctx context.Context, userID uuid.
 
 	return channels, nil
 }
+
+func (r *channelsRepo) IsChannelMember(ctx context.Context, channelID, userID uuid.UUID) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM channel_members
+			WHERE channel_id = $1 AND user_id = $2
+		)
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var isMember bool
+	err := r.db.QueryRowContext(ctx, query, channelID, userID).Scan(&isMember)
+	if err != nil {
+		return false, err
+	}
+
+	return isMember, nil
+}
+
+// IsEmailVerified tells whether the user verified their email address. Bots
+// have no address of their own, so the address of their owner counts.
+func (r *channelsRepo) IsEmailVerified(ctx context.Context, userID uuid.UUID) (bool, error) {
+	query := `
+		SELECT COALESCE(o.email_verified_at, u.email_verified_at) IS NOT NULL
+		FROM users u
+		LEFT JOIN users o ON o.id = u.bot_owner_id
+		WHERE u.id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var verified bool
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&verified)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return verified, nil
+}
+
+func (r *channelsRepo) FindChannelByID(ctx context.Context, channelID uuid.UUID) (*Channel, error) {
+	query := `
+		SELECT id, name, owner_id, type, created_at, updated_at
+		FROM channels
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	channel := &Channel{}
+	err := r.db.QueryRowContext(ctx, query, channelID).Scan(&channel.ID, &channel.Name, &channel.OwnerID, &channel.ChannelType, &channel.CreatedAt, &channel.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+func (r *channelsRepo) FindChannelMemberIDs(ctx context.Context, channelID uuid.UUID) ([]uuid.UUID, error) {
+	query := `
+		SELECT user_id FROM channel_members
+		WHERE channel_id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberIDs := []uuid.UUID{}
+	for rows.Next() {
+		var memberID uuid.UUID
+		if err := rows.Scan(&memberID); err != nil {
+			return nil, err
+		}
+		memberIDs = append(memberIDs, memberID)
+	}
+
+	return memberIDs, rows.Err()
+}
@@ -3,23 +3,29 @@ package channels
 import (
 	"context"
 	"fmt"
+	"log"
 
 	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/events"
 )
 
 type ChannelsService interface {
 	GetDMChannel(ctx context.Context, userId, targetUserID uuid.UUID) (*Channel, error)
 	CreateGroupChannel(ctx context.Context, userId uuid.UUID, name string, channelMemberIDs []uuid.UUID) (*Channel, []uuid.UUID, error)
 	GetAllChannels(ctx context.Context, userId uuid.UUID) ([]*Channel, error)
+	AddChannelMember(ctx context.Context, userId, channelID, memberID uuid.UUID) error
 }
 
 type channelsService struct {
 	channelsRepo ChannelsRepo
+	publisher    events.Publisher
 }
 
-func NewChannelsService(channelsRepo ChannelsRepo) ChannelsService {
+func NewChannelsService(channelsRepo ChannelsRepo, publisher events.Publisher) ChannelsService {
 	return &channelsService{
 		channelsRepo: channelsRepo,
+		publisher:    publisher,
 	}
 }
 
@@ -31,19 +37,40 @@ func (s *channelsService) GetDMChannel(ctx context.Context, userId, targetUserID
 	}
 
 	if channel == nil {
-		return s.channelsRepo.SaveDMChannel(ctx, userId, targetUserID)
+		savedChannel, err := s.channelsRepo.SaveDMChannel(ctx, userId, targetUserID)
+		if err != nil {
+			return nil, err
+		}
+
+		s.publishChannelCreated(ctx, savedChannel, []uuid.UUID{userId, targetUserID})
+
+		return savedChannel, nil
 	}
 
 	// Channel was found, return it
 	return channel, nil
 }
 
+// CreateGroupChannel creates a group owned by ownerUserID. Only users with a
+// verified email address can create groups, which keeps throwaway accounts
+// from pulling people into spam groups.
 func (s *channelsService) CreateGroupChannel(ctx context.Context, ownerUserID uuid.UUID, name string, channelMemberIDs []uuid.UUID) (*Channel, []uuid.UUID, error) {
+	verified, err := s.channelsRepo.IsEmailVerified(ctx, ownerUserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error checking email verification: %w", err)
+	}
+
+	if !verified {
+		return nil, nil, internal.NewForbiddenError("Verify your email address to create group channels")
+	}
+
 	savedChannel, memberIDs, err := s.channelsRepo.SaveGroupChannel(ctx, ownerUserID, name, channelMemberIDs)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error saving group channel: %w", err)
 	}
 
+	s.publishChannelCreated(ctx, savedChannel, memberIDs)
+
 	return savedChannel, memberIDs, nil
 }
 
@@ -55,3 +82,75 @@ func (s *channelsService) GetAllChannels(ctx context.Context, userId uuid.UUID)
 
 	return channels, nil
 }
+
+func (s *channelsService) AddChannelMember(ctx context.Context, userId, channelID, memberID uuid.UUID) error {
+	isMember, err := s.channelsRepo.IsChannelMember(ctx, channelID, userId)
+	if err != nil {
+		return fmt.Errorf("error checking channel membership: %w", err)
+	}
+
+	if !isMember {
+		return internal.NewNotFoundError("Channel not found")
+	}
+
+	channel, err := s.channelsRepo.FindChannelByID(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error finding channel: %w", err)
+	}
+
+	if channel == nil {
+		return internal.NewNotFoundError("Channel not found")
+	}
+
+	if channel.ChannelType != ChannelTypeGroup {
+		return internal.NewBadRequestError("Members can only be added to group channels")
+	}
+
+	if channel.OwnerID != userId {
+		return internal.NewForbiddenError("Only the channel owner can add members")
+	}
+
+	if _, err := s.channelsRepo.AddUserToChannel(ctx, channelID, memberID, nil); err != nil {
+		return err
+	}
+
+	memberIDs, err := s.channelsRepo.FindChannelMemberIDs(ctx, channelID)
+	if err != nil {
+		log.Printf("channels: failed to find members of channel %s: %v", channelID, err)
+		return nil
+	}
+
+	s.publishChannelCreated(ctx, channel, []uuid.UUID{memberID})
+	s.publish(ctx, &events.Event{
+		Type:       events.EventTypeChannelMemberAdded,
+		Recipients: memberIDs,
+		Data: &ChannelMemberResponse{
+			ChannelID: channelID,
+			UserID:    memberID,
+		},
+	})
+
+	return nil
+}
+
+func (s *channelsService) publishChannelCreated(ctx context.Context, channel *Channel, recipients []uuid.UUID) {
+	s.publish(ctx, &events.Event{
+		Type:       events.EventTypeChannelCreated,
+		Recipients: recipients,
+		Data: &GetChannelResponse{
+			ID:          channel.ID,
+			Name:        channel.Name,
+			OwnerID:     channel.OwnerID,
+			ChannelType: channel.ChannelType,
+			CreatedAt:   channel.CreatedAt,
+		},
+	})
+}
+
+// publish delivers an event on a best effort basis; the change it describes
+// has already been committed, so a failure is logged rather than returned.
+func (s *channelsService) publish(ctx context.Context, event *events.Event) {
+	if err := s.publisher.Publish(ctx, event); err != nil {
+		log.Printf("channels: failed to publish %s event: %v", event.Type, err)
+	}
+}
@@ -69,6 +69,46 @@ func NewUnauthorizedError(msg string) error {
 	}
 }
 
+func NewForbiddenError(msg string) error {
+	return &ServiceError{
+		Code:    http.StatusForbidden,
+		Message: msg,
+		Err:     errors.New(msg),
+	}
+}
+
+func NewPayloadTooLargeError(msg string) error {
+	return &ServiceError{
+		Code:    http.StatusRequestEntityTooLarge,
+		Message: msg,
+		Err:     errors.New(msg),
+	}
+}
+
+func NewUnsupportedMediaTypeError(msg string) error {
+	return &ServiceError{
+		Code:    http.StatusUnsupportedMediaType,
+		Message: msg,
+		Err:     errors.New(msg),
+	}
+}
+
+func NewTooManyRequestsError(msg string) error {
+	return &ServiceError{
+		Code:    http.StatusTooManyRequests,
+		Message: msg,
+		Err:     errors.New(msg),
+	}
+}
+
+func NewServiceUnavailableError(msg string) error {
+	return &ServiceError{
+		Code:    http.StatusServiceUnavailable,
+		Message: msg,
+		Err:     errors.New(msg),
+	}
+}
+
 func ErrorHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Next()
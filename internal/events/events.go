@@ -0,0 +1,44 @@
+package events
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type EventType string
+
+const (
+	EventTypeMessageCreated        EventType = "MESSAGE_CREATED"
+	EventTypeFriendRequestReceived EventType = "FRIEND_REQUEST_RECEIVED"
+	EventTypeChannelCreated        EventType = "CHANNEL_CREATED"
+	EventTypeChannelMemberAdded    EventType = "CHANNEL_MEMBER_ADDED"
+
+	// EventTypeSessionsRevoked tells the gateway to close every connection of
+	// the recipients, whose tokens were just revoked. It is not delivered to
+	// clients.
+	EventTypeSessionsRevoked EventType = "SESSIONS_REVOKED"
+)
+
+// Event is something that happened on behalf of a set of users. Data is
+// delivered to every connected session of each recipient as is, so it must
+// be JSON serializable.
+type Event struct {
+	Type       EventType   `json:"type"`
+	Recipients []uuid.UUID `json:"recipients"`
+	Data       interface{} `json:"data"`
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, event *Event) error
+}
+
+type Handler func(ctx context.Context, event *Event)
+
+// Bus carries events from the instance that produced them to every
+// subscriber, which may live on another instance.
+type Bus interface {
+	Publisher
+	Subscribe(handler Handler)
+	Close() error
+}
@@ -0,0 +1,39 @@
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// localBus delivers events to subscribers in the same process. It is enough
+// when a single instance of the server is running.
+type localBus struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewLocalBus() Bus {
+	return &localBus{}
+}
+
+func (b *localBus) Publish(ctx context.Context, event *Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handler := range b.handlers {
+		handler(ctx, event)
+	}
+
+	return nil
+}
+
+func (b *localBus) Subscribe(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *localBus) Close() error {
+	return nil
+}
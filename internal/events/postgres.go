@@ -0,0 +1,197 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	postgresChannel = "relay_events"
+
+	// NOTIFY payloads must stay below 8000 bytes. Larger events are stored
+	// in bus_events and only their row ID is sent.
+	maxNotifyPayloadSize = 7900
+
+	// How long stored events are kept for listeners to pick them up.
+	storedEventRetention = 5 * time.Minute
+
+	// How often the listener connection is checked when it is otherwise idle.
+	listenerPingInterval = 90 * time.Second
+)
+
+// notification is an event as sent over NOTIFY. Ref is set instead of the
+// event itself when the event was too large to send inline.
+type notification struct {
+	Type       EventType       `json:"type"`
+	Recipients []uuid.UUID     `json:"recipients"`
+	Data       json.RawMessage `json:"data"`
+	Ref        int64           `json:"ref,omitempty"`
+}
+
+// postgresBus fans events out to every instance connected to the same
+// database using LISTEN/NOTIFY. An instance also receives its own events
+// through the database, so subscribers see each event exactly once.
+type postgresBus struct {
+	db       *sql.DB
+	listener *pq.Listener
+
+	mu       sync.RWMutex
+	handlers []Handler
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func NewPostgresBus(db *sql.DB, dsn string) (Bus, error) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("events: postgres listener error: %v", err)
+		}
+	})
+
+	if err := listener.Listen(postgresChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("listen on %s: %w", postgresChannel, err)
+	}
+
+	bus := &postgresBus{
+		db:       db,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	bus.wg.Add(1)
+	go bus.listen()
+
+	return bus, nil
+}
+
+func (b *postgresBus) Publish(ctx context.Context, event *Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if len(payload) <= maxNotifyPayloadSize {
+		_, err = b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, postgresChannel, string(payload))
+		return err
+	}
+
+	query := `
+		WITH stored AS (
+			INSERT INTO bus_events (payload) VALUES ($2) RETURNING id
+		)
+		SELECT pg_notify($1, json_build_object('ref', id)::text) FROM stored
+	`
+	_, err = b.db.ExecContext(ctx, query, postgresChannel, string(payload))
+	return err
+}
+
+func (b *postgresBus) Subscribe(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+}
+
+// Close stops listening. It is safe to call more than once, as App.Shutdown
+// and App.Close both close the bus.
+func (b *postgresBus) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.wg.Wait()
+
+		b.closeErr = b.listener.Close()
+	})
+
+	return b.closeErr
+}
+
+func (b *postgresBus) listen() {
+	defer b.wg.Done()
+
+	cleanup := time.NewTicker(storedEventRetention)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case n := <-b.listener.Notify:
+			if n == nil {
+				// The listener reconnected; anything sent meanwhile is lost.
+				log.Printf("events: postgres listener reconnected, events may have been missed")
+				continue
+			}
+			b.handleNotification(n.Extra)
+		case <-time.After(listenerPingInterval):
+			go func() {
+				if err := b.listener.Ping(); err != nil {
+					log.Printf("events: postgres listener ping failed: %v", err)
+				}
+			}()
+		case <-cleanup.C:
+			b.deleteExpiredEvents()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *postgresBus) handleNotification(payload string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		log.Printf("events: failed to decode notification: %v", err)
+		return
+	}
+
+	if n.Ref != 0 {
+		var stored string
+		err := b.db.QueryRowContext(ctx, `SELECT payload FROM bus_events WHERE id = $1`, n.Ref).Scan(&stored)
+		if err != nil {
+			log.Printf("events: failed to load stored event %d: %v", n.Ref, err)
+			return
+		}
+		if err := json.Unmarshal([]byte(stored), &n); err != nil {
+			log.Printf("events: failed to decode stored event %d: %v", n.Ref, err)
+			return
+		}
+	}
+
+	event := &Event{
+		Type:       n.Type,
+		Recipients: n.Recipients,
+		Data:       n.Data,
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handler := range b.handlers {
+		handler(ctx, event)
+	}
+}
+
+func (b *postgresBus) deleteExpiredEvents() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM bus_events WHERE created_at < NOW() - make_interval(secs => $1)`
+	if _, err := b.db.ExecContext(ctx, query, storedEventRetention.Seconds()); err != nil {
+		log.Printf("events: failed to delete expired events: %v", err)
+	}
+}
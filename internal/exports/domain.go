@@ -0,0 +1,120 @@
+package exports
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	exportDownloadPurpose = "data_export_download"
+
+	// An export still processing after this long was given up by the
+	// instance building it, e.g. because it was stopped, and is built again
+	staleExportAfter = 30 * time.Minute
+	// Downloaded archives are kept a little longer, so a download in
+	// progress is not cut off
+	downloadedExportGrace = time.Hour
+
+	exportBatchSize         = 100
+	exportMessagesBatchSize = 1000
+)
+
+type ExportStatus string
+
+const (
+	ExportStatusPending    ExportStatus = "pending"
+	ExportStatusProcessing ExportStatus = "processing"
+	ExportStatusReady      ExportStatus = "ready"
+	ExportStatusDownloaded ExportStatus = "downloaded"
+	ExportStatusExpired    ExportStatus = "expired"
+	ExportStatusFailed     ExportStatus = "failed"
+)
+
+type DataExport struct {
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	Status       ExportStatus
+	BlobKey      *string
+	Size         *int64
+	StartedAt    *time.Time
+	CompletedAt  *time.Time
+	ExpiresAt    *time.Time
+	DownloadedAt *time.Time
+	CreatedAt    time.Time
+
+	// Signed one-time download link, set when a ready export is handed to
+	// its owner
+	DownloadURL *string
+}
+
+// exportDownloadClaims is what a signed download link grants access to.
+type exportDownloadClaims struct {
+	ExportID uuid.UUID `json:"eid"`
+}
+
+// ExportDownload is the archive behind a download link.
+type ExportDownload struct {
+	Filename string
+	Size     int64
+	Body     io.ReadCloser
+}
+
+// The types below are written to the archive as JSON.
+
+type ProfileExport struct {
+	ID              uuid.UUID  `json:"id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	DisplayName     *string    `json:"display_name"`
+	Bio             *string    `json:"bio"`
+	AvatarURL       *string    `json:"avatar_url"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+type RelationshipExport struct {
+	UserID             uuid.UUID `json:"user_id"`
+	Username           string    `json:"username"`
+	RelationshipStatus string    `json:"relationship_status"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+type ChannelMembershipExport struct {
+	ChannelID uuid.UUID `json:"channel_id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Owner     bool      `json:"owner"`
+	Hidden    bool      `json:"hidden"`
+	JoinedAt  time.Time `json:"joined_at"`
+}
+
+type MessageExport struct {
+	ID          uuid.UUID           `json:"id"`
+	ChannelID   uuid.UUID           `json:"channel_id"`
+	Content     string              `json:"content"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+	Attachments []*AttachmentExport `json:"attachments"`
+}
+
+type AttachmentExport struct {
+	ID          uuid.UUID `json:"id"`
+	MessageID   uuid.UUID `json:"-"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type DataExportResponse struct {
+	ID          uuid.UUID  `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DownloadURL *string    `json:"download_url,omitempty"`
+}
@@ -0,0 +1,103 @@
+package exports
+
+import (
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal"
+)
+
+type ExportsHandler struct {
+	service ExportsService
+}
+
+func NewExportsHandler(service ExportsService) *ExportsHandler {
+	return &ExportsHandler{service: service}
+}
+
+func (h *ExportsHandler) RequestExport(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("exports: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	export, err := h.service.RequestExport(c.Request.Context(), userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"export": toDataExportResponse(export),
+	})
+}
+
+func (h *ExportsHandler) GetLatestExport(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("exports: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	export, err := h.service.GetLatestExport(c.Request.Context(), userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"export": toDataExportResponse(export),
+	})
+}
+
+func (h *ExportsHandler) DownloadExport(c *gin.Context) {
+	exportID, err := uuid.Parse(c.Param("export_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid export id"))
+		return
+	}
+
+	download, err := h.service.DownloadExport(c.Request.Context(), exportID, c.Query("token"))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	defer download.Body.Close()
+
+	c.DataFromReader(http.StatusOK, download.Size, "application/zip", download.Body, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": download.Filename}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "no-store",
+	})
+}
+
+func toDataExportResponse(export *DataExport) *DataExportResponse {
+	return &DataExportResponse{
+		ID:          export.ID,
+		Status:      string(export.Status),
+		CreatedAt:   export.CreatedAt,
+		CompletedAt: export.CompletedAt,
+		ExpiresAt:   export.ExpiresAt,
+		DownloadURL: export.DownloadURL,
+	}
+}
@@ -0,0 +1,456 @@
+package exports
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type ExportsRepo interface {
+	SaveExport(ctx context.Context, userID uuid.UUID) (*DataExport, error)
+	FindActiveExport(ctx context.Context, userID uuid.UUID) (*DataExport, error)
+	FindLatestExport(ctx context.Context, userID uuid.UUID) (*DataExport, error)
+	ClaimPendingExport(ctx context.Context) (*DataExport, error)
+	CompleteExport(ctx context.Context, exportID uuid.UUID, blobKey string, size int64, expiresAt time.Time) (bool, error)
+	FailExport(ctx context.Context, exportID uuid.UUID) error
+	FindReadyExport(ctx context.Context, exportID uuid.UUID) (*DataExport, error)
+	ConsumeExport(ctx context.Context, exportID uuid.UUID) (bool, error)
+	FindExpiredExports(ctx context.Context, limit int) ([]*DataExport, error)
+	RemoveExportArchive(ctx context.Context, exportID uuid.UUID) error
+	FindProfile(ctx context.Context, userID uuid.UUID) (*ProfileExport, error)
+	FindRelationships(ctx context.Context, userID uuid.UUID) ([]*RelationshipExport, error)
+	FindChannelMemberships(ctx context.Context, userID uuid.UUID) ([]*ChannelMembershipExport, error)
+	FindMessagesByAuthor(ctx context.Context, userID uuid.UUID, after *MessageExport, limit int) ([]*MessageExport, error)
+}
+
+type exportsRepo struct {
+	db *sql.DB
+}
+
+func NewExportsRepo(db *sql.DB) ExportsRepo {
+	return &exportsRepo{db: db}
+}
+
+const exportColumns = `id, user_id, status, blob_key, size, started_at, completed_at, expires_at, downloaded_at, created_at`
+
+// SaveExport creates a pending export for the user. It returns nil if the user
+// already has one pending or processing.
+func (r *exportsRepo) SaveExport(ctx context.Context, userID uuid.UUID) (*DataExport, error) {
+	query := `
+		INSERT INTO data_exports (user_id) VALUES ($1)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'processing') DO NOTHING
+		RETURNING ` + exportColumns
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return findExport(r.db.QueryRowContext(ctx, query, userID))
+}
+
+// FindActiveExport returns the pending or processing export of the user.
+func (r *exportsRepo) FindActiveExport(ctx context.Context, userID uuid.UUID) (*DataExport, error) {
+	query := `
+		SELECT ` + exportColumns + `
+		FROM data_exports
+		WHERE user_id = $1 AND status IN ('pending', 'processing')
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return findExport(r.db.QueryRowContext(ctx, query, userID))
+}
+
+func (r *exportsRepo) FindLatestExport(ctx context.Context, userID uuid.UUID) (*DataExport, error) {
+	query := `
+		SELECT ` + exportColumns + `
+		FROM data_exports
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return findExport(r.db.QueryRowContext(ctx, query, userID))
+}
+
+// ClaimPendingExport marks the oldest pending export as processing and
+// returns it, or nil if there is nothing to build. Exports other instances
+// are claiming at the same time are skipped, so each is built once.
+func (r *exportsRepo) ClaimPendingExport(ctx context.Context) (*DataExport, error) {
+	query := `
+		UPDATE data_exports SET status = 'processing', started_at = now()
+		WHERE id = (
+			SELECT id FROM data_exports
+			WHERE status = 'pending'
+				OR (status = 'processing' AND started_at < now() - make_interval(secs => $1))
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + exportColumns
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return findExport(r.db.QueryRowContext(ctx, query, staleExportAfter.Seconds()))
+}
+
+// CompleteExport marks a processing export as ready. It returns false if the
+// export is not processing anymore, e.g. because it was built by another
+// instance or removed with its user.
+func (r *exportsRepo) CompleteExport(ctx context.Context, exportID uuid.UUID, blobKey string, size int64, expiresAt time.Time) (bool, error) {
+	query := `
+		UPDATE data_exports
+		SET status = 'ready', blob_key = $2, size = $3, completed_at = now(), expires_at = $4
+		WHERE id = $1 AND status = 'processing'
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, query, exportID, blobKey, size, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (r *exportsRepo) FailExport(ctx context.Context, exportID uuid.UUID) error {
+	query := `UPDATE data_exports SET status = 'failed', completed_at = now() WHERE id = $1 AND status = 'processing'`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, exportID)
+	return err
+}
+
+// FindReadyExport returns the export if it is ready and has not expired.
+func (r *exportsRepo) FindReadyExport(ctx context.Context, exportID uuid.UUID) (*DataExport, error) {
+	query := `
+		SELECT ` + exportColumns + `
+		FROM data_exports
+		WHERE id = $1 AND status = 'ready' AND expires_at > now()
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return findExport(r.db.QueryRowContext(ctx, query, exportID))
+}
+
+// ConsumeExport marks a ready export as downloaded. It returns false if it is
+// not ready or has expired, so only one caller ever consumes the export.
+func (r *exportsRepo) ConsumeExport(ctx context.Context, exportID uuid.UUID) (bool, error) {
+	query := `
+		UPDATE data_exports SET status = 'downloaded', downloaded_at = now()
+		WHERE id = $1 AND status = 'ready' AND expires_at > now()
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, query, exportID)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// FindExpiredExports returns up to limit exports whose archive is not needed
+// anymore, because it expired or was downloaded.
+func (r *exportsRepo) FindExpiredExports(ctx context.Context, limit int) ([]*DataExport, error) {
+	query := `
+		SELECT ` + exportColumns + `
+		FROM data_exports
+		WHERE blob_key IS NOT NULL AND (
+			(status = 'ready' AND expires_at <= now())
+			OR (status = 'downloaded' AND downloaded_at < now() - make_interval(secs => $1))
+		)
+		ORDER BY created_at
+		LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, downloadedExportGrace.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []*DataExport{}
+	for rows.Next() {
+		export, err := scanExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+
+	return exports, rows.Err()
+}
+
+// RemoveExportArchive forgets the archive of an export after it was deleted.
+// Exports that were never downloaded become expired.
+func (r *exportsRepo) RemoveExportArchive(ctx context.Context, exportID uuid.UUID) error {
+	query := `
+		UPDATE data_exports
+		SET blob_key = NULL, status = CASE WHEN status = 'ready' THEN 'expired' ELSE status END
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, exportID)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanExport(row rowScanner) (*DataExport, error) {
+	export := &DataExport{}
+	err := row.Scan(
+		&export.ID,
+		&export.UserID,
+		&export.Status,
+		&export.BlobKey,
+		&export.Size,
+		&export.StartedAt,
+		&export.CompletedAt,
+		&export.ExpiresAt,
+		&export.DownloadedAt,
+		&export.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func findExport(row *sql.Row) (*DataExport, error) {
+	export, err := scanExport(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func (r *exportsRepo) FindProfile(ctx context.Context, userID uuid.UUID) (*ProfileExport, error) {
+	query := `
+		SELECT id, username, email, email_verified_at, display_name, bio, avatar_url, created_at, updated_at
+		FROM users
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	profile := &ProfileExport{}
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(
+		&profile.ID,
+		&profile.Username,
+		&profile.Email,
+		&profile.EmailVerifiedAt,
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.AvatarURL,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+func (r *exportsRepo) FindRelationships(ctx context.Context, userID uuid.UUID) ([]*RelationshipExport, error) {
+	query := `
+		SELECT r.other_user_id, u.username, r.relationship_status, r.created_at, r.updated_at
+		FROM relationships r
+		JOIN users u ON u.id = r.other_user_id
+		WHERE r.user_id = $1
+		ORDER BY r.created_at, r.id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	relationships := []*RelationshipExport{}
+	for rows.Next() {
+		relationship := &RelationshipExport{}
+		err := rows.Scan(
+			&relationship.UserID,
+			&relationship.Username,
+			&relationship.RelationshipStatus,
+			&relationship.CreatedAt,
+			&relationship.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		relationships = append(relationships, relationship)
+	}
+
+	return relationships, rows.Err()
+}
+
+func (r *exportsRepo) FindChannelMemberships(ctx context.Context, userID uuid.UUID) ([]*ChannelMembershipExport, error) {
+	query := `
+		SELECT c.id, c.name, c.type, c.owner_id = $1, COALESCE(cm.channel_hidden, FALSE), cm.joined_at
+		FROM channel_members cm
+		JOIN channels c ON c.id = cm.channel_id
+		WHERE cm.user_id = $1
+		ORDER BY cm.joined_at, c.id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*ChannelMembershipExport{}
+	for rows.Next() {
+		membership := &ChannelMembershipExport{}
+		var owner sql.NullBool
+		err := rows.Scan(
+			&membership.ChannelID,
+			&membership.Name,
+			&membership.Type,
+			&owner,
+			&membership.Hidden,
+			&membership.JoinedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		membership.Owner = owner.Bool
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+// FindMessagesByAuthor returns up to limit messages of the author sent after
+// the given message, oldest first, with their attachments. A nil after starts
+// from the first message.
+func (r *exportsRepo) FindMessagesByAuthor(ctx context.Context, userID uuid.UUID, after *MessageExport, limit int) ([]*MessageExport, error) {
+	query := `
+		SELECT id, channel_id, content, created_at, updated_at
+		FROM messages
+		WHERE author_id = $1
+		ORDER BY created_at, id
+		LIMIT $2
+	`
+	args := []interface{}{userID, limit}
+	if after != nil {
+		query = `
+			SELECT id, channel_id, content, created_at, updated_at
+			FROM messages
+			WHERE author_id = $1 AND (created_at, id) > ($3, $4)
+			ORDER BY created_at, id
+			LIMIT $2
+		`
+		args = append(args, after.CreatedAt, after.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*MessageExport{}
+	byID := map[uuid.UUID]*MessageExport{}
+	for rows.Next() {
+		message := &MessageExport{Attachments: []*AttachmentExport{}}
+		err := rows.Scan(
+			&message.ID,
+			&message.ChannelID,
+			&message.Content,
+			&message.CreatedAt,
+			&message.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+		byID[message.ID] = message
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	messageIDs := make([]uuid.UUID, 0, len(messages))
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+	}
+
+	attachmentsQuery := `
+		SELECT id, message_id, filename, content_type, size, created_at
+		FROM attachments
+		WHERE message_id = ANY($1)
+		ORDER BY created_at, id
+	`
+	attachmentRows, err := r.db.QueryContext(ctx, attachmentsQuery, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer attachmentRows.Close()
+
+	for attachmentRows.Next() {
+		attachment := &AttachmentExport{}
+		err := attachmentRows.Scan(
+			&attachment.ID,
+			&attachment.MessageID,
+			&attachment.Filename,
+			&attachment.ContentType,
+			&attachment.Size,
+			&attachment.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		message := byID[attachment.MessageID]
+		message.Attachments = append(message.Attachments, attachment)
+	}
+
+	return messages, attachmentRows.Err()
+}
@@ -0,0 +1,354 @@
+package exports
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/blob"
+)
+
+// ExportsService builds archives of everything a user has stored, so they
+// can take their data with them. Archives are built by a background job and
+// can be downloaded once through a signed link.
+type ExportsService interface {
+	RequestExport(ctx context.Context, userID uuid.UUID) (*DataExport, error)
+	GetLatestExport(ctx context.Context, userID uuid.UUID) (*DataExport, error)
+	DownloadExport(ctx context.Context, exportID uuid.UUID, token string) (*ExportDownload, error)
+	ProcessExports(ctx context.Context) error
+}
+
+type exportsService struct {
+	repo   ExportsRepo
+	blobs  blob.BlobStore
+	signer *internal.Signer
+	ttl    time.Duration
+}
+
+func NewExportsService(repo ExportsRepo, blobs blob.BlobStore, signer *internal.Signer, cfg config.Config) ExportsService {
+	return &exportsService{
+		repo:   repo,
+		blobs:  blobs,
+		signer: signer,
+		ttl:    time.Duration(cfg.DataExportTTLSecond) * time.Second,
+	}
+}
+
+// RequestExport queues an export for the user. Asking again while one is
+// being built returns that one.
+func (s *exportsService) RequestExport(ctx context.Context, userID uuid.UUID) (*DataExport, error) {
+	export, err := s.repo.SaveExport(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not save export: %w", err)
+	}
+
+	if export != nil {
+		return export, nil
+	}
+
+	export, err = s.repo.FindActiveExport(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get active export: %w", err)
+	}
+
+	// The active export finished in the meantime
+	if export == nil {
+		return s.RequestExport(ctx, userID)
+	}
+
+	return export, nil
+}
+
+// GetLatestExport returns the most recent export of the user, with a download
+// link if it is ready.
+func (s *exportsService) GetLatestExport(ctx context.Context, userID uuid.UUID) (*DataExport, error) {
+	export, err := s.repo.FindLatestExport(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get export: %w", err)
+	}
+
+	if export == nil {
+		return nil, internal.NewNotFoundError("No data export requested")
+	}
+
+	if export.Status == ExportStatusReady && export.ExpiresAt.After(time.Now()) {
+		token, err := s.signer.Sign(exportDownloadPurpose, &exportDownloadClaims{ExportID: export.ID}, time.Until(*export.ExpiresAt))
+		if err != nil {
+			return nil, fmt.Errorf("could not sign download link: %w", err)
+		}
+
+		downloadURL := "/api/v1/exports/" + export.ID.String() + "?token=" + url.QueryEscape(token)
+		export.DownloadURL = &downloadURL
+	}
+
+	return export, nil
+}
+
+// DownloadExport returns the archive behind a download link. The link works
+// once, later attempts get a not found error. The export is only used up once
+// its archive could be opened, so a failed attempt can be retried.
+func (s *exportsService) DownloadExport(ctx context.Context, exportID uuid.UUID, token string) (*ExportDownload, error) {
+	var claims exportDownloadClaims
+	if err := s.signer.Verify(exportDownloadPurpose, token, &claims); err != nil {
+		return nil, internal.NewForbiddenError("Invalid or expired download link")
+	}
+
+	if claims.ExportID != exportID {
+		return nil, internal.NewForbiddenError("Invalid or expired download link")
+	}
+
+	export, err := s.repo.FindReadyExport(ctx, exportID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get export: %w", err)
+	}
+
+	if export == nil {
+		return nil, internal.NewNotFoundError("Data export not found or already downloaded")
+	}
+
+	body, err := s.blobs.Get(ctx, *export.BlobKey)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, internal.NewNotFoundError("Data export not found or already downloaded")
+		}
+		return nil, fmt.Errorf("could not get export blob: %w", err)
+	}
+
+	consumed, err := s.repo.ConsumeExport(ctx, exportID)
+	if err != nil || !consumed {
+		body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not consume export: %w", err)
+	}
+
+	// Someone else downloaded the export in the meantime
+	if !consumed {
+		return nil, internal.NewNotFoundError("Data export not found or already downloaded")
+	}
+
+	return &ExportDownload{
+		Filename: "relay-export-" + export.CreatedAt.UTC().Format("2006-01-02") + ".zip",
+		Size:     *export.Size,
+		Body:     body,
+	}, nil
+}
+
+// ProcessExports removes archives that are not needed anymore and builds
+// every pending export. It is run periodically by a background job.
+func (s *exportsService) ProcessExports(ctx context.Context) error {
+	if err := s.removeExpiredExports(ctx); err != nil {
+		return err
+	}
+
+	for {
+		export, err := s.repo.ClaimPendingExport(ctx)
+		if err != nil {
+			return fmt.Errorf("claim pending export: %w", err)
+		}
+
+		if export == nil {
+			return nil
+		}
+
+		if err := s.buildExport(ctx, export); err != nil {
+			// Exports interrupted by a shutdown are picked up again once
+			// they are stale
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log.Printf("exports: failed to build export %s: %v", export.ID, err)
+			if err := s.repo.FailExport(ctx, export.ID); err != nil {
+				return fmt.Errorf("fail export %s: %w", export.ID, err)
+			}
+		}
+	}
+}
+
+func (s *exportsService) removeExpiredExports(ctx context.Context) error {
+	for {
+		exports, err := s.repo.FindExpiredExports(ctx, exportBatchSize)
+		if err != nil {
+			return fmt.Errorf("find expired exports: %w", err)
+		}
+
+		for _, export := range exports {
+			if err := s.blobs.Delete(ctx, *export.BlobKey); err != nil {
+				return fmt.Errorf("delete export blob %s: %w", *export.BlobKey, err)
+			}
+
+			if err := s.repo.RemoveExportArchive(ctx, export.ID); err != nil {
+				return fmt.Errorf("remove export archive %s: %w", export.ID, err)
+			}
+		}
+
+		if len(exports) < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+// buildExport writes the archive of an export to a temporary file and
+// stores it. Every build gets its own key, so a build that lost the export to
+// another instance only removes its own archive.
+func (s *exportsService) buildExport(ctx context.Context, export *DataExport) error {
+	tmp, err := os.CreateTemp("", "relay-export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := s.writeArchive(ctx, tmp, export.UserID); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("exports/%s/%s.zip", export.UserID, uuid.New())
+	if err := s.blobs.Put(ctx, key, tmp, size, "application/zip"); err != nil {
+		return fmt.Errorf("store archive: %w", err)
+	}
+
+	completed, err := s.repo.CompleteExport(ctx, export.ID, key, size, time.Now().Add(s.ttl))
+	if err != nil || !completed {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			log.Printf("exports: failed to delete archive %s: %v", key, err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("complete export: %w", err)
+	}
+
+	if completed {
+		log.Printf("exports: export %s is ready", export.ID)
+	}
+
+	return nil
+}
+
+// writeArchive writes the data of a user as a ZIP archive of JSON files.
+func (s *exportsService) writeArchive(ctx context.Context, w io.Writer, userID uuid.UUID) error {
+	profile, err := s.repo.FindProfile(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("find profile: %w", err)
+	}
+
+	if profile == nil {
+		return errors.New("user not found")
+	}
+
+	relationships, err := s.repo.FindRelationships(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("find relationships: %w", err)
+	}
+
+	memberships, err := s.repo.FindChannelMemberships(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("find channel memberships: %w", err)
+	}
+
+	archive := zip.NewWriter(w)
+
+	if err := writeJSONFile(archive, "profile.json", profile); err != nil {
+		return err
+	}
+
+	if err := writeJSONFile(archive, "relationships.json", relationships); err != nil {
+		return err
+	}
+
+	if err := writeJSONFile(archive, "channels.json", memberships); err != nil {
+		return err
+	}
+
+	if err := s.writeMessages(ctx, archive, userID); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// writeMessages writes the messages of the author as one JSON array. Users
+// can have sent a lot of messages, so they are read and written in batches.
+func (s *exportsService) writeMessages(ctx context.Context, archive *zip.Writer, userID uuid.UUID) error {
+	f, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(f, "["); err != nil {
+		return err
+	}
+
+	var last *MessageExport
+	for {
+		messages, err := s.repo.FindMessagesByAuthor(ctx, userID, last, exportMessagesBatchSize)
+		if err != nil {
+			return fmt.Errorf("find messages: %w", err)
+		}
+
+		for _, message := range messages {
+			separator := ",\n  "
+			if last == nil {
+				separator = "\n  "
+			}
+
+			data, err := json.MarshalIndent(message, "  ", "  ")
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.WriteString(f, separator); err != nil {
+				return err
+			}
+
+			if _, err := f.Write(data); err != nil {
+				return err
+			}
+
+			last = message
+		}
+
+		if len(messages) < exportMessagesBatchSize {
+			break
+		}
+	}
+
+	closing := "]\n"
+	if last != nil {
+		closing = "\n]\n"
+	}
+
+	_, err = io.WriteString(f, closing)
+	return err
+}
+
+func writeJSONFile(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connection is a transport attached to a session. It only lives as long as
+// the underlying request; the session outlives it so it can be resumed.
+type connection interface {
+	// enqueue queues a payload for delivery without blocking and reports
+	// whether it was accepted.
+	enqueue(payload *Payload) bool
+	close()
+	shutdown()
+	// revoke ends the connection because the session was revoked, so the
+	// client does not try to resume it.
+	revoke()
+}
+
+// wsConnection is a WebSocket attached to a session.
+type wsConnection struct {
+	ws        *websocket.Conn
+	send      chan *Payload
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSConnection(ws *websocket.Conn) *wsConnection {
+	return &wsConnection{
+		ws:   ws,
+		send: make(chan *Payload, sendBufferSize),
+		done: make(chan struct{}),
+	}
+}
+
+// enqueue closes a connection whose buffer is full so one slow client cannot
+// hold up the hub.
+func (c *wsConnection) enqueue(payload *Payload) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+func (c *wsConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *wsConnection) shutdown() {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	if err := c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+		log.Printf("gateway: failed to send close frame: %v", err)
+	}
+	c.close()
+}
+
+func (c *wsConnection) revoke() {
+	message := websocket.FormatCloseMessage(closeSessionRevoked, "session revoked")
+	if err := c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+		log.Printf("gateway: failed to send close frame: %v", err)
+	}
+	c.close()
+}
+
+// run pumps payloads in both directions and returns once the socket is gone.
+func (c *wsConnection) run() {
+	go c.writePump()
+	c.readPump()
+}
+
+func (c *wsConnection) readPump() {
+	defer c.close()
+
+	c.ws.SetReadLimit(maxMessageSize)
+	_ = c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("gateway: connection closed unexpectedly: %v", err)
+			}
+			return
+		}
+
+		_ = c.ws.SetReadDeadline(time.Now().Add(pongWait))
+
+		var payload Payload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			continue
+		}
+
+		switch payload.Op {
+		case OpcodeHeartbeat:
+			c.enqueue(&Payload{Op: OpcodeHeartbeatAck})
+		}
+	}
+}
+
+func (c *wsConnection) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+	}()
+
+	for {
+		select {
+		case payload := <-c.send:
+			_ = c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteJSON(payload); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			_ = c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
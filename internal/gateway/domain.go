@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal/events"
+)
+
+const (
+	// Time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed without hearing from the peer before the session is dropped.
+	pongWait = 60 * time.Second
+
+	// How often the server pings the peer. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// How often clients that cannot send ping frames should send a heartbeat.
+	heartbeatInterval = 30 * time.Second
+
+	// Maximum size of a frame read from the peer.
+	maxMessageSize = 4096
+
+	// Outgoing payloads buffered per connection before it is considered too
+	// slow. It has room for a full replay on top of live traffic.
+	sendBufferSize = replayBufferSize + 256
+
+	// Dispatched payloads kept per session so a resuming client can catch up.
+	replayBufferSize = 256
+
+	// How long a disconnected session is kept around to be resumed.
+	resumeTimeout = 2 * time.Minute
+
+	// WebSocket close code sent when the tokens of the user were revoked,
+	// e.g. because they logged out everywhere. Clients should not reconnect
+	// with the same token.
+	closeSessionRevoked = 4001
+)
+
+type Opcode string
+
+const (
+	OpcodeHello          Opcode = "hello"
+	OpcodeDispatch       Opcode = "dispatch"
+	OpcodeHeartbeat      Opcode = "heartbeat"
+	OpcodeHeartbeatAck   Opcode = "heartbeat_ack"
+	OpcodeResumed        Opcode = "resumed"
+	OpcodeInvalidSession Opcode = "invalid_session"
+)
+
+// Payload is a single frame sent to the client. Only dispatches carry a
+// sequence number; it increases by one for every event of a session.
+type Payload struct {
+	Op   Opcode           `json:"op"`
+	Type events.EventType `json:"t,omitempty"`
+	Seq  int64            `json:"s,omitempty"`
+	Data interface{}      `json:"d,omitempty"`
+}
+
+// ConnectRequest optionally resumes an earlier session, replaying every
+// event dispatched after Seq.
+type ConnectRequest struct {
+	SessionID string `form:"session_id"`
+	Seq       int64  `form:"seq" validate:"min=0"`
+}
+
+type HelloData struct {
+	SessionID         uuid.UUID `json:"session_id"`
+	HeartbeatInterval int64     `json:"heartbeat_interval"`
+}
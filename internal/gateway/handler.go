@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jakottelaar/relay-backend/internal"
+)
+
+type GatewayHandler struct {
+	hub      *Hub
+	upgrader websocket.Upgrader
+}
+
+func NewGatewayHandler(hub *Hub) *GatewayHandler {
+	return &GatewayHandler{
+		hub: hub,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			// Sessions are authenticated with a bearer token rather than
+			// cookies, so cross-origin clients are allowed to connect.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+func (h *GatewayHandler) Connect(c *gin.Context) {
+	currentUserID, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserID.(string))
+	if err != nil {
+		log.Printf("gateway: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req ConnectRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid query parameters"))
+		return
+	}
+
+	validate := validator.New()
+
+	if err := validate.Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	ws, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already written an error response.
+		log.Printf("gateway: failed to upgrade connection: %v", err)
+		return
+	}
+
+	conn := newWSConnection(ws)
+
+	session, err := h.attachSession(userID, &req, conn)
+	if err != nil {
+		conn.shutdown()
+		ws.Close()
+		return
+	}
+	defer h.hub.disconnect(session, conn)
+
+	conn.run()
+}
+
+// Stream serves the same events as the WebSocket gateway as Server-Sent
+// Events, for clients behind proxies that do not allow WebSocket upgrades.
+func (h *GatewayHandler) Stream(c *gin.Context) {
+	currentUserID, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserID.(string))
+	if err != nil {
+		log.Printf("gateway: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	req := &ConnectRequest{}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		// EventSource cannot set headers on the first request, so allow
+		// the same value as a query parameter.
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		parsed, ok := parseEventID(lastEventID)
+		if !ok {
+			_ = c.Error(internal.NewBadRequestError("Invalid Last-Event-ID"))
+			return
+		}
+		req = parsed
+	}
+
+	// Streams stay open far longer than the server's write timeout.
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("gateway: failed to clear write deadline: %v", err)
+	}
+
+	conn := newSSEConnection()
+
+	session, err := h.attachSession(userID, req, conn)
+	if err != nil {
+		_ = c.Error(internal.NewServiceUnavailableError("Server is shutting down"))
+		return
+	}
+	defer h.hub.disconnect(session, conn)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	resumedSessionID, _ := uuid.Parse(req.SessionID)
+	conn.run(c, resumedSessionID)
+}
+
+// attachSession resumes the requested session when possible. Otherwise the
+// client is told to resync its state and a fresh session is started.
+func (h *GatewayHandler) attachSession(userID uuid.UUID, req *ConnectRequest, conn connection) (*Session, error) {
+	if req.SessionID == "" {
+		return h.hub.connect(userID, conn)
+	}
+
+	sessionID, err := uuid.Parse(req.SessionID)
+	if err == nil {
+		session, err := h.hub.resume(userID, sessionID, req.Seq, conn)
+		if err == nil {
+			return session, nil
+		}
+		if err == ErrHubClosed {
+			return nil, err
+		}
+	}
+
+	conn.enqueue(&Payload{Op: OpcodeInvalidSession})
+
+	return h.hub.connect(userID, conn)
+}
@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal/events"
+)
+
+var (
+	ErrHubClosed      = errors.New("gateway hub closed")
+	ErrInvalidSession = errors.New("gateway session cannot be resumed")
+)
+
+// Hub keeps track of every session, connected or waiting to be resumed, and
+// fans events out to the sessions of their recipients.
+type Hub struct {
+	mu           sync.RWMutex
+	sessions     map[uuid.UUID]*Session
+	userSessions map[uuid.UUID]map[uuid.UUID]*Session
+	closed       bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		sessions:     make(map[uuid.UUID]*Session),
+		userSessions: make(map[uuid.UUID]map[uuid.UUID]*Session),
+	}
+}
+
+// Dispatch delivers an event to every session of its recipients on this
+// instance. It is subscribed to the event bus, which brings in events
+// published on any instance.
+func (h *Hub) Dispatch(ctx context.Context, event *events.Event) {
+	if event.Type == events.EventTypeSessionsRevoked {
+		h.revoke(event.Recipients)
+		return
+	}
+
+	payload := &Payload{
+		Op:   OpcodeDispatch,
+		Type: event.Type,
+		Data: event.Data,
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, userID := range event.Recipients {
+		for _, session := range h.userSessions[userID] {
+			session.dispatch(payload)
+		}
+	}
+}
+
+// connect starts a new session for the user with conn attached.
+func (h *Hub) connect(userID uuid.UUID, conn connection) (*Session, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrHubClosed
+	}
+
+	session := newSession(userID)
+	session.attach(conn, 0, false)
+
+	h.sessions[session.ID] = session
+	if h.userSessions[userID] == nil {
+		h.userSessions[userID] = make(map[uuid.UUID]*Session)
+	}
+	h.userSessions[userID][session.ID] = session
+
+	return session, nil
+}
+
+// resume attaches conn to an existing session of the user, replaying the
+// events dispatched after lastSeq.
+func (h *Hub) resume(userID, sessionID uuid.UUID, lastSeq int64, conn connection) (*Session, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrHubClosed
+	}
+
+	session, ok := h.sessions[sessionID]
+	if !ok || session.UserID != userID {
+		return nil, ErrInvalidSession
+	}
+
+	if !session.attach(conn, lastSeq, true) {
+		return nil, ErrInvalidSession
+	}
+
+	return session, nil
+}
+
+// disconnect detaches conn from its session, leaving the session resumable
+// for a while.
+func (h *Hub) disconnect(session *Session, conn connection) {
+	session.detach(conn, h.expire)
+}
+
+func (h *Hub) expire(session *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The session may have been resumed while the timer fired.
+	if !session.detached() {
+		return
+	}
+
+	delete(h.sessions, session.ID)
+	delete(h.userSessions[session.UserID], session.ID)
+	if len(h.userSessions[session.UserID]) == 0 {
+		delete(h.userSessions, session.UserID)
+	}
+}
+
+// revoke ends every session of the users for good. Their tokens were
+// revoked, so the sessions must neither receive events nor be resumed.
+func (h *Hub) revoke(userIDs []uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, userID := range userIDs {
+		for _, session := range h.userSessions[userID] {
+			session.revoke()
+			delete(h.sessions, session.ID)
+		}
+		delete(h.userSessions, userID)
+	}
+}
+
+// Close tells every connected client the server is going away and stops
+// accepting new sessions.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, session := range h.sessions {
+		session.shutdown()
+	}
+}
@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is the server side state of one logged in client. A user may have
+// several sessions open at once, e.g. a desktop and a mobile client. Each
+// session numbers its events and keeps the most recent ones, so a client
+// that briefly loses its connection can resume without missing anything.
+type Session struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+
+	mu     sync.Mutex
+	seq    int64
+	buffer []*Payload
+	conn   connection
+	expiry *time.Timer
+}
+
+func newSession(userID uuid.UUID) *Session {
+	return &Session{
+		ID:     uuid.New(),
+		UserID: userID,
+	}
+}
+
+// dispatch assigns the next sequence number to an event, keeps it for replay
+// and delivers it if a connection is attached.
+func (s *Session) dispatch(payload *Payload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	sequenced := *payload
+	sequenced.Seq = s.seq
+
+	s.buffer = append(s.buffer, &sequenced)
+	if len(s.buffer) > replayBufferSize {
+		s.buffer = append([]*Payload(nil), s.buffer[len(s.buffer)-replayBufferSize:]...)
+	}
+
+	if s.conn != nil && !s.conn.enqueue(&sequenced) {
+		log.Printf("gateway: dropping slow connection of session %s", s.ID)
+	}
+}
+
+// attach makes conn the session's live connection, replacing any previous
+// one. When resuming, every event after lastSeq is replayed first; attach
+// fails if some of those events have already been evicted.
+func (s *Session) attach(conn connection, lastSeq int64, resume bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if resume && !s.canReplayFrom(lastSeq) {
+		return false
+	}
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+
+	if s.conn != nil {
+		s.conn.close()
+	}
+	s.conn = conn
+
+	conn.enqueue(&Payload{
+		Op: OpcodeHello,
+		Data: &HelloData{
+			SessionID:         s.ID,
+			HeartbeatInterval: heartbeatInterval.Milliseconds(),
+		},
+	})
+
+	if resume {
+		for _, payload := range s.buffer {
+			if payload.Seq > lastSeq {
+				conn.enqueue(payload)
+			}
+		}
+		conn.enqueue(&Payload{Op: OpcodeResumed})
+	}
+
+	return true
+}
+
+func (s *Session) canReplayFrom(lastSeq int64) bool {
+	if lastSeq > s.seq {
+		return false
+	}
+	if lastSeq == s.seq {
+		return true
+	}
+	return len(s.buffer) > 0 && s.buffer[0].Seq <= lastSeq+1
+}
+
+// detach is called once conn is gone. The session stays resumable until
+// resumeTimeout passes, after which expire is called.
+func (s *Session) detach(conn connection, expire func(*Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != conn {
+		// Another connection has already taken over the session.
+		return
+	}
+
+	s.conn = nil
+	s.expiry = time.AfterFunc(resumeTimeout, func() {
+		expire(s)
+	})
+}
+
+// detached reports whether the session currently has no live connection.
+func (s *Session) detached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn == nil
+}
+
+func (s *Session) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+
+	if s.conn != nil {
+		s.conn.shutdown()
+		s.conn = nil
+	}
+}
+
+// revoke ends the session because the tokens of its user were revoked.
+func (s *Session) revoke() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+
+	if s.conn != nil {
+		s.conn.revoke()
+		s.conn = nil
+	}
+}
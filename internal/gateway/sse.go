@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// sseConnection is a Server-Sent Events stream attached to a session. It is
+// one way, so heartbeats are plain comments written by the server.
+type sseConnection struct {
+	send      chan *Payload
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSSEConnection() *sseConnection {
+	return &sseConnection{
+		send: make(chan *Payload, sendBufferSize),
+		done: make(chan struct{}),
+	}
+}
+
+// enqueue closes a stream whose buffer is full so one slow client cannot
+// hold up the hub.
+func (c *sseConnection) enqueue(payload *Payload) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+func (c *sseConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// shutdown ends the stream. EventSource clients reconnect on their own and
+// resume with the Last-Event-ID they last saw.
+func (c *sseConnection) shutdown() {
+	c.close()
+}
+
+// revoke ends the stream. EventSource clients reconnect on their own, which
+// fails now that their token is revoked.
+func (c *sseConnection) revoke() {
+	c.close()
+}
+
+// run writes payloads to the response until the stream or the request ends.
+// Every dispatch carries a "<session_id>:<seq>" event ID, which browsers
+// send back as Last-Event-ID when they reconnect.
+func (c *sseConnection) run(ctx *gin.Context, resumedSessionID uuid.UUID) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	var sessionID uuid.UUID
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case payload := <-c.send:
+			event := sse.Event{
+				Event: string(payload.Op),
+				Data:  payload,
+			}
+
+			switch payload.Op {
+			case OpcodeHello:
+				data := payload.Data.(*HelloData)
+				sessionID = data.SessionID
+				// A fresh session resets the ID the client resumes from.
+				if sessionID != resumedSessionID {
+					event.Id = formatEventID(sessionID, 0)
+				}
+			case OpcodeDispatch:
+				event.Id = formatEventID(sessionID, payload.Seq)
+			}
+
+			ctx.Render(-1, event)
+			return true
+		case <-ticker.C:
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		case <-c.done:
+			return false
+		case <-ctx.Request.Context().Done():
+			c.close()
+			return false
+		}
+	})
+}
+
+func formatEventID(sessionID uuid.UUID, seq int64) string {
+	return fmt.Sprintf("%s:%d", sessionID, seq)
+}
+
+// parseEventID splits a Last-Event-ID back into the session and sequence
+// number it was built from.
+func parseEventID(eventID string) (*ConnectRequest, bool) {
+	sessionID, rawSeq, found := strings.Cut(eventID, ":")
+	if !found {
+		return nil, false
+	}
+
+	seq, err := strconv.ParseInt(rawSeq, 10, 64)
+	if err != nil || seq < 0 {
+		return nil, false
+	}
+
+	return &ConnectRequest{SessionID: sessionID, Seq: seq}, true
+}
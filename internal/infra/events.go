@@ -0,0 +1,19 @@
+package infra
+
+import (
+	"database/sql"
+
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal/events"
+)
+
+// initializeEventBus picks the bus events are fanned out through. The local
+// bus only reaches clients connected to this instance.
+func initializeEventBus(cfg *config.Config, db *sql.DB) (events.Bus, error) {
+	switch cfg.EventBus {
+	case "local":
+		return events.NewLocalBus(), nil
+	default:
+		return events.NewPostgresBus(db, cfg.DSN)
+	}
+}
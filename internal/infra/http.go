@@ -12,7 +12,17 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jakottelaar/relay-backend/config"
 	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/auth"
+	"github.com/jakottelaar/relay-backend/internal/blob"
 	"github.com/jakottelaar/relay-backend/internal/channels"
+	"github.com/jakottelaar/relay-backend/internal/events"
+	"github.com/jakottelaar/relay-backend/internal/exports"
+	"github.com/jakottelaar/relay-backend/internal/gateway"
+	"github.com/jakottelaar/relay-backend/internal/lockout"
+	"github.com/jakottelaar/relay-backend/internal/mail"
+	"github.com/jakottelaar/relay-backend/internal/messages"
+	"github.com/jakottelaar/relay-backend/internal/mfa"
+	"github.com/jakottelaar/relay-backend/internal/oidc"
 	"github.com/jakottelaar/relay-backend/internal/relationships"
 	"github.com/jakottelaar/relay-backend/internal/users"
 )
@@ -21,9 +31,27 @@ type App struct {
 	HttpServer *http.Server
 	config     *config.Config
 	db         *sql.DB
+	hub        *gateway.Hub
+	bus        events.Bus
+	jobs       *scheduler
 }
 
 func NewApp(ctx context.Context, config *config.Config) (*App, error) {
+	keys, err := internal.NewKeySet(config)
+	if err != nil {
+		return nil, fmt.Errorf("load jwt keys: %w", err)
+	}
+
+	mailer, err := mail.NewMailer(config)
+	if err != nil {
+		return nil, fmt.Errorf("initialize mailer: %w", err)
+	}
+
+	blobs, err := blob.NewBlobStore(config)
+	if err != nil {
+		return nil, fmt.Errorf("initialize blob store: %w", err)
+	}
+
 	db, err := initializeDB(config.DSN)
 	if err != nil {
 		return nil, fmt.Errorf("initialize database: %w", err)
@@ -36,7 +64,27 @@ func NewApp(ctx context.Context, config *config.Config) (*App, error) {
 		gin.Recovery(),
 	)
 
-	registerRoutes(router, db, *config)
+	// Client IPs are used to throttle logins, so X-Forwarded-For may only be
+	// believed when it was set by one of our own proxies
+	if err := router.SetTrustedProxies(config.TrustedProxies); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("set trusted proxies: %w", err)
+	}
+
+	bus, err := initializeEventBus(config, db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initialize event bus: %w", err)
+	}
+
+	log.Printf("%s event bus started", config.EventBus)
+
+	hub := gateway.NewHub()
+	bus.Subscribe(hub.Dispatch)
+
+	jobs := newScheduler()
+
+	registerRoutes(router, db, *config, keys, mailer, blobs, hub, bus, jobs)
 
 	log.Println("routes registered")
 
@@ -52,66 +100,189 @@ func NewApp(ctx context.Context, config *config.Config) (*App, error) {
 		HttpServer: srv,
 		config:     config,
 		db:         db,
+		hub:        hub,
+		bus:        bus,
+		jobs:       jobs,
 	}, nil
 }
 
-func registerRoutes(r *gin.Engine, db *sql.DB, cfg config.Config) {
+func registerRoutes(r *gin.Engine, db *sql.DB, cfg config.Config, keys *internal.KeySet, mailer mail.Mailer, blobs blob.BlobStore, hub *gateway.Hub, bus events.Bus, jobs *scheduler) {
 
 	r.Use(internal.ErrorHandler())
 
 	r.GET("/health", handleHealth(db))
 
+	authRepo := auth.NewAuthRepo(db)
+	authService := auth.NewAuthService(authRepo, keys, bus, cfg)
+	authHandler := auth.NewAuthHandler(authService)
+
+	mfaRepo := mfa.NewMFARepo(db)
+	mfaService := mfa.NewMFAService(mfaRepo)
+
+	lockoutRepo := lockout.NewLockoutRepo(db)
+	lockoutService := lockout.NewLockoutService(lockoutRepo)
+
+	signer := internal.NewSigner(cfg.SigningSecret)
+
+	oidcService := oidc.NewOIDCService(cfg, signer)
+	oidcHandler := oidc.NewOIDCHandler(oidcService)
+
 	userRepo := users.NewUserRepo(db)
-	userService := users.NewUserService(userRepo, cfg)
-	userHandler := users.NewUserHandler(userService, cfg)
+	userService := users.NewUserService(userRepo, authService, mfaService, lockoutService, oidcService, mailer, blobs, signer, cfg)
+	userHandler := users.NewUserHandler(userService, authService, mfaService)
+
+	jobs.every("account deletion", time.Duration(cfg.AccountDeletionIntervalSecond)*time.Second, userService.DeleteDueAccounts)
+
+	exportsRepo := exports.NewExportsRepo(db)
+	exportsService := exports.NewExportsService(exportsRepo, blobs, signer, cfg)
+	exportsHandler := exports.NewExportsHandler(exportsService)
 
-	auth := r.Group("/api/v1/auth")
+	jobs.every("data exports", time.Duration(cfg.DataExportIntervalSecond)*time.Second, exportsService.ProcessExports)
+
+	r.GET("/.well-known/jwks.json", authHandler.GetJWKS)
+
+	// S3 buckets serve public blobs themselves
+	if cfg.BlobDriver == "local" {
+		r.GET("/blobs/*key", blob.ServePublic(blobs))
+	}
+
+	authRoutes := r.Group("/api/v1/auth")
 	{
-		auth.POST("/register", userHandler.RegisterUser)
-		auth.POST("/login", userHandler.Login)
+		authRoutes.POST("/register", userHandler.RegisterUser)
+		authRoutes.POST("/login", userHandler.Login)
+		authRoutes.POST("/login/mfa", userHandler.LoginMFA)
+		authRoutes.GET("/oidc/providers", oidcHandler.GetProviders)
+		authRoutes.POST("/oidc/:provider/authorize", oidcHandler.Authorize)
+		authRoutes.POST("/oidc/:provider/callback", userHandler.LoginOIDC)
+		authRoutes.POST("/refresh", authHandler.Refresh)
+		authRoutes.POST("/verify-email", userHandler.VerifyEmail)
+		authRoutes.POST("/password/forgot", userHandler.ForgotPassword)
+		authRoutes.POST("/password/reset", userHandler.ResetPassword)
+		authRoutes.POST("/verify-email/resend", internal.JWTAuthMiddleware(keys, authService), internal.DenyAPITokens(), userHandler.ResendEmailVerification)
+		authRoutes.POST("/logout", internal.JWTAuthMiddleware(keys, authService), internal.DenyAPITokens(), authHandler.Logout)
+		authRoutes.POST("/logout-all", internal.JWTAuthMiddleware(keys, authService), internal.DenyAPITokens(), authHandler.LogoutAll)
 	}
 
 	users := r.Group("/api/v1/users")
-	users.Use(internal.JWTAuthMiddleware(&cfg))
+	users.Use(internal.JWTAuthMiddleware(keys, authService))
 	{
-		users.GET("/me", userHandler.GetProfile)
+		users.GET("/me", internal.RequireScopes(internal.ScopeProfileRead), userHandler.GetProfile)
+		users.PATCH("/me", internal.RequireScopes(internal.ScopeProfileWrite), userHandler.UpdateProfile)
+		users.POST("/me/avatar", internal.RequireScopes(internal.ScopeProfileWrite), userHandler.UploadAvatar)
+		users.DELETE("/me/avatar", internal.RequireScopes(internal.ScopeProfileWrite), userHandler.DeleteAvatar)
+		users.GET("/search", internal.RequireScopes(internal.ScopeProfileRead), userHandler.SearchUsers)
+		users.GET("/:target_user_id", internal.RequireScopes(internal.ScopeProfileRead), userHandler.GetPublicProfile)
+
+		// A leaked API token must not be enough to take over the account
+		account := users.Group("", internal.DenyAPITokens())
+		{
+			account.PUT("/me/password", userHandler.ChangePassword)
+			account.GET("/me/sessions", authHandler.GetSessions)
+			account.DELETE("/me/sessions/:session_id", authHandler.RevokeSession)
+			account.GET("/me/mfa", userHandler.GetMFAStatus)
+			account.POST("/me/mfa/totp", userHandler.EnrollTOTP)
+			account.POST("/me/mfa/totp/confirm", userHandler.ConfirmTOTP)
+			account.DELETE("/me/mfa/totp", userHandler.DisableTOTP)
+			account.POST("/me/tokens", authHandler.CreateAPIToken)
+			account.GET("/me/tokens", authHandler.GetAPITokens)
+			account.DELETE("/me/tokens/:token_id", authHandler.RevokeAPIToken)
+			account.POST("/me/deactivate", userHandler.DeactivateAccount)
+			account.POST("/me/deletion", userHandler.RequestAccountDeletion)
+			account.POST("/me/export", exportsHandler.RequestExport)
+			account.GET("/me/export", exportsHandler.GetLatestExport)
+		}
 	}
 
+	// Download links are signed and work once
+	r.GET("/api/v1/exports/:export_id", exportsHandler.DownloadExport)
+
 	relationShipsRepo := relationships.NewRelationshipsRepo(db)
-	relationShipsService := relationships.NewRelationshipsService(relationShipsRepo, userRepo)
+	relationShipsService := relationships.NewRelationshipsService(relationShipsRepo, userRepo, bus)
 	relationshipsHandler := relationships.NewRelationshipsHandler(relationShipsService)
 
+	bots := r.Group("/api/v1/bots")
+	bots.Use(internal.JWTAuthMiddleware(keys, authService), internal.DenyAPITokens())
+	{
+		bots.POST("", userHandler.CreateBot)
+		bots.GET("", userHandler.GetBots)
+		bots.DELETE("/:bot_id", userHandler.DeleteBot)
+		bots.POST("/:bot_id/tokens", userHandler.CreateBotToken)
+		bots.GET("/:bot_id/tokens", userHandler.GetBotTokens)
+		bots.DELETE("/:bot_id/tokens/:token_id", userHandler.RevokeBotToken)
+	}
+
 	relationShips := r.Group("/api/v1/relationships")
-	relationShips.Use(internal.JWTAuthMiddleware(&cfg))
+	relationShips.Use(internal.JWTAuthMiddleware(keys, authService))
 	{
-		relationShips.POST("/friend-requests", relationshipsHandler.CreateRelationship)
-		relationShips.GET("", relationshipsHandler.GetAllRelationships)
-		relationShips.PATCH("/users/:target_user_id/friend-requests", relationshipsHandler.AcceptFriendRequest)
-		relationShips.DELETE("/users/:target_user_id/friend-requests", relationshipsHandler.CancelOrDeclineFriendRequest)
-		relationShips.DELETE("/users/:target_user_id/friends", relationshipsHandler.RemoveFriend)
+		relationShips.POST("/friend-requests", internal.RequireScopes(internal.ScopeRelationshipsWrite), relationshipsHandler.CreateRelationship)
+		relationShips.GET("", internal.RequireScopes(internal.ScopeRelationshipsRead), relationshipsHandler.GetAllRelationships)
+		relationShips.PATCH("/users/:target_user_id/friend-requests", internal.RequireScopes(internal.ScopeRelationshipsWrite), relationshipsHandler.AcceptFriendRequest)
+		relationShips.DELETE("/users/:target_user_id/friend-requests", internal.RequireScopes(internal.ScopeRelationshipsWrite), relationshipsHandler.CancelOrDeclineFriendRequest)
+		relationShips.DELETE("/users/:target_user_id/friends", internal.RequireScopes(internal.ScopeRelationshipsWrite), relationshipsHandler.RemoveFriend)
 	}
 
 	channelsRepo := channels.NewChannelsRepo(db)
-	channelsService := channels.NewChannelsService(channelsRepo)
+	channelsService := channels.NewChannelsService(channelsRepo, bus)
 	channelsHandler := channels.NewChannelsHandler(channelsService)
 
 	dmChannels := r.Group("/api/v1/users")
-	dmChannels.Use(internal.JWTAuthMiddleware(&cfg))
+	dmChannels.Use(internal.JWTAuthMiddleware(keys, authService))
 	{
-		dmChannels.GET("/:target_user_id/dm", channelsHandler.GetDMChannel)
+		dmChannels.GET("/:target_user_id/dm", internal.RequireScopes(internal.ScopeChannelsManage), channelsHandler.GetDMChannel)
 	}
 
 	channels := r.Group("/api/v1/channels")
-	channels.Use(internal.JWTAuthMiddleware(&cfg))
+	channels.Use(internal.JWTAuthMiddleware(keys, authService))
+	{
+		channels.POST("/groups", internal.RequireScopes(internal.ScopeChannelsManage), channelsHandler.CreateGroupChannel)
+		channels.GET("", internal.RequireScopes(internal.ScopeChannelsRead), channelsHandler.GetAllChannels)
+		channels.POST("/:channel_id/members", internal.RequireScopes(internal.ScopeChannelsManage), channelsHandler.AddChannelMember)
+	}
+
+	messagesRepo := messages.NewMessagesRepo(db)
+	messagesService := messages.NewMessagesService(messagesRepo, channelsRepo, bus, blobs, signer)
+	messagesHandler := messages.NewMessagesHandler(messagesService)
+
+	channelMessages := r.Group("/api/v1/channels/:channel_id/messages")
+	channelMessages.Use(internal.JWTAuthMiddleware(keys, authService))
+	{
+		channelMessages.POST("", internal.RequireScopes(internal.ScopeMessagesWrite), messagesHandler.CreateMessage)
+		channelMessages.GET("", internal.RequireScopes(internal.ScopeMessagesRead), messagesHandler.GetChannelMessages)
+	}
+
+	channelAttachments := r.Group("/api/v1/channels/:channel_id/attachments")
+	channelAttachments.Use(internal.JWTAuthMiddleware(keys, authService))
+	{
+		channelAttachments.POST("", internal.RequireScopes(internal.ScopeMessagesWrite), messagesHandler.UploadAttachment)
+	}
+
+	// Download links are signed, so they need no Authorization header and
+	// work in image tags
+	attachments := r.Group("/api/v1/attachments")
 	{
-		channels.POST("/groups", channelsHandler.CreateGroupChannel)
-		channels.GET("", channelsHandler.GetAllChannels)
+		attachments.GET("/:attachment_id", messagesHandler.DownloadAttachment)
+		attachments.GET("/:attachment_id/thumbnail", messagesHandler.DownloadAttachmentThumbnail)
 	}
 
+	gatewayHandler := gateway.NewGatewayHandler(hub)
+
+	r.GET("/api/v1/gateway", internal.QueryTokenMiddleware(), internal.JWTAuthMiddleware(keys, authService), internal.RequireScopes(internal.ScopeEventsRead), gatewayHandler.Connect)
+	r.GET("/api/v1/events", internal.QueryTokenMiddleware(), internal.JWTAuthMiddleware(keys, authService), internal.RequireScopes(internal.ScopeEventsRead), gatewayHandler.Stream)
+
 }
 
 func (a *App) Shutdown(ctx context.Context) error {
-	// First shutdown the HTTP server
+	a.jobs.stop()
+
+	// Hijacked gateway connections are not tracked by the HTTP server, so
+	// close them explicitly before shutting it down
+	a.hub.Close()
+
+	if err := a.bus.Close(); err != nil {
+		return fmt.Errorf("event bus close: %w", err)
+	}
+
+	// Shutdown the HTTP server
 	if err := a.HttpServer.Shutdown(ctx); err != nil {
 		return fmt.Errorf("http server shutdown: %w", err)
 	}
@@ -125,6 +296,13 @@ func (a *App) Shutdown(ctx context.Context) error {
 }
 
 func (a *App) Close() error {
+	a.jobs.stop()
+	a.hub.Close()
+
+	if err := a.bus.Close(); err != nil {
+		log.Printf("infra: failed to close event bus: %v", err)
+	}
+
 	return a.db.Close()
 }
 
@@ -0,0 +1,50 @@
+package infra
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// scheduler runs background jobs of the app. Every instance runs every job,
+// so jobs must be safe to run on several instances at once.
+type scheduler struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newScheduler() *scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scheduler{ctx: ctx, cancel: cancel}
+}
+
+// every runs job every interval until the scheduler is stopped. Failed runs
+// are logged and retried at the next interval.
+func (s *scheduler) every(name string, interval time.Duration, job func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := job(s.ctx); err != nil && s.ctx.Err() == nil {
+					log.Printf("jobs: %s failed: %v", name, err)
+				}
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop cancels running jobs and waits for them to return.
+func (s *scheduler) stop() {
+	s.cancel()
+	s.wg.Wait()
+}
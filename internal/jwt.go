@@ -1,15 +1,16 @@
 package internal
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/jakottelaar/relay-backend/config"
+	"github.com/google/uuid"
 )
 
 var (
@@ -17,11 +18,35 @@ var (
 	ErrTokenExpired = errors.New("token expired")
 )
 
+// JWTClaims identifies each access token by its jti claim (RegisteredClaims.ID)
+// and the session it was issued for, so either can be revoked before the
+// token expires. Scopes limits what the token can be used for; nil means it
+// is not limited, see HasScope.
 type JWTClaims struct {
-	UserId string
+	UserId    string
+	SessionId string
+	Scopes    []string `json:"scp,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// TokenRevocationStore tells whether an access token was revoked, e.g. because
+// its user logged out.
+type TokenRevocationStore interface {
+	IsTokenRevoked(ctx context.Context, claims *JWTClaims) (bool, error)
+}
+
+// TokenAuthenticator checks both kinds of tokens JWTAuthMiddleware accepts.
+// AuthenticateAPIToken returns nil claims for an unknown, revoked or expired
+// API token.
+type TokenAuthenticator interface {
+	TokenRevocationStore
+	AuthenticateAPIToken(ctx context.Context, token string) (*JWTClaims, error)
+}
+
+// apiTokenScheme is the authorization scheme of API tokens, as opposed to
+// Bearer for access tokens.
+const apiTokenScheme = "Bot"
+
 type AuthPayload struct {
 	AccessToken string
 }
@@ -29,10 +54,11 @@ type AuthPayload struct {
 type AuthResponse struct {
 	UserId  string
 	Expired bool
+	Claims  *JWTClaims
 }
 
-func Authenticate(authPayload *AuthPayload, jwtSecret string) (*AuthResponse, error) {
-	token, err := parseToken(authPayload.AccessToken, jwtSecret)
+func Authenticate(authPayload *AuthPayload, keys *KeySet) (*AuthResponse, error) {
+	token, err := parseToken(authPayload.AccessToken, keys)
 
 	if err != nil {
 		return nil, ErrInvalidToken
@@ -46,46 +72,70 @@ func Authenticate(authPayload *AuthPayload, jwtSecret string) (*AuthResponse, er
 	return &AuthResponse{
 		UserId:  claims.UserId,
 		Expired: false,
+		Claims:  claims,
 	}, nil
 }
 
-func GenerateJWT(userId string, jwtSecret string, jwtExpirationSecond int) (string, error) {
-	expiresAt := time.Now().Add(time.Duration(jwtExpirationSecond) * time.Second)
+func GenerateJWT(keys *KeySet, userId string, sessionId string, jwtExpirationSecond int) (string, error) {
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(jwtExpirationSecond) * time.Second)
 	jwtClaims := &JWTClaims{
-		UserId: userId,
+		UserId:    userId,
+		SessionId: sessionId,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims)
-	accessToken, err := token.SignedString([]byte(jwtSecret))
+	accessToken, err := keys.Sign(jwtClaims)
 	if err != nil {
 		return "", err
 	}
 	return accessToken, nil
 }
 
-func parseToken(accessToken string, jwtSecret string) (*jwt.Token, error) {
-	return jwt.ParseWithClaims(accessToken, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtSecret), nil
-	})
+func parseToken(accessToken string, keys *KeySet) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(accessToken, &JWTClaims{}, keys.keyFunc)
 }
 
-func JWTAuthMiddleware(cfg *config.Config) gin.HandlerFunc {
+// JWTAuthMiddleware authenticates requests with either an access token
+// ("Bearer <jwt>") or an API token ("Bot <token>"), and sets the user_id and
+// token_claims of the caller. Requests with an API token also get api_token
+// set.
+func JWTAuthMiddleware(keys *KeySet, tokens TokenAuthenticator) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		accessToken := ExtractTokenFromHeader(c.Request)
+		scheme, accessToken := extractAuthorization(c.Request)
 		if accessToken == "" {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 
+		if strings.EqualFold(scheme, apiTokenScheme) {
+			claims, err := tokens.AuthenticateAPIToken(c.Request.Context(), accessToken)
+			if err != nil {
+				log.Printf("auth: failed to check API token: %v", err)
+				c.AbortWithStatus(http.StatusServiceUnavailable)
+				return
+			}
+
+			if claims == nil {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+
+			c.Set("user_id", claims.UserId)
+			c.Set("token_claims", claims)
+			c.Set("api_token", true)
+
+			c.Next()
+			return
+		}
+
 		authResult, err := Authenticate(&AuthPayload{
 			AccessToken: accessToken,
-		}, cfg.JwtSecret)
+		}, keys)
 
 		if err != nil {
 			c.AbortWithStatus(http.StatusUnauthorized)
@@ -99,17 +149,70 @@ func JWTAuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 			return
 		}
 
+		revoked, err := tokens.IsTokenRevoked(c.Request.Context(), authResult.Claims)
+		if err != nil {
+			log.Printf("auth: failed to check token revocation: %v", err)
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "token revoked",
+			})
+			return
+		}
+
 		c.Set("user_id", authResult.UserId)
+		c.Set("token_claims", authResult.Claims)
+
+		c.Next()
+	}
+}
+
+// DenyAPITokens rejects requests made with an API token. It guards account
+// management, so a leaked integration token cannot be used to take over the
+// account it belongs to. It must run after JWTAuthMiddleware.
+func DenyAPITokens() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetBool("api_token") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "API tokens cannot be used for this endpoint",
+			})
+			return
+		}
 
 		c.Next()
 	}
 }
 
 func ExtractTokenFromHeader(r *http.Request) string {
+	_, token := extractAuthorization(r)
+	return token
+}
+
+// extractAuthorization splits the Authorization header into its scheme and
+// credentials.
+func extractAuthorization(r *http.Request) (string, string) {
 	bearToken := r.Header.Get("Authorization")
 	strArr := strings.Split(bearToken, " ")
 	if len(strArr) == 2 {
-		return strArr[1]
+		return strArr[0], strArr[1]
+	}
+	return "", ""
+}
+
+// QueryTokenMiddleware lets clients that cannot set request headers, such as
+// browser WebSockets, pass the access token in the access_token query
+// parameter instead. It must run before JWTAuthMiddleware.
+func QueryTokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(JWTAuthHeader) == "" {
+			if token := c.Query("access_token"); token != "" {
+				c.Request.Header.Set(JWTAuthHeader, "Bearer "+token)
+			}
+		}
+
+		c.Next()
 	}
-	return ""
 }
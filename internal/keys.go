@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jakottelaar/relay-backend/config"
+)
+
+const minRSAKeyBits = 2048
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeySet holds the key access tokens are signed with and every key they are
+// still accepted from. Asymmetric keys are identified by the kid header,
+// which is the RFC 7638 thumbprint of the public key, so rotating keys only
+// means adding the new key before signing with it and removing the old one
+// once its tokens have expired.
+type KeySet struct {
+	signingKey       *signingKey
+	verificationKeys map[string]*verificationKey
+	// hmacSecret signs tokens when no signing key is configured. It is also
+	// accepted for tokens without a kid, to keep them valid while moving to
+	// asymmetric keys.
+	hmacSecret []byte
+}
+
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	key    crypto.PrivateKey
+}
+
+type verificationKey struct {
+	id     string
+	method jwt.SigningMethod
+	key    crypto.PublicKey
+}
+
+// JWK is the public part of a verification key as published in the JWKS. Y is
+// only used by EC keys, which Relay reads from identity providers but does
+// not sign with itself.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// NewKeySet loads the signing and verification keys from the PEM files in
+// cfg. Verification key files may hold either public or private keys.
+func NewKeySet(cfg *config.Config) (*KeySet, error) {
+	keys := &KeySet{
+		verificationKeys: make(map[string]*verificationKey),
+	}
+
+	if cfg.JwtSecret != "" {
+		keys.hmacSecret = []byte(cfg.JwtSecret)
+	}
+
+	if cfg.JwtSigningKeyFile != "" {
+		privateKey, err := readPrivateKey(cfg.JwtSigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read signing key: %w", err)
+		}
+
+		verification, err := newVerificationKey(privateKey.(crypto.Signer).Public())
+		if err != nil {
+			return nil, fmt.Errorf("read signing key: %w", err)
+		}
+
+		keys.signingKey = &signingKey{
+			id:     verification.id,
+			method: verification.method,
+			key:    privateKey,
+		}
+		keys.verificationKeys[verification.id] = verification
+	}
+
+	for _, path := range cfg.JwtVerificationKeyFiles {
+		publicKey, err := readPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("read verification key %s: %w", path, err)
+		}
+
+		verification, err := newVerificationKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("read verification key %s: %w", path, err)
+		}
+		keys.verificationKeys[verification.id] = verification
+	}
+
+	if keys.signingKey == nil && keys.hmacSecret == nil {
+		return nil, errors.New("either a JWT secret or a signing key is required")
+	}
+
+	return keys, nil
+}
+
+// Sign returns the signed token for claims.
+func (k *KeySet) Sign(claims jwt.Claims) (string, error) {
+	if k.signingKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.hmacSecret)
+	}
+
+	token := jwt.NewWithClaims(k.signingKey.method, claims)
+	token.Header["kid"] = k.signingKey.id
+
+	return token.SignedString(k.signingKey.key)
+}
+
+// keyFunc picks the key a token must be verified with. The algorithm in the
+// token header has to match the key, so a public key can never be used as an
+// HMAC secret.
+func (k *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, hasKid := token.Header["kid"].(string)
+	if !hasKid {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || k.hmacSecret == nil {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return k.hmacSecret, nil
+	}
+
+	key, ok := k.verificationKeys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.key, nil
+}
+
+// JWKS returns the public verification keys, the current signing key first.
+// Tokens signed with the HMAC secret cannot be verified by anyone else, so it
+// is never included.
+func (k *KeySet) JWKS() *JWKS {
+	jwks := &JWKS{Keys: []*JWK{}}
+
+	for _, key := range k.verificationKeys {
+		jwks.Keys = append(jwks.Keys, key.jwk())
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		if k.signingKey != nil && jwks.Keys[i].KeyID != jwks.Keys[j].KeyID {
+			if jwks.Keys[i].KeyID == k.signingKey.id {
+				return true
+			}
+			if jwks.Keys[j].KeyID == k.signingKey.id {
+				return false
+			}
+		}
+		return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID
+	})
+
+	return jwks
+}
+
+func newVerificationKey(publicKey crypto.PublicKey) (*verificationKey, error) {
+	key := &verificationKey{key: publicKey}
+
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", publicKey)
+	}
+
+	thumbprint, err := key.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	key.id = thumbprint
+
+	return key, nil
+}
+
+func (k *verificationKey) jwk() *JWK {
+	jwk := &JWK{
+		KeyID:     k.id,
+		Use:       "sig",
+		Algorithm: k.method.Alg(),
+	}
+
+	switch pub := k.key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return jwk
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint of the key. Only the
+// required members are hashed, in lexicographic order.
+func (k *verificationKey) thumbprint() (string, error) {
+	jwk := k.jwk()
+
+	var members interface{}
+	switch jwk.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePrivateKey(block)
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := key.(crypto.Signer); !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		privateKey, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey.(crypto.Signer).Public(), nil
+	}
+}
@@ -0,0 +1,61 @@
+package lockout
+
+import (
+	"time"
+)
+
+// Policy decides when failed logins lock a key and for how long. The first
+// Threshold failures are free; every failure after that locks the key for
+// twice as long as the one before, starting at BaseDelay and capped at
+// MaxDelay. Failures are forgotten once there has been none for ResetAfter.
+type Policy struct {
+	Threshold  int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	ResetAfter time.Duration
+}
+
+var (
+	// accountPolicy protects a single account from password guessing.
+	accountPolicy = Policy{
+		Threshold:  5,
+		BaseDelay:  30 * time.Second,
+		MaxDelay:   15 * time.Minute,
+		ResetAfter: time.Hour,
+	}
+
+	// ipPolicy slows down a single client trying many accounts. It is more
+	// lenient, since users behind the same NAT share an address.
+	ipPolicy = Policy{
+		Threshold:  20,
+		BaseDelay:  30 * time.Second,
+		MaxDelay:   time.Hour,
+		ResetAfter: time.Hour,
+	}
+)
+
+// LoginFailures is the failure count of one key.
+type LoginFailures struct {
+	Key           string
+	Failures      int
+	LockedUntil   *time.Time
+	LastFailureAt time.Time
+}
+
+// delay returns how long the key is locked after the given number of
+// failures, or zero if it is not locked.
+func (p Policy) delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.Threshold; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,106 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type LockoutRepo interface {
+	FindLockedUntil(ctx context.Context, keys []string) (*time.Time, error)
+	RecordFailure(ctx context.Context, key string, resetAfter time.Duration) (int, error)
+	Lock(ctx context.Context, key string, duration time.Duration) (time.Time, error)
+	DeleteFailures(ctx context.Context, key string) error
+	DeleteExpiredFailures(ctx context.Context, resetAfter time.Duration) error
+}
+
+type lockoutRepo struct {
+	db *sql.DB
+}
+
+func NewLockoutRepo(db *sql.DB) LockoutRepo {
+	return &lockoutRepo{db: db}
+}
+
+// FindLockedUntil returns when the last active lock on any of the keys ends,
+// or nil if none of them is locked.
+func (r *lockoutRepo) FindLockedUntil(ctx context.Context, keys []string) (*time.Time, error) {
+	query := `SELECT MAX(locked_until) FROM login_failures WHERE key = ANY($1) AND locked_until > now()`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var lockedUntil *time.Time
+	if err := r.db.QueryRowContext(ctx, query, pq.Array(keys)).Scan(&lockedUntil); err != nil {
+		return nil, err
+	}
+
+	return lockedUntil, nil
+}
+
+// RecordFailure counts a failed login for key and returns the number of
+// failures so far. The count starts over if the previous failure is older
+// than resetAfter.
+func (r *lockoutRepo) RecordFailure(ctx context.Context, key string, resetAfter time.Duration) (int, error) {
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure_at) VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_failures.last_failure_at < now() - make_interval(secs => $2) THEN 1
+				ELSE login_failures.failures + 1
+			END,
+			last_failure_at = now()
+		RETURNING failures
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var failures int
+	if err := r.db.QueryRowContext(ctx, query, key, resetAfter.Seconds()).Scan(&failures); err != nil {
+		return 0, err
+	}
+
+	return failures, nil
+}
+
+func (r *lockoutRepo) Lock(ctx context.Context, key string, duration time.Duration) (time.Time, error) {
+	query := `
+		UPDATE login_failures SET locked_until = now() + make_interval(secs => $2)
+		WHERE key = $1
+		RETURNING locked_until
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var lockedUntil time.Time
+	if err := r.db.QueryRowContext(ctx, query, key, duration.Seconds()).Scan(&lockedUntil); err != nil {
+		return time.Time{}, err
+	}
+
+	return lockedUntil, nil
+}
+
+func (r *lockoutRepo) DeleteFailures(ctx context.Context, key string) error {
+	query := `DELETE FROM login_failures WHERE key = $1`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, key)
+	return err
+}
+
+// DeleteExpiredFailures removes keys that are no longer locked and whose
+// failures would not be counted anymore.
+func (r *lockoutRepo) DeleteExpiredFailures(ctx context.Context, resetAfter time.Duration) error {
+	query := `
+		DELETE FROM login_failures
+		WHERE last_failure_at < now() - make_interval(secs => $1)
+		AND (locked_until IS NULL OR locked_until < now())
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, resetAfter.Seconds())
+	return err
+}
@@ -0,0 +1,95 @@
+package lockout
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jakottelaar/relay-backend/internal"
+)
+
+// LockoutService throttles logins by counting failed attempts per account and
+// per IP address. Accounts are identified by the email address that was
+// tried, whether or not an account uses it, so a lockout does not reveal
+// which addresses are registered.
+type LockoutService interface {
+	Check(ctx context.Context, email, ip string) error
+	RecordFailure(ctx context.Context, email, ip string) error
+	RecordSuccess(ctx context.Context, email string) error
+}
+
+type lockoutService struct {
+	repo LockoutRepo
+}
+
+func NewLockoutService(repo LockoutRepo) LockoutService {
+	return &lockoutService{repo: repo}
+}
+
+// Check returns a too many requests error if the account or the IP address is
+// locked.
+func (s *lockoutService) Check(ctx context.Context, email, ip string) error {
+	lockedUntil, err := s.repo.FindLockedUntil(ctx, []string{accountKey(email), ipKey(ip)})
+	if err != nil {
+		return err
+	}
+
+	if lockedUntil != nil {
+		return internal.NewTooManyRequestsError("Too many failed login attempts, try again later")
+	}
+
+	return nil
+}
+
+// RecordFailure counts a failed attempt against both the account and the IP
+// address, and locks whichever of them went over its threshold.
+func (s *lockoutService) RecordFailure(ctx context.Context, email, ip string) error {
+	if err := s.recordFailure(ctx, accountKey(email), accountPolicy, ip); err != nil {
+		return err
+	}
+
+	return s.recordFailure(ctx, ipKey(ip), ipPolicy, ip)
+}
+
+func (s *lockoutService) recordFailure(ctx context.Context, key string, policy Policy, ip string) error {
+	failures, err := s.repo.RecordFailure(ctx, key, policy.ResetAfter)
+	if err != nil {
+		return err
+	}
+
+	delay := policy.delay(failures)
+	if delay == 0 {
+		return nil
+	}
+
+	lockedUntil, err := s.repo.Lock(ctx, key, delay)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("security: login locked for %s until %s after %d failed attempts, last from %s",
+		key, lockedUntil.UTC().Format(time.RFC3339), failures, ip)
+
+	return nil
+}
+
+// RecordSuccess clears the failures of the account. Failures of the IP
+// address are kept, so logging into an account of one's own does not allow
+// guessing more passwords of others.
+func (s *lockoutService) RecordSuccess(ctx context.Context, email string) error {
+	if err := s.repo.DeleteFailures(ctx, accountKey(email)); err != nil {
+		return err
+	}
+
+	// There is no background job for this table, so clean it up here
+	return s.repo.DeleteExpiredFailures(ctx, max(accountPolicy.ResetAfter, ipPolicy.ResetAfter))
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
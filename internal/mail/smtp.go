@@ -0,0 +1,75 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+	// envelopeFrom is the bare address of from, e.g. for "Relay <a@b>"
+	envelopeFrom string
+}
+
+// NewSMTPMailer sends mail through an SMTP relay. STARTTLS is used whenever
+// the server offers it; credentials are optional.
+func NewSMTPMailer(host string, port int, username, password, from string) Mailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	envelopeFrom := from
+	if addr, err := mail.ParseAddress(from); err == nil {
+		envelopeFrom = addr.Address
+	}
+
+	return &smtpMailer{
+		addr:         net.JoinHostPort(host, strconv.Itoa(port)),
+		auth:         auth,
+		from:         from,
+		envelopeFrom: envelopeFrom,
+	}
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg *Message) error {
+	// smtp.SendMail does not take a context, so the context only bounds how
+	// long the caller waits
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(m.addr, m.auth, m.envelopeFrom, []string{msg.To}, formatMessage(m.from, msg))
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			return fmt.Errorf("send mail to %s: %w", msg.To, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func formatMessage(from string, msg *Message) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
@@ -0,0 +1,148 @@
+package messages
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultMessagesLimit = 50
+	MaxMessagesLimit     = 100
+
+	maxAttachmentSize = 25 << 20
+	// Longer filenames are cut short
+	maxAttachmentFilenameLength = 255
+
+	attachmentDownloadPurpose = "attachment_download"
+	// Download links are only handed to channel members and expire soon, so
+	// a leaked link is not useful for long. Clients refetch messages for new
+	// ones.
+	attachmentURLTTL = time.Hour
+
+	// Thumbnails fit in a square of this size
+	thumbnailSize = 400
+	// Images with more pixels are stored without a thumbnail, decoding them
+	// would take too much memory
+	maxThumbnailSourcePixels = 16_000_000
+)
+
+type Message struct {
+	ID          uuid.UUID
+	ChannelID   uuid.UUID
+	AuthorID    uuid.UUID
+	Content     string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Attachments []*Attachment
+}
+
+type Attachment struct {
+	ID           uuid.UUID
+	ChannelID    uuid.UUID
+	UploaderID   uuid.UUID
+	MessageID    *uuid.UUID
+	Filename     string
+	ContentType  string
+	Size         int64
+	Width        *int
+	Height       *int
+	BlobKey      string
+	ThumbnailKey *string
+	CreatedAt    time.Time
+
+	// Signed download links, set when the attachment is handed to a channel
+	// member
+	URL          string
+	ThumbnailURL *string
+	URLExpiresAt time.Time
+}
+
+// attachmentDownloadClaims is what a signed download link grants access to.
+type attachmentDownloadClaims struct {
+	AttachmentID uuid.UUID `json:"aid"`
+	Thumbnail    bool      `json:"thumb,omitempty"`
+}
+
+// AttachmentDownload is the file behind a download link.
+type AttachmentDownload struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	Body        io.ReadCloser
+}
+
+// inlineContentTypes are shown in the browser when downloaded, everything
+// else is saved as a file.
+var inlineContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+type PaginationDirection string
+
+const (
+	PaginationDirectionBefore PaginationDirection = "before"
+	PaginationDirectionAfter  PaginationDirection = "after"
+	PaginationDirectionAround PaginationDirection = "around"
+)
+
+// MessageCursor is a position in a channel's history, ordered by creation
+// time with the message ID as tie breaker.
+type MessageCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+type MessagesQuery struct {
+	Direction PaginationDirection
+	Cursor    string
+	Limit     int
+}
+
+type MessagesPage struct {
+	Messages   []*Message
+	NextCursor *uuid.UUID
+}
+
+// CreateMessageRequest needs content, attachments or both. Attachments are
+// uploaded to the channel first and referenced by ID.
+type CreateMessageRequest struct {
+	Content       string      `json:"content" validate:"max=2000"`
+	AttachmentIDs []uuid.UUID `json:"attachment_ids" validate:"max=10"`
+}
+
+type GetMessagesRequest struct {
+	Before string `form:"before"`
+	After  string `form:"after"`
+	Around string `form:"around"`
+	Limit  int    `form:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+type MessageResponse struct {
+	ID          uuid.UUID             `json:"id"`
+	ChannelID   uuid.UUID             `json:"channel_id"`
+	AuthorID    uuid.UUID             `json:"author_id"`
+	Content     string                `json:"content"`
+	Attachments []*AttachmentResponse `json:"attachments"`
+	CreatedAt   time.Time             `json:"created_at"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+}
+
+// AttachmentResponse links to the file through URLs relative to the API,
+// which stop working at url_expires_at.
+type AttachmentResponse struct {
+	ID           uuid.UUID `json:"id"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Width        *int      `json:"width"`
+	Height       *int      `json:"height"`
+	URL          string    `json:"url"`
+	ThumbnailURL *string   `json:"thumbnail_url"`
+	URLExpiresAt time.Time `json:"url_expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
@@ -0,0 +1,261 @@
+package messages
+
+import (
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/blob"
+)
+
+type MessagesHandler struct {
+	service MessagesService
+}
+
+func NewMessagesHandler(service MessagesService) *MessagesHandler {
+	return &MessagesHandler{service: service}
+}
+
+func (h *MessagesHandler) CreateMessage(c *gin.Context) {
+	currentUserID, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserID.(string))
+	if err != nil {
+		log.Printf("messages: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	channelID, err := uuid.Parse(c.Param("channel_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid channel id"))
+		return
+	}
+
+	var req CreateMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid request body"))
+		return
+	}
+
+	validate := validator.New()
+
+	if err := validate.Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	if req.Content == "" && len(req.AttachmentIDs) == 0 {
+		_ = c.Error(internal.NewBadRequestError("Message must have content or attachments"))
+		return
+	}
+
+	message, err := h.service.CreateMessage(c.Request.Context(), userID, channelID, req.Content, req.AttachmentIDs)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": toMessageResponse(message),
+	})
+}
+
+func (h *MessagesHandler) GetChannelMessages(c *gin.Context) {
+	currentUserID, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserID.(string))
+	if err != nil {
+		log.Printf("messages: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	channelID, err := uuid.Parse(c.Param("channel_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid channel id"))
+		return
+	}
+
+	var req GetMessagesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid query parameters"))
+		return
+	}
+
+	validate := validator.New()
+
+	if err := validate.Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	query, err := toMessagesQuery(&req)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	page, err := h.service.GetChannelMessages(c.Request.Context(), userID, channelID, query)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	messagesResponse := make([]*MessageResponse, 0, len(page.Messages))
+	for _, message := range page.Messages {
+		messagesResponse = append(messagesResponse, toMessageResponse(message))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages":    messagesResponse,
+		"next_cursor": page.NextCursor,
+	})
+}
+
+func (h *MessagesHandler) UploadAttachment(c *gin.Context) {
+	currentUserID, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserID.(string))
+	if err != nil {
+		log.Printf("messages: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	channelID, err := uuid.Parse(c.Param("channel_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid channel id"))
+		return
+	}
+
+	upload, err := blob.ReadUpload(c, "file", maxAttachmentSize)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	defer upload.Close()
+
+	attachment, err := h.service.UploadAttachment(c.Request.Context(), userID, channelID, upload)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"attachment": toAttachmentResponse(attachment),
+	})
+}
+
+func (h *MessagesHandler) DownloadAttachment(c *gin.Context) {
+	h.downloadAttachment(c, false)
+}
+
+func (h *MessagesHandler) DownloadAttachmentThumbnail(c *gin.Context) {
+	h.downloadAttachment(c, true)
+}
+
+func (h *MessagesHandler) downloadAttachment(c *gin.Context, thumbnail bool) {
+	attachmentID, err := uuid.Parse(c.Param("attachment_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid attachment id"))
+		return
+	}
+
+	download, err := h.service.DownloadAttachment(c.Request.Context(), attachmentID, c.Query("token"), thumbnail)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	defer download.Body.Close()
+
+	// Uploads can be anything, so only images are shown in the browser and
+	// nothing served here may run scripts
+	disposition := "attachment"
+	if inlineContentTypes[download.ContentType] {
+		disposition = "inline"
+	}
+
+	c.DataFromReader(http.StatusOK, download.Size, download.ContentType, download.Body, map[string]string{
+		"Content-Disposition":     mime.FormatMediaType(disposition, map[string]string{"filename": download.Filename}),
+		"Content-Security-Policy": "default-src 'none'; sandbox",
+		"X-Content-Type-Options":  "nosniff",
+		"Cache-Control":           "private, max-age=3600",
+	})
+}
+
+func toMessagesQuery(req *GetMessagesRequest) (*MessagesQuery, error) {
+	query := &MessagesQuery{
+		Direction: PaginationDirectionBefore,
+		Limit:     req.Limit,
+	}
+
+	cursors := 0
+	if req.Before != "" {
+		query.Direction, query.Cursor = PaginationDirectionBefore, req.Before
+		cursors++
+	}
+	if req.After != "" {
+		query.Direction, query.Cursor = PaginationDirectionAfter, req.After
+		cursors++
+	}
+	if req.Around != "" {
+		query.Direction, query.Cursor = PaginationDirectionAround, req.Around
+		cursors++
+	}
+
+	if cursors > 1 {
+		return nil, internal.NewBadRequestError("Only one of before, after or around may be provided")
+	}
+
+	return query, nil
+}
+
+func toMessageResponse(message *Message) *MessageResponse {
+	response := &MessageResponse{
+		ID:        message.ID,
+		ChannelID: message.ChannelID,
+		AuthorID:  message.AuthorID,
+		Content:   message.Content,
+		CreatedAt: message.CreatedAt,
+		UpdatedAt: message.UpdatedAt,
+	}
+
+	response.Attachments = make([]*AttachmentResponse, 0, len(message.Attachments))
+	for _, attachment := range message.Attachments {
+		response.Attachments = append(response.Attachments, toAttachmentResponse(attachment))
+	}
+
+	return response
+}
+
+func toAttachmentResponse(attachment *Attachment) *AttachmentResponse {
+	return &AttachmentResponse{
+		ID:           attachment.ID,
+		Filename:     attachment.Filename,
+		ContentType:  attachment.ContentType,
+		Size:         attachment.Size,
+		Width:        attachment.Width,
+		Height:       attachment.Height,
+		URL:          attachment.URL,
+		ThumbnailURL: attachment.ThumbnailURL,
+		URLExpiresAt: attachment.URLExpiresAt,
+		CreatedAt:    attachment.CreatedAt,
+	}
+}
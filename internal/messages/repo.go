@@ -0,0 +1,282 @@
+package messages
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrAttachmentsUnavailable is returned when a message references attachments
+// that do not exist, are already used or belong to someone else.
+var ErrAttachmentsUnavailable = errors.New("attachments unavailable")
+
+type MessagesRepo interface {
+	// SaveMessage stores a message and attaches the given attachments to it.
+	// They must be unattached uploads of the author in the same channel.
+	SaveMessage(ctx context.Context, message *Message, attachmentIDs []uuid.UUID) (*Message, error)
+	FindMessageByID(ctx context.Context, channelID, messageID uuid.UUID) (*Message, error)
+	FindMessagesBefore(ctx context.Context, channelID uuid.UUID, cursor *MessageCursor, limit int) ([]*Message, error)
+	FindMessagesAfter(ctx context.Context, channelID uuid.UUID, cursor *MessageCursor, limit int) ([]*Message, error)
+	SaveAttachment(ctx context.Context, attachment *Attachment) (*Attachment, error)
+	FindAttachmentByID(ctx context.Context, attachmentID uuid.UUID) (*Attachment, error)
+	FindAttachmentsByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]*Attachment, error)
+}
+
+type messagesRepo struct {
+	db *sql.DB
+}
+
+func NewMessagesRepo(db *sql.DB) MessagesRepo {
+	return &messagesRepo{db: db}
+}
+
+func (r *messagesRepo) SaveMessage(ctx context.Context, message *Message, attachmentIDs []uuid.UUID) (*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	query := `
+		INSERT INTO messages (channel_id, author_id, content)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
+	`
+
+	err = tx.QueryRowContext(ctx, query, message.ChannelID, message.AuthorID, message.Content).Scan(
+		&message.ID,
+		&message.CreatedAt,
+		&message.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	message.Attachments = []*Attachment{}
+	if len(attachmentIDs) > 0 {
+		query = `
+			WITH attached AS (
+				UPDATE attachments SET message_id = $1
+				WHERE id = ANY($2) AND channel_id = $3 AND uploader_id = $4 AND message_id IS NULL
+				RETURNING ` + attachmentColumns + `
+			)
+			SELECT ` + attachmentColumns + ` FROM attached
+			ORDER BY created_at, id
+		`
+		message.Attachments, err = findAttachments(ctx, tx, query, message.ID, pq.Array(attachmentIDs), message.ChannelID, message.AuthorID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(message.Attachments) != len(attachmentIDs) {
+			return nil, ErrAttachmentsUnavailable
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return message, nil
+}
+
+func (r *messagesRepo) FindMessageByID(ctx context.Context, channelID, messageID uuid.UUID) (*Message, error) {
+	query := `
+		SELECT id, channel_id, author_id, content, created_at, updated_at
+		FROM messages
+		WHERE channel_id = $1 AND id = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	message := &Message{}
+	err := r.db.QueryRowContext(ctx, query, channelID, messageID).Scan(
+		&message.ID,
+		&message.ChannelID,
+		&message.AuthorID,
+		&message.Content,
+		&message.CreatedAt,
+		&message.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// FindMessagesBefore returns up to limit messages older than the cursor,
+// newest first. A nil cursor starts from the most recent message.
+func (r *messagesRepo) FindMessagesBefore(ctx context.Context, channelID uuid.UUID, cursor *MessageCursor, limit int) ([]*Message, error) {
+	if cursor == nil {
+		query := `
+			SELECT id, channel_id, author_id, content, created_at, updated_at
+			FROM messages
+			WHERE channel_id = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT $2
+		`
+		return r.findMessages(ctx, query, channelID, limit)
+	}
+
+	query := `
+		SELECT id, channel_id, author_id, content, created_at, updated_at
+		FROM messages
+		WHERE channel_id = $1 AND (created_at, id) < ($2, $3)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4
+	`
+	return r.findMessages(ctx, query, channelID, cursor.CreatedAt, cursor.ID, limit)
+}
+
+// FindMessagesAfter returns up to limit messages newer than the cursor,
+// oldest first.
+func (r *messagesRepo) FindMessagesAfter(ctx context.Context, channelID uuid.UUID, cursor *MessageCursor, limit int) ([]*Message, error) {
+	query := `
+		SELECT id, channel_id, author_id, content, created_at, updated_at
+		FROM messages
+		WHERE channel_id = $1 AND (created_at, id) > ($2, $3)
+		ORDER BY created_at ASC, id ASC
+		LIMIT $4
+	`
+	return r.findMessages(ctx, query, channelID, cursor.CreatedAt, cursor.ID, limit)
+}
+
+func (r *messagesRepo) findMessages(ctx context.Context, query string, args ...interface{}) ([]*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		message := &Message{}
+		err := rows.Scan(&message.ID, &message.ChannelID, &message.AuthorID, &message.Content, &message.CreatedAt, &message.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+const attachmentColumns = `id, channel_id, uploader_id, message_id, filename, content_type, size, width, height, blob_key, thumbnail_key, created_at`
+
+func (r *messagesRepo) SaveAttachment(ctx context.Context, attachment *Attachment) (*Attachment, error) {
+	query := `
+		INSERT INTO attachments (id, channel_id, uploader_id, filename, content_type, size, width, height, blob_key, thumbnail_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := r.db.QueryRowContext(ctx, query,
+		attachment.ID,
+		attachment.ChannelID,
+		attachment.UploaderID,
+		attachment.Filename,
+		attachment.ContentType,
+		attachment.Size,
+		attachment.Width,
+		attachment.Height,
+		attachment.BlobKey,
+		attachment.ThumbnailKey,
+	).Scan(&attachment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+func (r *messagesRepo) FindAttachmentByID(ctx context.Context, attachmentID uuid.UUID) (*Attachment, error) {
+	query := `SELECT ` + attachmentColumns + ` FROM attachments WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	attachments, err := findAttachments(ctx, r.db, query, attachmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+
+	return attachments[0], nil
+}
+
+// FindAttachmentsByMessageIDs returns the attachments of all given messages,
+// in the order they were uploaded.
+func (r *messagesRepo) FindAttachmentsByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]*Attachment, error) {
+	query := `
+		SELECT ` + attachmentColumns + `
+		FROM attachments
+		WHERE message_id = ANY($1)
+		ORDER BY created_at, id
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return findAttachments(ctx, r.db, query, pq.Array(messageIDs))
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func findAttachments(ctx context.Context, db queryer, query string, args ...interface{}) ([]*Attachment, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []*Attachment{}
+	for rows.Next() {
+		attachment := &Attachment{}
+		err := rows.Scan(
+			&attachment.ID,
+			&attachment.ChannelID,
+			&attachment.UploaderID,
+			&attachment.MessageID,
+			&attachment.Filename,
+			&attachment.ContentType,
+			&attachment.Size,
+			&attachment.Width,
+			&attachment.Height,
+			&attachment.BlobKey,
+			&attachment.ThumbnailKey,
+			&attachment.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
@@ -0,0 +1,474 @@
+package messages
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/blob"
+	"github.com/jakottelaar/relay-backend/internal/channels"
+	"github.com/jakottelaar/relay-backend/internal/events"
+)
+
+type MessagesService interface {
+	CreateMessage(ctx context.Context, userID, channelID uuid.UUID, content string, attachmentIDs []uuid.UUID) (*Message, error)
+	GetChannelMessages(ctx context.Context, userID, channelID uuid.UUID, query *MessagesQuery) (*MessagesPage, error)
+	UploadAttachment(ctx context.Context, userID, channelID uuid.UUID, upload *blob.Upload) (*Attachment, error)
+	DownloadAttachment(ctx context.Context, attachmentID uuid.UUID, token string, thumbnail bool) (*AttachmentDownload, error)
+}
+
+type messagesService struct {
+	messagesRepo MessagesRepo
+	channelsRepo channels.ChannelsRepo
+	publisher    events.Publisher
+	blobs        blob.BlobStore
+	signer       *internal.Signer
+}
+
+func NewMessagesService(messagesRepo MessagesRepo, channelsRepo channels.ChannelsRepo, publisher events.Publisher, blobs blob.BlobStore, signer *internal.Signer) MessagesService {
+	return &messagesService{
+		messagesRepo: messagesRepo,
+		channelsRepo: channelsRepo,
+		publisher:    publisher,
+		blobs:        blobs,
+		signer:       signer,
+	}
+}
+
+func (s *messagesService) CreateMessage(ctx context.Context, userID, channelID uuid.UUID, content string, attachmentIDs []uuid.UUID) (*Message, error) {
+	if err := s.ensureChannelMember(ctx, userID, channelID); err != nil {
+		return nil, err
+	}
+
+	message, err := s.messagesRepo.SaveMessage(ctx, &Message{
+		ChannelID: channelID,
+		AuthorID:  userID,
+		Content:   content,
+	}, uniqueIDs(attachmentIDs))
+	if err != nil {
+		if errors.Is(err, ErrAttachmentsUnavailable) {
+			return nil, internal.NewUnprocessableEntityError("Attachments must be your own unused uploads to this channel")
+		}
+		return nil, fmt.Errorf("could not save message: %w", err)
+	}
+
+	if err := s.signAttachments(message); err != nil {
+		return nil, err
+	}
+
+	s.publishMessageCreated(ctx, message)
+
+	return message, nil
+}
+
+// publishMessageCreated notifies every channel member, including the author's
+// other sessions. The message is already stored, so failures are only logged.
+func (s *messagesService) publishMessageCreated(ctx context.Context, message *Message) {
+	memberIDs, err := s.channelsRepo.FindChannelMemberIDs(ctx, message.ChannelID)
+	if err != nil {
+		log.Printf("messages: failed to find members of channel %s: %v", message.ChannelID, err)
+		return
+	}
+
+	err = s.publisher.Publish(ctx, &events.Event{
+		Type:       events.EventTypeMessageCreated,
+		Recipients: memberIDs,
+		Data:       toMessageResponse(message),
+	})
+	if err != nil {
+		log.Printf("messages: failed to publish %s event: %v", events.EventTypeMessageCreated, err)
+	}
+}
+
+func (s *messagesService) GetChannelMessages(ctx context.Context, userID, channelID uuid.UUID, query *MessagesQuery) (*MessagesPage, error) {
+	if err := s.ensureChannelMember(ctx, userID, channelID); err != nil {
+		return nil, err
+	}
+
+	page, err := s.getChannelMessages(ctx, channelID, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loadAttachments(ctx, page.Messages); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func (s *messagesService) getChannelMessages(ctx context.Context, channelID uuid.UUID, query *MessagesQuery) (*MessagesPage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultMessagesLimit
+	}
+	if limit > MaxMessagesLimit {
+		limit = MaxMessagesLimit
+	}
+
+	if query.Cursor == "" {
+		// Without a cursor every direction starts from the newest message.
+		return s.getMessagesBefore(ctx, channelID, nil, limit)
+	}
+
+	cursor, target, err := s.resolveCursor(ctx, channelID, query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	switch query.Direction {
+	case PaginationDirectionAfter:
+		return s.getMessagesAfter(ctx, channelID, cursor, limit)
+	case PaginationDirectionAround:
+		return s.getMessagesAround(ctx, channelID, cursor, target, limit)
+	default:
+		return s.getMessagesBefore(ctx, channelID, cursor, limit)
+	}
+}
+
+// resolveCursor accepts either a message ID from the channel or an RFC 3339
+// timestamp. For message IDs the referenced message is returned as well.
+func (s *messagesService) resolveCursor(ctx context.Context, channelID uuid.UUID, rawCursor string) (*MessageCursor, *Message, error) {
+	if messageID, err := uuid.Parse(rawCursor); err == nil {
+		message, err := s.messagesRepo.FindMessageByID(ctx, channelID, messageID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not find cursor message: %w", err)
+		}
+		if message == nil {
+			return nil, nil, internal.NewBadRequestError("Invalid cursor")
+		}
+		return &MessageCursor{CreatedAt: message.CreatedAt, ID: message.ID}, message, nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, rawCursor)
+	if err != nil {
+		return nil, nil, internal.NewBadRequestError("Invalid cursor")
+	}
+
+	// The nil UUID sorts before every message ID, so the cursor sits right
+	// before any message created at exactly this timestamp.
+	return &MessageCursor{CreatedAt: timestamp.UTC(), ID: uuid.Nil}, nil, nil
+}
+
+func (s *messagesService) getMessagesBefore(ctx context.Context, channelID uuid.UUID, cursor *MessageCursor, limit int) (*MessagesPage, error) {
+	messages, err := s.messagesRepo.FindMessagesBefore(ctx, channelID, cursor, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("could not get messages: %w", err)
+	}
+
+	page := &MessagesPage{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[:limit]
+		page.NextCursor = &page.Messages[limit-1].ID
+	}
+
+	return page, nil
+}
+
+func (s *messagesService) getMessagesAfter(ctx context.Context, channelID uuid.UUID, cursor *MessageCursor, limit int) (*MessagesPage, error) {
+	messages, err := s.messagesRepo.FindMessagesAfter(ctx, channelID, cursor, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("could not get messages: %w", err)
+	}
+
+	page := &MessagesPage{}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.NextCursor = &messages[limit-1].ID
+	}
+	page.Messages = reverseMessages(messages)
+
+	return page, nil
+}
+
+// getMessagesAround returns a window centered on the cursor. It has no
+// single continuation point, so clients page outwards with before/after.
+func (s *messagesService) getMessagesAround(ctx context.Context, channelID uuid.UUID, cursor *MessageCursor, target *Message, limit int) (*MessagesPage, error) {
+	newer, err := s.messagesRepo.FindMessagesAfter(ctx, channelID, cursor, limit/2)
+	if err != nil {
+		return nil, fmt.Errorf("could not get messages: %w", err)
+	}
+
+	olderLimit := limit - len(newer)
+	if target != nil {
+		olderLimit--
+	}
+
+	older := []*Message{}
+	if olderLimit > 0 {
+		older, err = s.messagesRepo.FindMessagesBefore(ctx, channelID, cursor, olderLimit)
+		if err != nil {
+			return nil, fmt.Errorf("could not get messages: %w", err)
+		}
+	}
+
+	messages := reverseMessages(newer)
+	if target != nil {
+		messages = append(messages, target)
+	}
+	messages = append(messages, older...)
+
+	return &MessagesPage{Messages: messages}, nil
+}
+
+// loadAttachments fills in the attachments of messages, with download links
+// for the channel member they are returned to.
+func (s *messagesService) loadAttachments(ctx context.Context, messages []*Message) error {
+	messageIDs := make([]uuid.UUID, 0, len(messages))
+	for _, message := range messages {
+		messageIDs = append(messageIDs, message.ID)
+		message.Attachments = []*Attachment{}
+	}
+
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	attachments, err := s.messagesRepo.FindAttachmentsByMessageIDs(ctx, messageIDs)
+	if err != nil {
+		return fmt.Errorf("could not get attachments: %w", err)
+	}
+
+	byMessageID := make(map[uuid.UUID][]*Attachment, len(messages))
+	for _, attachment := range attachments {
+		byMessageID[*attachment.MessageID] = append(byMessageID[*attachment.MessageID], attachment)
+	}
+
+	for _, message := range messages {
+		if attachments, ok := byMessageID[message.ID]; ok {
+			message.Attachments = attachments
+		}
+		if err := s.signAttachments(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func reverseMessages(messages []*Message) []*Message {
+	reversed := make([]*Message, 0, len(messages))
+	for i := len(messages) - 1; i >= 0; i-- {
+		reversed = append(reversed, messages[i])
+	}
+	return reversed
+}
+
+// ensureChannelMember reports a missing channel and a channel the user is not
+// part of in the same way, so non-members cannot probe for channel IDs.
+func (s *messagesService) ensureChannelMember(ctx context.Context, userID, channelID uuid.UUID) error {
+	isMember, err := s.channelsRepo.IsChannelMember(ctx, channelID, userID)
+	if err != nil {
+		return fmt.Errorf("could not check channel membership: %w", err)
+	}
+
+	if !isMember {
+		return internal.NewNotFoundError("Channel not found")
+	}
+
+	return nil
+}
+
+func (s *messagesService) UploadAttachment(ctx context.Context, userID, channelID uuid.UUID, upload *blob.Upload) (*Attachment, error) {
+	if err := s.ensureChannelMember(ctx, userID, channelID); err != nil {
+		return nil, err
+	}
+
+	attachment := &Attachment{
+		ID:          uuid.New(),
+		ChannelID:   channelID,
+		UploaderID:  userID,
+		Filename:    attachmentFilename(upload.Filename),
+		ContentType: upload.ContentType,
+		Size:        upload.Size,
+	}
+	attachment.BlobKey = fmt.Sprintf("attachments/%s/%s%s", channelID, attachment.ID, upload.Extension())
+
+	thumbnail, thumbnailType, err := s.inspectImage(attachment, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.blobs.Put(ctx, attachment.BlobKey, upload.Reader, upload.Size, upload.ContentType); err != nil {
+		return nil, fmt.Errorf("store attachment: %w", err)
+	}
+	keys := []string{attachment.BlobKey}
+
+	if thumbnail != nil {
+		key := fmt.Sprintf("attachments/%s/%s_thumb%s", channelID, attachment.ID, thumbnailExtensions[thumbnailType])
+		if err := s.blobs.Put(ctx, key, bytes.NewReader(thumbnail), int64(len(thumbnail)), thumbnailType); err != nil {
+			s.deleteBlobs(ctx, keys)
+			return nil, fmt.Errorf("store thumbnail: %w", err)
+		}
+		attachment.ThumbnailKey = &key
+		keys = append(keys, key)
+	}
+
+	attachment, err = s.messagesRepo.SaveAttachment(ctx, attachment)
+	if err != nil {
+		s.deleteBlobs(ctx, keys)
+		return nil, fmt.Errorf("could not save attachment: %w", err)
+	}
+
+	if err := s.signAttachment(attachment); err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// inspectImage records the dimensions of image uploads and makes their
+// thumbnail. Files that turn out not to be readable images are stored as
+// plain files. The upload is rewound afterwards.
+func (s *messagesService) inspectImage(attachment *Attachment, upload *blob.Upload) ([]byte, string, error) {
+	if _, ok := imageFormats[upload.ContentType]; !ok {
+		return nil, "", nil
+	}
+
+	config, ok := imageConfig(upload.ContentType, upload.Reader)
+	if err := upload.Rewind(); err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", nil
+	}
+
+	attachment.Width, attachment.Height = &config.Width, &config.Height
+
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, "", nil
+	}
+
+	thumbnail, thumbnailType, err := makeThumbnail(upload.ContentType, upload.Reader)
+	if err := upload.Rewind(); err != nil {
+		return nil, "", err
+	}
+	if err != nil {
+		log.Printf("messages: failed to make thumbnail for attachment %s: %v", attachment.ID, err)
+		return nil, "", nil
+	}
+
+	return thumbnail, thumbnailType, nil
+}
+
+func (s *messagesService) deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			log.Printf("messages: failed to delete blob %s: %v", key, err)
+		}
+	}
+}
+
+// DownloadAttachment opens the file a signed download link points to. The
+// link is the only proof of access needed, so it works in image tags.
+func (s *messagesService) DownloadAttachment(ctx context.Context, attachmentID uuid.UUID, token string, thumbnail bool) (*AttachmentDownload, error) {
+	var claims attachmentDownloadClaims
+	if err := s.signer.Verify(attachmentDownloadPurpose, token, &claims); err != nil {
+		return nil, internal.NewForbiddenError("Invalid or expired download link")
+	}
+
+	if claims.AttachmentID != attachmentID || claims.Thumbnail != thumbnail {
+		return nil, internal.NewForbiddenError("Invalid or expired download link")
+	}
+
+	attachment, err := s.messagesRepo.FindAttachmentByID(ctx, attachmentID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get attachment: %w", err)
+	}
+
+	if attachment == nil || (thumbnail && attachment.ThumbnailKey == nil) {
+		return nil, internal.NewNotFoundError("Attachment not found")
+	}
+
+	download := &AttachmentDownload{
+		Filename:    attachment.Filename,
+		ContentType: attachment.ContentType,
+		Size:        attachment.Size,
+	}
+	key := attachment.BlobKey
+
+	if thumbnail {
+		key = *attachment.ThumbnailKey
+		download.ContentType = mime.TypeByExtension(path.Ext(key))
+		download.Size = -1
+	}
+
+	download.Body, err = s.blobs.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, internal.NewNotFoundError("Attachment not found")
+		}
+		return nil, fmt.Errorf("could not get attachment blob: %w", err)
+	}
+
+	return download, nil
+}
+
+func (s *messagesService) signAttachments(message *Message) error {
+	for _, attachment := range message.Attachments {
+		if err := s.signAttachment(attachment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signAttachment sets the download links of an attachment. Callers must have
+// checked that the links go to a member of the attachment's channel.
+func (s *messagesService) signAttachment(attachment *Attachment) error {
+	attachment.URLExpiresAt = time.Now().Add(attachmentURLTTL).Truncate(time.Second)
+
+	token, err := s.signer.Sign(attachmentDownloadPurpose, &attachmentDownloadClaims{AttachmentID: attachment.ID}, attachmentURLTTL)
+	if err != nil {
+		return fmt.Errorf("could not sign attachment url: %w", err)
+	}
+	attachment.URL = fmt.Sprintf("/api/v1/attachments/%s?token=%s", attachment.ID, url.QueryEscape(token))
+
+	if attachment.ThumbnailKey != nil {
+		token, err := s.signer.Sign(attachmentDownloadPurpose, &attachmentDownloadClaims{AttachmentID: attachment.ID, Thumbnail: true}, attachmentURLTTL)
+		if err != nil {
+			return fmt.Errorf("could not sign attachment url: %w", err)
+		}
+		thumbnailURL := fmt.Sprintf("/api/v1/attachments/%s/thumbnail?token=%s", attachment.ID, url.QueryEscape(token))
+		attachment.ThumbnailURL = &thumbnailURL
+	}
+
+	return nil
+}
+
+// attachmentFilename keeps the name a file is offered for download under
+// reasonably short.
+func attachmentFilename(filename string) string {
+	filename = strings.TrimSpace(filename)
+	if filename == "" || filename == "." || filename == "/" {
+		return "attachment"
+	}
+
+	runes := []rune(filename)
+	if len(runes) > maxAttachmentFilenameLength {
+		filename = string(runes[:maxAttachmentFilenameLength])
+	}
+
+	return filename
+}
+
+func uniqueIDs(ids []uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool, len(ids))
+	unique := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
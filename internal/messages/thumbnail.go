@@ -0,0 +1,91 @@
+package messages
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// imageFormats are the image types attachments get dimensions and a
+// thumbnail for. Decoders are called directly rather than through
+// image.Decode, so the sniffed content type decides how a file is read.
+var imageFormats = map[string]struct {
+	decode       func(io.Reader) (image.Image, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+}{
+	"image/png":  {png.Decode, png.DecodeConfig},
+	"image/jpeg": {jpeg.Decode, jpeg.DecodeConfig},
+	"image/gif":  {gif.Decode, gif.DecodeConfig},
+	"image/webp": {webp.Decode, webp.DecodeConfig},
+	"image/bmp":  {bmp.Decode, bmp.DecodeConfig},
+}
+
+var thumbnailExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// imageConfig reads the dimensions of an image without decoding it. ok is
+// false for files that are not a supported image.
+func imageConfig(contentType string, r io.Reader) (image.Config, bool) {
+	format, ok := imageFormats[contentType]
+	if !ok {
+		return image.Config{}, false
+	}
+
+	config, err := format.decodeConfig(r)
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return image.Config{}, false
+	}
+
+	return config, true
+}
+
+// makeThumbnail decodes an image and scales it down to fit in a
+// thumbnailSize square. Photos become JPEGs, other images keep their
+// transparency as PNGs. GIFs only keep their first frame.
+func makeThumbnail(contentType string, r io.Reader) ([]byte, string, error) {
+	src, err := imageFormats[contentType].decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := src.Bounds()
+	width, height := fitInSquare(bounds.Dx(), bounds.Dy(), thumbnailSize)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// fitInSquare scales width and height down to fit in a size by size square,
+// keeping the aspect ratio. Images that already fit are left as is.
+func fitInSquare(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
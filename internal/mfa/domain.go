@@ -0,0 +1,46 @@
+package mfa
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Issuer shown next to the account in authenticator apps
+	totpIssuer = "Relay"
+
+	recoveryCodeCount = 10
+)
+
+// TOTP is the authenticator secret of a user. It only protects logins once
+// EnabledAt is set.
+type TOTP struct {
+	UserID       uuid.UUID
+	Secret       string
+	EnabledAt    *time.Time
+	LastUsedStep *int64
+	CreatedAt    time.Time
+}
+
+type EnrollTOTPResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type ConfirmTOTPRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type ConfirmTOTPResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type DisableTOTPRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MFAStatusResponse struct {
+	Enabled                bool `json:"enabled"`
+	RemainingRecoveryCodes int  `json:"remaining_recovery_codes"`
+}
@@ -0,0 +1,202 @@
+package mfa
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/internal"
+)
+
+type MFAService interface {
+	EnrollTOTP(ctx context.Context, userID uuid.UUID, accountName string) (*EnrollTOTPResponse, error)
+	ConfirmTOTP(ctx context.Context, userID uuid.UUID, code string) (*ConfirmTOTPResponse, error)
+	DisableTOTP(ctx context.Context, userID uuid.UUID, code string) error
+	GetStatus(ctx context.Context, userID uuid.UUID) (*MFAStatusResponse, error)
+	IsEnabled(ctx context.Context, userID uuid.UUID) (bool, error)
+	Verify(ctx context.Context, userID uuid.UUID, code string) (bool, error)
+}
+
+type mfaService struct {
+	repo MFARepo
+}
+
+func NewMFAService(repo MFARepo) MFAService {
+	return &mfaService{repo: repo}
+}
+
+// EnrollTOTP creates a new secret for the user. It does not protect anything
+// until the user proves their authenticator app works with ConfirmTOTP.
+func (s *mfaService) EnrollTOTP(ctx context.Context, userID uuid.UUID, accountName string) (*EnrollTOTPResponse, error) {
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := s.repo.SaveTOTP(ctx, userID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if !saved {
+		return nil, internal.NewDuplicateError("Two-factor authentication is already enabled")
+	}
+
+	return &EnrollTOTPResponse{
+		Secret:          secret,
+		ProvisioningURI: provisioningURI(totpIssuer, accountName, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables the pending secret of the user and returns a fresh set
+// of recovery codes. The codes are only stored hashed, so this is the only
+// time they can be shown.
+func (s *mfaService) ConfirmTOTP(ctx context.Context, userID uuid.UUID, code string) (*ConfirmTOTPResponse, error) {
+	totp, err := s.repo.FindTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if totp == nil {
+		return nil, internal.NewNotFoundError("No two-factor enrollment in progress")
+	}
+
+	if totp.EnabledAt != nil {
+		return nil, internal.NewDuplicateError("Two-factor authentication is already enabled")
+	}
+
+	step, ok := validateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return nil, internal.NewUnprocessableEntityError("Invalid verification code")
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i], err = generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	enabled, err := s.repo.EnableTOTP(ctx, userID, step, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		return nil, internal.NewDuplicateError("Two-factor authentication is already enabled")
+	}
+
+	return &ConfirmTOTPResponse{RecoveryCodes: codes}, nil
+}
+
+// DisableTOTP turns two-factor authentication off. A valid code is required
+// so a stolen access token alone cannot weaken the account.
+func (s *mfaService) DisableTOTP(ctx context.Context, userID uuid.UUID, code string) error {
+	enabled, err := s.IsEnabled(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if !enabled {
+		return internal.NewNotFoundError("Two-factor authentication is not enabled")
+	}
+
+	valid, err := s.Verify(ctx, userID, code)
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		return internal.NewForbiddenError("Invalid verification code")
+	}
+
+	return s.repo.DeleteTOTP(ctx, userID)
+}
+
+func (s *mfaService) GetStatus(ctx context.Context, userID uuid.UUID) (*MFAStatusResponse, error) {
+	enabled, err := s.IsEnabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		return &MFAStatusResponse{}, nil
+	}
+
+	remaining, err := s.repo.CountRecoveryCodes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAStatusResponse{
+		Enabled:                true,
+		RemainingRecoveryCodes: remaining,
+	}, nil
+}
+
+func (s *mfaService) IsEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	totp, err := s.repo.FindTOTP(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return totp != nil && totp.EnabledAt != nil, nil
+}
+
+// Verify checks a code from the authenticator app or one of the recovery
+// codes of the user. Either can only be used once.
+func (s *mfaService) Verify(ctx context.Context, userID uuid.UUID, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+
+	if len(code) != totpDigits {
+		return s.repo.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	}
+
+	totp, err := s.repo.FindTOTP(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if totp == nil || totp.EnabledAt == nil {
+		return false, nil
+	}
+
+	step, ok := validateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return s.repo.UseTOTPStep(ctx, userID, step)
+}
+
+// Recovery codes are ten characters of the base32 alphabet, shown in two
+// groups of five. The alphabet has 32 characters, so mapping random bytes to
+// it is unbiased.
+const recoveryCodeAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = recoveryCodeAlphabet[int(b[i])%len(recoveryCodeAlphabet)]
+	}
+
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+// hashRecoveryCode hashes the code ignoring case and separators, so it does
+// not matter how the user types it.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	return internal.HashOpaqueToken(code)
+}
@@ -0,0 +1,69 @@
+package oidc
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	loginPurpose = "oidc_login"
+	// How long a user has to complete the login at the identity provider
+	loginTTL = 10 * time.Minute
+)
+
+// Identity is a user as authenticated by an identity provider.
+type Identity struct {
+	Provider          string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// loginClaims is the data signed into the login token. It stays with the
+// client that started the login; only the state and nonce are sent to the
+// identity provider, so a leaked redirect does not reveal the PKCE verifier.
+type loginClaims struct {
+	Provider string `json:"p"`
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+}
+
+type AuthorizeResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+	LoginToken       string `json:"login_token"`
+}
+
+type CallbackRequest struct {
+	Code       string `json:"code" binding:"required"`
+	State      string `json:"state" binding:"required"`
+	LoginToken string `json:"login_token" binding:"required"`
+	// Reactivate restores a deactivated account, as with password logins
+	Reactivate bool `json:"reactivate"`
+}
+
+type ProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+// discoveryDocument holds the fields of the OpenID provider metadata that are
+// used.
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// idTokenClaims holds the claims of an ID token that are used.
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
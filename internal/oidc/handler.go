@@ -0,0 +1,34 @@
+package oidc
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OIDCHandler struct {
+	service OIDCService
+}
+
+func NewOIDCHandler(service OIDCService) *OIDCHandler {
+	return &OIDCHandler{service: service}
+}
+
+func (h *OIDCHandler) GetProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, &ProvidersResponse{
+		Providers: h.service.Providers(),
+	})
+}
+
+func (h *OIDCHandler) Authorize(c *gin.Context) {
+
+	resp, err := h.service.Authorize(c.Request.Context(), c.Param("provider"))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": resp,
+	})
+}
@@ -0,0 +1,154 @@
+package oidc
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal"
+	"golang.org/x/oauth2"
+)
+
+// OIDCService logs users in with OpenID Connect identity providers using the
+// authorization code flow with PKCE. The client starts a login with Authorize,
+// sends the user to the returned URL, and passes the code and state the
+// provider redirects back with to Callback along with the login token.
+type OIDCService interface {
+	Providers() []string
+	Authorize(ctx context.Context, providerName string) (*AuthorizeResponse, error)
+	Callback(ctx context.Context, providerName string, req *CallbackRequest) (*Identity, error)
+}
+
+type oidcService struct {
+	providers map[string]*provider
+	signer    *internal.Signer
+	client    *http.Client
+}
+
+func NewOIDCService(cfg config.Config, signer *internal.Signer) OIDCService {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	providers := make(map[string]*provider)
+	for _, providerCfg := range cfg.OIDCProviders {
+		providers[providerCfg.Name] = newProvider(providerCfg, client)
+	}
+
+	return &oidcService{
+		providers: providers,
+		signer:    signer,
+		client:    client,
+	}
+}
+
+func (s *oidcService) Providers() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *oidcService) Authorize(ctx context.Context, providerName string) (*AuthorizeResponse, error) {
+	p, ok := s.providers[providerName]
+	if !ok {
+		return nil, internal.NewNotFoundError("Identity provider not found")
+	}
+
+	doc, err := p.metadata(ctx)
+	if err != nil {
+		log.Printf("oidc: failed to load metadata of %s: %v", providerName, err)
+		return nil, internal.NewServiceUnavailableError("Identity provider is unavailable")
+	}
+
+	state, err := internal.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := internal.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	loginToken, err := s.signer.Sign(loginPurpose, &loginClaims{
+		Provider: providerName,
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+	}, loginTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizationURL := p.oauth2Config(doc).AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	)
+
+	return &AuthorizeResponse{
+		AuthorizationURL: authorizationURL,
+		LoginToken:       loginToken,
+	}, nil
+}
+
+// Callback exchanges the code for an ID token and returns the identity it
+// proves. The state has to match the one in the login token, which only the
+// client that started the login has, so a login cannot be forced on someone
+// else.
+func (s *oidcService) Callback(ctx context.Context, providerName string, req *CallbackRequest) (*Identity, error) {
+	p, ok := s.providers[providerName]
+	if !ok {
+		return nil, internal.NewNotFoundError("Identity provider not found")
+	}
+
+	var claims loginClaims
+	if err := s.signer.Verify(loginPurpose, req.LoginToken, &claims); err != nil {
+		return nil, internal.NewUnauthorizedError("Invalid or expired login token")
+	}
+
+	if claims.Provider != providerName || claims.State != req.State {
+		return nil, internal.NewUnauthorizedError("Invalid or expired login token")
+	}
+
+	doc, err := p.metadata(ctx)
+	if err != nil {
+		log.Printf("oidc: failed to load metadata of %s: %v", providerName, err)
+		return nil, internal.NewServiceUnavailableError("Identity provider is unavailable")
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, s.client)
+
+	token, err := p.oauth2Config(doc).Exchange(ctx, req.Code, oauth2.VerifierOption(claims.Verifier))
+	if err != nil {
+		log.Printf("oidc: failed to exchange code with %s: %v", providerName, err)
+		return nil, internal.NewUnauthorizedError("Login with identity provider failed")
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Printf("oidc: %s did not return an ID token", providerName)
+		return nil, internal.NewUnauthorizedError("Login with identity provider failed")
+	}
+
+	idToken, err := p.verifyIDToken(ctx, doc, rawIDToken, claims.Nonce)
+	if err != nil {
+		log.Printf("oidc: invalid ID token from %s: %v", providerName, err)
+		return nil, internal.NewUnauthorizedError("Login with identity provider failed")
+	}
+
+	return &Identity{
+		Provider:          providerName,
+		Subject:           idToken.Subject,
+		Email:             idToken.Email,
+		EmailVerified:     idToken.EmailVerified,
+		Name:              idToken.Name,
+		PreferredUsername: idToken.PreferredUsername,
+	}, nil
+}
@@ -3,9 +3,11 @@ package relationships
 import (
 	"context"
 	"fmt"
+	"log"
 
 	"github.com/google/uuid"
 	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/events"
 	"github.com/jakottelaar/relay-backend/internal/users"
 )
 
@@ -20,12 +22,14 @@ type RelationshipsService interface {
 type relationshipsService struct {
 	relationshipsRepo RelationshipsRepo
 	usersRepo         users.UserRepo
+	publisher         events.Publisher
 }
 
-func NewRelationshipsService(relationshipsRepo RelationshipsRepo, usersRepo users.UserRepo) RelationshipsService {
+func NewRelationshipsService(relationshipsRepo RelationshipsRepo, usersRepo users.UserRepo, publisher events.Publisher) RelationshipsService {
 	return &relationshipsService{
 		relationshipsRepo: relationshipsRepo,
 		usersRepo:         usersRepo,
+		publisher:         publisher,
 	}
 }
 
@@ -81,9 +85,34 @@ func (s *relationshipsService) CreateRelationship(ctx context.Context, username
 		return nil, fmt.Errorf("could not save relationship: %w", err)
 	}
 
+	s.publishFriendRequestReceived(ctx, savedRelationship)
+
 	return savedRelationship, nil
 }
 
+// publishFriendRequestReceived lets the target user know about a new incoming
+// request. The relationship is already stored, so failures are only logged.
+func (s *relationshipsService) publishFriendRequestReceived(ctx context.Context, relationship *Relationship) {
+	sender, err := s.usersRepo.FindUserByID(ctx, relationship.UserID.String())
+	if err != nil || sender == nil {
+		log.Printf("relationships: failed to find sender %s: %v", relationship.UserID, err)
+		return
+	}
+
+	err = s.publisher.Publish(ctx, &events.Event{
+		Type:       events.EventTypeFriendRequestReceived,
+		Recipients: []uuid.UUID{relationship.OtherUserID},
+		Data: &FriendRequestResponse{
+			UserID:    sender.ID,
+			Username:  sender.Username,
+			CreatedAt: relationship.CreatedAt,
+		},
+	})
+	if err != nil {
+		log.Printf("relationships: failed to publish %s event: %v", events.EventTypeFriendRequestReceived, err)
+	}
+}
+
 func (s *relationshipsService) getOppositeStatus(status RelationshipStatus) RelationshipStatus {
 	switch status {
 	case RelationshipStatusOutgoing:
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes limit what an API token can do. Each authenticated route requires
+// one of them, see RequireScopes.
+const (
+	ScopeProfileRead        = "profile:read"
+	ScopeProfileWrite       = "profile:write"
+	ScopeMessagesRead       = "messages:read"
+	ScopeMessagesWrite      = "messages:write"
+	ScopeChannelsRead       = "channels:read"
+	ScopeChannelsManage     = "channels:manage"
+	ScopeRelationshipsRead  = "relationships:read"
+	ScopeRelationshipsWrite = "relationships:write"
+	ScopeEventsRead         = "events:read"
+)
+
+// Scopes lists every scope a token can be given.
+var Scopes = []string{
+	ScopeProfileRead,
+	ScopeProfileWrite,
+	ScopeMessagesRead,
+	ScopeMessagesWrite,
+	ScopeChannelsRead,
+	ScopeChannelsManage,
+	ScopeRelationshipsRead,
+	ScopeRelationshipsWrite,
+	ScopeEventsRead,
+}
+
+func IsKnownScope(scope string) bool {
+	return slices.Contains(Scopes, scope)
+}
+
+// HasScope tells whether the token may be used for routes requiring scope.
+// A token without a scope list, like the access tokens users get when they
+// log in, has every scope.
+func (c *JWTClaims) HasScope(scope string) bool {
+	if c.Scopes == nil {
+		return true
+	}
+
+	return slices.Contains(c.Scopes, scope)
+}
+
+// RequireScopes rejects requests whose token lacks any of the given scopes.
+// It must run after JWTAuthMiddleware.
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("token_claims")
+		if !ok {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		claims := value.(*JWTClaims)
+		for _, scope := range scopes {
+			if !claims.HasScope(scope) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"error": "token is missing the " + scope + " scope",
+				})
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
@@ -6,13 +6,113 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	emailVerificationPurpose = "email_verification"
+	emailVerificationTTL     = 24 * time.Hour
+	// Minimum time between two verification emails to the same user
+	emailVerificationCooldown = time.Minute
+
+	passwordResetTTL = time.Hour
+	// Minimum time between two password reset emails to the same user
+	passwordResetCooldown = time.Minute
+
+	mfaChallengePurpose = "mfa_challenge"
+	// How long a user has to enter their code after giving their password
+	mfaChallengeTTL = 5 * time.Minute
+
+	// Usernames picked for users who sign up through an identity provider are
+	// cut short to leave room for a suffix when the name is taken
+	maxOIDCUsernameLength = 32
+	maxUsernameAttempts   = 5
+
+	// Bots need a unique email address but never receive mail; .invalid is
+	// reserved so it can never reach anyone
+	botEmailDomain = "bots.invalid"
+
+	maxAvatarSize = 5 << 20
+
+	defaultUserSearchLimit = 20
+
+	// How many accounts the deletion job anonymizes per query
+	accountDeletionBatchSize = 100
+)
+
+// DeletedUserID is the placeholder user the messages of deleted users are
+// attributed to.
+var DeletedUserID = uuid.Nil
+
+var avatarContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
 type User struct {
+	ID              uuid.UUID
+	Username        string
+	Email           string
+	Password        string
+	EmailVerifiedAt *time.Time
+	// PendingEmail replaces Email once it is verified
+	PendingEmail *string
+	DisplayName  *string
+	Bio          *string
+	AvatarURL    *string
+	IsBot        bool
+	BotOwnerID   *uuid.UUID
+	// Deactivated users cannot log in and are hidden from others
+	DeactivatedAt       *time.Time
+	DeletionScheduledAt *time.Time
+	DeletedAt           *time.Time
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// EmailVerificationToken records a verification email, so the link in it can
+// only be used once.
+type EmailVerificationToken struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Email     string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// PasswordResetToken is the stored form of a password reset token. Only a
+// hash of the token that was emailed is kept.
+type PasswordResetToken struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// UserIdentity links a user to their account at an identity provider.
+type UserIdentity struct {
 	ID        uuid.UUID
-	Username  string
+	UserID    uuid.UUID
+	Provider  string
+	Subject   string
 	Email     string
-	Password  string
 	CreatedAt time.Time
-	UpdatedAt time.Time
+}
+
+// emailVerificationClaims is the data signed into the verification link.
+type emailVerificationClaims struct {
+	TokenID uuid.UUID `json:"tid"`
+}
+
+// mfaChallengeClaims is the data signed into the MFA token handed out after
+// a correct password, when the user still has to give a second factor.
+// ChallengeID makes the token single use.
+type mfaChallengeClaims struct {
+	ChallengeID uuid.UUID `json:"cid"`
+	UserID      uuid.UUID `json:"uid"`
+	Reactivate  bool      `json:"reactivate,omitempty"`
 }
 
 type RegisterRequest struct {
@@ -22,28 +122,142 @@ type RegisterRequest struct {
 }
 
 type RegisterResponse struct {
-	ID          uuid.UUID `json:"id"`
-	Username    string    `json:"username"`
-	Email       string    `json:"email"`
-	AccessToken string    `json:"access_token"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID           uuid.UUID `json:"id"`
+	Username     string    `json:"username"`
+	Email        string    `json:"email"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
+// LoginRequest logs a user in. Deactivated users have to set Reactivate,
+// which also cancels a scheduled deletion.
 type LoginRequest struct {
-	Email    string `json:"email" binding:"required" validate:"email"`
-	Password string `json:"password" binding:"required" validate:"required"`
+	Email      string `json:"email" binding:"required" validate:"email"`
+	Password   string `json:"password" binding:"required" validate:"required"`
+	Reactivate bool   `json:"reactivate"`
 }
 
+// LoginResponse either holds the tokens of the user, or when MFARequired is
+// set, the MFA token to exchange for them together with a code.
 type LoginResponse struct {
-	UserID      uuid.UUID `json:"user_id"`
-	UserName    string    `json:"username"`
-	AccessToken string    `json:"access_token"`
+	UserID       uuid.UUID `json:"user_id"`
+	UserName     string    `json:"username"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	MFARequired  bool      `json:"mfa_required"`
+	MFAToken     string    `json:"mfa_token,omitempty"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
 }
 
 type ProfileResponse struct {
+	ID            uuid.UUID `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	PendingEmail  *string   `json:"pending_email"`
+	DisplayName   *string   `json:"display_name"`
+	Bio           *string   `json:"bio"`
+	AvatarURL     *string   `json:"avatar_url"`
+	IsBot         bool      `json:"is_bot"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func NewProfileResponse(user *User) *ProfileResponse {
+	return &ProfileResponse{
+		ID:            user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		PendingEmail:  user.PendingEmail,
+		DisplayName:   user.DisplayName,
+		Bio:           user.Bio,
+		AvatarURL:     user.AvatarURL,
+		IsBot:         user.IsBot,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+	}
+}
+
+// PublicProfileResponse is what other users can see of a user.
+type PublicProfileResponse struct {
+	ID          uuid.UUID `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName *string   `json:"display_name"`
+	Bio         *string   `json:"bio"`
+	AvatarURL   *string   `json:"avatar_url"`
+	IsBot       bool      `json:"is_bot"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func NewPublicProfileResponse(user *User) *PublicProfileResponse {
+	return &PublicProfileResponse{
+		ID:          user.ID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		IsBot:       user.IsBot,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+type SearchUsersRequest struct {
+	Query string `form:"q" binding:"required" validate:"min=1,max=64"`
+	Limit int    `form:"limit" validate:"omitempty,min=1,max=50"`
+}
+
+// UpdateProfileRequest changes only the fields that are set. An empty
+// display name, bio or avatar URL removes it. Changing the email address
+// needs the current password.
+type UpdateProfileRequest struct {
+	Username    *string `json:"username" validate:"omitempty,min=3,max=64"`
+	DisplayName *string `json:"display_name" validate:"omitempty,max=64"`
+	Bio         *string `json:"bio" validate:"omitempty,max=500"`
+	AvatarURL   *string `json:"avatar_url" validate:"omitempty,max=2048"`
+	Email       *string `json:"email" validate:"omitempty,email"`
+	Password    string  `json:"password"`
+}
+
+// DeactivateAccountRequest confirms a deactivation or deletion with the
+// user's password.
+type DeactivateAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+type AccountDeletionResponse struct {
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required" validate:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required" validate:"min=8,max=64"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required" validate:"min=8,max=64"`
+}
+
+type CreateBotRequest struct {
+	Username string `json:"username" binding:"required" validate:"min=3,max=64"`
+}
+
+type BotResponse struct {
 	ID        uuid.UUID `json:"id"`
 	Username  string    `json:"username"`
-	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
 }
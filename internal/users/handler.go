@@ -1,23 +1,30 @@
 package users
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator"
-	"github.com/jakottelaar/relay-backend/config"
+	"github.com/google/uuid"
 	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/auth"
+	"github.com/jakottelaar/relay-backend/internal/blob"
+	"github.com/jakottelaar/relay-backend/internal/mfa"
+	"github.com/jakottelaar/relay-backend/internal/oidc"
 )
 
 type UserHandler struct {
-	service UserService
-	cfg     config.Config
+	service     UserService
+	authService auth.AuthService
+	mfaService  mfa.MFAService
 }
 
-func NewUserHandler(service UserService, cfg config.Config) *UserHandler {
+func NewUserHandler(service UserService, authService auth.AuthService, mfaService mfa.MFAService) *UserHandler {
 	return &UserHandler{
-		service: service,
-		cfg:     cfg,
+		service:     service,
+		authService: authService,
+		mfaService:  mfaService,
 	}
 }
 
@@ -47,19 +54,20 @@ func (h *UserHandler) RegisterUser(c *gin.Context) {
 		return
 	}
 
-	token, err := internal.GenerateJWT(user.ID.String(), h.cfg.JwtSecret, h.cfg.JwtExpirationSecond)
+	tokens, err := h.authService.IssueTokens(c.Request.Context(), user.ID, auth.NewClientInfo(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		_ = c.Error(err)
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"user": &RegisterResponse{
-			ID:          user.ID,
-			Username:    user.Username,
-			Email:       user.Email,
-			AccessToken: token,
-			CreatedAt:   user.CreatedAt,
+			ID:           user.ID,
+			Username:     user.Username,
+			Email:        user.Email,
+			AccessToken:  tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+			CreatedAt:    user.CreatedAt,
 		},
 	})
 
@@ -80,7 +88,47 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
-	resp, err := h.service.LoginUser(c.Request.Context(), req.Email, req.Password)
+	resp, err := h.service.LoginUser(c.Request.Context(), req.Email, req.Password, req.Reactivate, auth.NewClientInfo(c))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": resp,
+	})
+
+}
+
+func (h *UserHandler) LoginMFA(c *gin.Context) {
+
+	var req *MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.service.LoginMFA(c.Request.Context(), req.MFAToken, req.Code, auth.NewClientInfo(c))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": resp,
+	})
+
+}
+
+func (h *UserHandler) LoginOIDC(c *gin.Context) {
+
+	var req *oidc.CallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.service.LoginOIDC(c.Request.Context(), c.Param("provider"), req, auth.NewClientInfo(c))
 	if err != nil {
 		_ = c.Error(err)
 		return
@@ -108,12 +156,691 @@ func (h *UserHandler) GetProfile(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"user": &ProfileResponse{
-			ID:        user.ID,
-			Username:  user.Username,
-			Email:     user.Email,
-			CreatedAt: user.CreatedAt,
-			UpdatedAt: user.UpdatedAt,
-		},
+		"user": NewProfileResponse(user),
+	})
+}
+
+func (h *UserHandler) GetPublicProfile(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	viewerID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(c.Param("target_user_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid user id"))
+		return
+	}
+
+	user, err := h.service.GetPublicProfile(c.Request.Context(), viewerID, userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user": NewPublicProfileResponse(user),
+	})
+}
+
+func (h *UserHandler) SearchUsers(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	viewerID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req SearchUsersRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid query parameters"))
+		return
+	}
+
+	if err := validator.New().Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	users, err := h.service.SearchUsers(c.Request.Context(), viewerID, req.Query, req.Limit)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	usersResponse := make([]*PublicProfileResponse, 0, len(users))
+	for _, user := range users {
+		usersResponse = append(usersResponse, NewPublicProfileResponse(user))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users": usersResponse,
+	})
+}
+
+func (h *UserHandler) UpdateProfile(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validator.New().Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	// The email address is how an account is recovered, so only the user
+	// themselves may change it
+	if req.Email != nil && c.GetBool("api_token") {
+		_ = c.Error(internal.NewForbiddenError("API tokens cannot change the email address"))
+		return
+	}
+
+	user, err := h.service.UpdateProfile(c.Request.Context(), userID, req)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user": NewProfileResponse(user),
+	})
+}
+
+func (h *UserHandler) VerifyEmail(c *gin.Context) {
+
+	var req *VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.service.VerifyEmail(c.Request.Context(), req.Token); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UserHandler) ResendEmailVerification(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	if err := h.service.ResendEmailVerification(c.Request.Context(), userID); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func (h *UserHandler) ForgotPassword(c *gin.Context) {
+
+	var req *ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	validate := validator.New()
+
+	if err := validate.Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	if err := h.service.ForgotPassword(c.Request.Context(), req.Email); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+
+	var req *ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	validate := validator.New()
+
+	if err := validate.Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	if err := h.service.ResetPassword(c.Request.Context(), req.Token, req.Password); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+
+	claims, ok := c.Get("token_claims")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	validate := validator.New()
+
+	if err := validate.Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	err := h.service.ChangePassword(c.Request.Context(), claims.(*internal.JWTClaims), req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UserHandler) DeactivateAccount(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *DeactivateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.service.DeactivateAccount(c.Request.Context(), userID, req.Password); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UserHandler) RequestAccountDeletion(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *DeactivateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deletionScheduledAt, err := h.service.RequestAccountDeletion(c.Request.Context(), userID, req.Password)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, &AccountDeletionResponse{
+		DeletionScheduledAt: deletionScheduledAt,
+	})
+}
+
+func (h *UserHandler) GetMFAStatus(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	status, err := h.mfaService.GetStatus(c.Request.Context(), userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mfa": status,
+	})
+}
+
+func (h *UserHandler) EnrollTOTP(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	user, err := h.service.GetUserByID(c.Request.Context(), currentUserId.(string))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	enrollment, err := h.mfaService.EnrollTOTP(c.Request.Context(), user.ID, user.Email)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"totp": enrollment,
+	})
+}
+
+func (h *UserHandler) ConfirmTOTP(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *mfa.ConfirmTOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := h.mfaService.ConfirmTOTP(c.Request.Context(), userID, req.Code)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"result": resp,
+	})
+}
+
+func (h *UserHandler) DisableTOTP(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *mfa.DisableTOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.mfaService.DisableTOTP(c.Request.Context(), userID, req.Code); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UserHandler) CreateBot(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	var req *CreateBotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validator.New().Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	bot, err := h.service.CreateBot(c.Request.Context(), userID, req.Username)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"bot": &BotResponse{
+			ID:        bot.ID,
+			Username:  bot.Username,
+			CreatedAt: bot.CreatedAt,
+		},
+	})
+}
+
+func (h *UserHandler) GetBots(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	bots, err := h.service.GetBots(c.Request.Context(), userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	resp := make([]*BotResponse, 0, len(bots))
+	for _, bot := range bots {
+		resp = append(resp, &BotResponse{
+			ID:        bot.ID,
+			Username:  bot.Username,
+			CreatedAt: bot.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bots": resp,
+	})
+}
+
+func (h *UserHandler) DeleteBot(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	botID, err := uuid.Parse(c.Param("bot_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid bot id"))
+		return
+	}
+
+	if err := h.service.DeleteBot(c.Request.Context(), userID, botID); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UserHandler) CreateBotToken(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	botID, err := uuid.Parse(c.Param("bot_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid bot id"))
+		return
+	}
+
+	var req *auth.CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validator.New().Struct(req); err != nil {
+		_ = c.Error(internal.NewUnprocessableEntityError("Invalid input: " + err.Error()))
+		return
+	}
+
+	token, err := h.service.CreateBotToken(c.Request.Context(), userID, botID, req)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token": token,
+	})
+}
+
+func (h *UserHandler) GetBotTokens(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	botID, err := uuid.Parse(c.Param("bot_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid bot id"))
+		return
+	}
+
+	tokens, err := h.service.GetBotTokens(c.Request.Context(), userID, botID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	resp := make([]*auth.APITokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		resp = append(resp, auth.NewAPITokenResponse(token))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": resp,
+	})
+}
+
+func (h *UserHandler) RevokeBotToken(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	botID, err := uuid.Parse(c.Param("bot_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid bot id"))
+		return
+	}
+
+	tokenID, err := uuid.Parse(c.Param("token_id"))
+	if err != nil {
+		_ = c.Error(internal.NewBadRequestError("Invalid token id"))
+		return
+	}
+
+	if err := h.service.RevokeBotToken(c.Request.Context(), userID, botID, tokenID); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UserHandler) UploadAvatar(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	upload, err := blob.ReadUpload(c, "file", maxAvatarSize)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+	defer upload.Close()
+
+	user, err := h.service.UploadAvatar(c.Request.Context(), userID, upload)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user": NewProfileResponse(user),
+	})
+}
+
+func (h *UserHandler) DeleteAvatar(c *gin.Context) {
+
+	currentUserId, ok := c.Get("user_id")
+	if !ok {
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	userID, err := uuid.Parse(currentUserId.(string))
+	if err != nil {
+		log.Printf("users: failed to parse user_id: %v", err)
+		_ = c.Error(internal.NewUnauthorizedError("Unauthorized"))
+		return
+	}
+
+	user, err := h.service.DeleteAvatar(c.Request.Context(), userID)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user": NewProfileResponse(user),
 	})
 }
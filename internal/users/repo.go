@@ -3,8 +3,12 @@ package users
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jakottelaar/relay-backend/internal"
 )
 
@@ -13,6 +17,30 @@ type UserRepo interface {
 	FindUserByID(ctx context.Context, id string) (*User, error)
 	FindUserByEmail(ctx context.Context, email string) (*User, error)
 	FindUserByUsername(ctx context.Context, username string) (*User, error)
+	UpdateProfile(ctx context.Context, user *User) (*User, error)
+	UpdatePassword(ctx context.Context, userID uuid.UUID, passwordHash string) error
+	ReplacePasswordHash(ctx context.Context, userID uuid.UUID, oldHash, newHash string) error
+	SaveEmailVerificationToken(ctx context.Context, token *EmailVerificationToken) (*EmailVerificationToken, error)
+	FindLatestEmailVerificationToken(ctx context.Context, userID uuid.UUID) (*EmailVerificationToken, error)
+	VerifyEmail(ctx context.Context, tokenID uuid.UUID) (bool, error)
+	SavePasswordResetToken(ctx context.Context, token *PasswordResetToken) (*PasswordResetToken, error)
+	FindLatestPasswordResetToken(ctx context.Context, userID uuid.UUID) (*PasswordResetToken, error)
+	ResetPassword(ctx context.Context, tokenHash, passwordHash string) (uuid.UUID, error)
+	IsMFAChallengeUsed(ctx context.Context, challengeID uuid.UUID) (bool, error)
+	UseMFAChallenge(ctx context.Context, challengeID, userID uuid.UUID, expiresAt time.Time) (bool, error)
+	FindUserByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	SaveUserIdentity(ctx context.Context, identity *UserIdentity) error
+	SaveUserWithIdentity(ctx context.Context, user *User, identity *UserIdentity) (*User, error)
+	SaveBot(ctx context.Context, bot *User) (*User, error)
+	FindBotsByOwnerID(ctx context.Context, ownerID uuid.UUID) ([]*User, error)
+	FindBot(ctx context.Context, botID, ownerID uuid.UUID) (*User, error)
+	ScheduleBotDeletion(ctx context.Context, botID, ownerID uuid.UUID) (*User, error)
+	FindVisibleUserByID(ctx context.Context, id, viewerID uuid.UUID) (*User, error)
+	SearchUsers(ctx context.Context, query string, viewerID uuid.UUID, limit int) ([]*User, error)
+	DeactivateUser(ctx context.Context, userID uuid.UUID, deletionScheduledAt *time.Time) error
+	ReactivateUser(ctx context.Context, userID uuid.UUID) error
+	FindUsersDueForDeletion(ctx context.Context, limit int) ([]*User, error)
+	AnonymizeUser(ctx context.Context, userID uuid.UUID) (bool, []string, error)
 }
 
 type userRepo struct {
@@ -45,13 +73,13 @@ func (r *userRepo) SaveUser(ctx context.Context, user *User) (*User, error) {
 
 func (r *userRepo) FindUserByID(ctx context.Context, id string) (*User, error) {
 
-	query := `SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1`
+	query := `SELECT id, username, email, password, email_verified_at, pending_email, display_name, bio, avatar_url, is_bot, bot_owner_id, deactivated_at, deletion_scheduled_at, deleted_at, created_at, updated_at FROM users WHERE id = $1`
 	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	var user User
 
-	err := r.db.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.EmailVerifiedAt, &user.PendingEmail, &user.DisplayName, &user.Bio, &user.AvatarURL, &user.IsBot, &user.BotOwnerID, &user.DeactivatedAt, &user.DeletionScheduledAt, &user.DeletedAt, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
@@ -67,13 +95,13 @@ func (r *userRepo) FindUserByID(ctx context.Context, id string) (*User, error) {
 
 func (r *userRepo) FindUserByEmail(ctx context.Context, email string) (*User, error) {
 
-	query := `SELECT id, username, email, password, created_at, updated_at FROM users WHERE email = $1`
+	query := `SELECT id, username, email, password, email_verified_at, pending_email, display_name, bio, avatar_url, is_bot, bot_owner_id, deactivated_at, deletion_scheduled_at, deleted_at, created_at, updated_at FROM users WHERE email = $1`
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	var user User
 
-	err := r.db.QueryRowContext(ctx, query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.CreatedAt, &user.UpdatedAt)
+	err := r.db.QueryRowContext(ctx, query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.EmailVerifiedAt, &user.PendingEmail, &user.DisplayName, &user.Bio, &user.AvatarURL, &user.IsBot, &user.BotOwnerID, &user.DeactivatedAt, &user.DeletionScheduledAt, &user.DeletedAt, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
@@ -87,8 +115,10 @@ func (r *userRepo) FindUserByEmail(ctx context.Context, email string) (*User, er
 
 }
 
+// FindUserByUsername only finds active users, deactivated ones cannot be
+// found by others.
 func (r *userRepo) FindUserByUsername(ctx context.Context, username string) (*User, error) {
-	query := `SELECT id, username, email, created_at, updated_at FROM users WHERE username = $1`
+	query := `SELECT id, username, email, created_at, updated_at FROM users WHERE username = $1 AND deactivated_at IS NULL AND deleted_at IS NULL`
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
@@ -107,3 +137,773 @@ func (r *userRepo) FindUserByUsername(ctx context.Context, username string) (*Us
 	return &user, nil
 
 }
+
+func (r *userRepo) UpdateProfile(ctx context.Context, user *User) (*User, error) {
+	query := `
+		UPDATE users
+		SET username = $2, email = $3, email_verified_at = $4, pending_email = $5, display_name = $6, bio = $7, avatar_url = $8, updated_at = now()
+		WHERE id = $1
+		RETURNING updated_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := r.db.QueryRowContext(ctx, query, user.ID, user.Username, user.Email, user.EmailVerifiedAt, user.PendingEmail, user.DisplayName, user.Bio, user.AvatarURL).Scan(&user.UpdatedAt)
+	if err != nil {
+		switch err.Error() {
+		case "pq: duplicate key value violates unique constraint \"users_email_key\"":
+			return nil, internal.NewDuplicateError("email already exists")
+		case "pq: duplicate key value violates unique constraint \"users_username_key\"":
+			return nil, internal.NewDuplicateError("username already exists")
+		default:
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func (r *userRepo) UpdatePassword(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	query := `UPDATE users SET password = $2, updated_at = now() WHERE id = $1`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, userID, passwordHash)
+	return err
+}
+
+// ReplacePasswordHash swaps the hash of an unchanged password for a new hash
+// of the same password. It does nothing if the password was changed since
+// oldHash was read.
+func (r *userRepo) ReplacePasswordHash(ctx context.Context, userID uuid.UUID, oldHash, newHash string) error {
+	query := `UPDATE users SET password = $3 WHERE id = $1 AND password = $2`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, userID, oldHash, newHash)
+	return err
+}
+
+func (r *userRepo) SaveEmailVerificationToken(ctx context.Context, token *EmailVerificationToken) (*EmailVerificationToken, error) {
+	query := `
+		INSERT INTO email_verification_tokens (user_id, email, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := r.db.QueryRowContext(ctx, query, token.UserID, token.Email, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (r *userRepo) FindLatestEmailVerificationToken(ctx context.Context, userID uuid.UUID) (*EmailVerificationToken, error) {
+	query := `
+		SELECT id, user_id, email, expires_at, used_at, created_at
+		FROM email_verification_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var token EmailVerificationToken
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&token.ID, &token.UserID, &token.Email, &token.ExpiresAt, &token.UsedAt, &token.CreatedAt)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// VerifyEmail uses up the token and marks the address it was sent to as
+// verified. If it was sent to the pending email address of the user, that
+// address replaces the current one. It returns false if the token was
+// already used or expired, or if the user uses neither address anymore.
+func (r *userRepo) VerifyEmail(ctx context.Context, tokenID uuid.UUID) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	query := `
+		UPDATE email_verification_tokens SET used_at = now()
+		WHERE id = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id, email
+	`
+
+	var userID uuid.UUID
+	var email string
+
+	err = tx.QueryRowContext(ctx, query, tokenID).Scan(&userID, &email)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	query = `
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()), updated_at = now()
+		WHERE id = $1 AND email = $2
+	`
+	result, err := tx.ExecContext(ctx, query, userID, email)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if rows == 0 {
+		query = `
+			UPDATE users SET email = pending_email, pending_email = NULL, email_verified_at = now(), updated_at = now()
+			WHERE id = $1 AND pending_email = $2
+		`
+		result, err = tx.ExecContext(ctx, query, userID, email)
+		if err != nil {
+			// Someone else started using the address in the meantime
+			if err.Error() == "pq: duplicate key value violates unique constraint \"users_email_key\"" {
+				return false, internal.NewDuplicateError("email already exists")
+			}
+			return false, err
+		}
+
+		rows, err = result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if rows == 0 {
+			return false, nil
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
+
+func (r *userRepo) SavePasswordResetToken(ctx context.Context, token *PasswordResetToken) (*PasswordResetToken, error) {
+	query := `
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := r.db.QueryRowContext(ctx, query, token.UserID, token.TokenHash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (r *userRepo) FindLatestPasswordResetToken(ctx context.Context, userID uuid.UUID) (*PasswordResetToken, error) {
+	query := `
+		SELECT id, user_id, token_hash, expires_at, used_at, created_at
+		FROM password_reset_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var token PasswordResetToken
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&token.ID, &token.UserID, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.CreatedAt)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// ResetPassword uses up the reset token and replaces the password of its
+// user. Every other reset token of the user is used up too. It returns the
+// user's ID, or uuid.Nil if the token is unknown, used or expired.
+func (r *userRepo) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (uuid.UUID, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	query := `
+		UPDATE password_reset_tokens SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id
+	`
+
+	var userID uuid.UUID
+
+	err = tx.QueryRowContext(ctx, query, tokenHash).Scan(&userID)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return uuid.Nil, nil
+		default:
+			return uuid.Nil, err
+		}
+	}
+
+	query = `UPDATE users SET password = $2, updated_at = now() WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, userID, passwordHash); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	query = `UPDATE password_reset_tokens SET used_at = now() WHERE user_id = $1 AND used_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to use up reset tokens: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return userID, nil
+}
+
+func (r *userRepo) IsMFAChallengeUsed(ctx context.Context, challengeID uuid.UUID) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM used_mfa_challenges WHERE id = $1)`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var used bool
+	if err := r.db.QueryRowContext(ctx, query, challengeID).Scan(&used); err != nil {
+		return false, err
+	}
+
+	return used, nil
+}
+
+// UseMFAChallenge records that an MFA challenge was completed. It returns
+// false if the challenge was already used.
+func (r *userRepo) UseMFAChallenge(ctx context.Context, challengeID, userID uuid.UUID, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+		INSERT INTO used_mfa_challenges (id, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO NOTHING
+	`
+	result, err := r.db.ExecContext(ctx, query, challengeID, userID, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	// Expired challenges are rejected anyway, so their rows are no longer needed
+	cleanup := `DELETE FROM used_mfa_challenges WHERE expires_at < now()`
+	if _, err := r.db.ExecContext(ctx, cleanup); err != nil {
+		log.Printf("failed to delete expired MFA challenges: %v", err)
+	}
+
+	return rows > 0, nil
+}
+
+func (r *userRepo) FindUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	query := `
+		SELECT u.id, u.username, u.email, u.password, u.email_verified_at, u.pending_email, u.display_name, u.bio, u.avatar_url, u.is_bot, u.bot_owner_id, u.deactivated_at, u.deletion_scheduled_at, u.deleted_at, u.created_at, u.updated_at
+		FROM user_identities i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.provider = $1 AND i.subject = $2
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user User
+
+	err := r.db.QueryRowContext(ctx, query, provider, subject).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.EmailVerifiedAt, &user.PendingEmail, &user.DisplayName, &user.Bio, &user.AvatarURL, &user.IsBot, &user.BotOwnerID, &user.DeactivatedAt, &user.DeletionScheduledAt, &user.DeletedAt, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (r *userRepo) SaveUserIdentity(ctx context.Context, identity *UserIdentity) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return r.saveUserIdentity(ctx, r.db, identity)
+}
+
+// SaveUserWithIdentity creates a user who signed up through an identity
+// provider, together with the identity, so there is never a user without a
+// way to log in.
+func (r *userRepo) SaveUserWithIdentity(ctx context.Context, user *User, identity *UserIdentity) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	query := `
+		INSERT INTO users (username, email, password, email_verified_at) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at
+	`
+	err = tx.QueryRowContext(ctx, query, user.Username, user.Email, user.Password, user.EmailVerifiedAt).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		switch err.Error() {
+		case "pq: duplicate key value violates unique constraint \"users_email_key\"":
+			return nil, internal.NewDuplicateError("email already exists")
+		case "pq: duplicate key value violates unique constraint \"users_username_key\"":
+			return nil, internal.NewDuplicateError("username already exists")
+		default:
+			return nil, err
+		}
+	}
+
+	identity.UserID = user.ID
+	if err := r.saveUserIdentity(ctx, tx, identity); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *userRepo) SaveBot(ctx context.Context, bot *User) (*User, error) {
+	query := `
+		INSERT INTO users (username, email, password, is_bot, bot_owner_id) VALUES ($1, $2, $3, true, $4)
+		RETURNING id, is_bot, created_at, updated_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := r.db.QueryRowContext(ctx, query, bot.Username, bot.Email, bot.Password, bot.BotOwnerID).Scan(&bot.ID, &bot.IsBot, &bot.CreatedAt, &bot.UpdatedAt)
+	if err != nil {
+		switch err.Error() {
+		case "pq: duplicate key value violates unique constraint \"users_username_key\"":
+			return nil, internal.NewDuplicateError("username already exists")
+		default:
+			return nil, err
+		}
+	}
+
+	return bot, nil
+}
+
+func (r *userRepo) FindBotsByOwnerID(ctx context.Context, ownerID uuid.UUID) ([]*User, error) {
+	query := `
+		SELECT id, username, email, is_bot, bot_owner_id, created_at, updated_at
+		FROM users
+		WHERE bot_owner_id = $1 AND deletion_scheduled_at IS NULL
+		ORDER BY created_at
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []*User{}
+	for rows.Next() {
+		var bot User
+		if err := rows.Scan(&bot.ID, &bot.Username, &bot.Email, &bot.IsBot, &bot.BotOwnerID, &bot.CreatedAt, &bot.UpdatedAt); err != nil {
+			return nil, err
+		}
+		bots = append(bots, &bot)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bots, nil
+}
+
+// FindBot returns the bot only if it belongs to ownerID.
+func (r *userRepo) FindBot(ctx context.Context, botID, ownerID uuid.UUID) (*User, error) {
+	query := `
+		SELECT id, username, email, is_bot, bot_owner_id, created_at, updated_at
+		FROM users
+		WHERE id = $1 AND bot_owner_id = $2 AND deletion_scheduled_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var bot User
+
+	err := r.db.QueryRowContext(ctx, query, botID, ownerID).Scan(&bot.ID, &bot.Username, &bot.Email, &bot.IsBot, &bot.BotOwnerID, &bot.CreatedAt, &bot.UpdatedAt)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &bot, nil
+}
+
+// ScheduleBotDeletion deactivates a bot of ownerID and makes its deletion due
+// right away. It returns nil if ownerID has no such bot.
+func (r *userRepo) ScheduleBotDeletion(ctx context.Context, botID, ownerID uuid.UUID) (*User, error) {
+	query := `
+		UPDATE users
+		SET deactivated_at = COALESCE(deactivated_at, now()), deletion_scheduled_at = now(), updated_at = now()
+		WHERE id = $1 AND bot_owner_id = $2 AND deletion_scheduled_at IS NULL
+		RETURNING id, avatar_url
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var bot User
+	err := r.db.QueryRowContext(ctx, query, botID, ownerID).Scan(&bot.ID, &bot.AvatarURL)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &bot, nil
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (r *userRepo) saveUserIdentity(ctx context.Context, q queryRower, identity *UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+	err := q.QueryRowContext(ctx, query, identity.UserID, identity.Provider, identity.Subject, identity.Email).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		switch err.Error() {
+		case "pq: duplicate key value violates unique constraint \"user_identities_provider_subject_key\"":
+			return internal.NewDuplicateError("identity is already linked to a user")
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// notBlockedByViewer hides users who blocked the viewer, $2 in the queries
+// using it.
+const notBlockedByViewer = `
+	NOT EXISTS (
+		SELECT 1 FROM relationships
+		WHERE user_id = users.id AND other_user_id = $2 AND relationship_status = 'blocked'
+	)
+`
+
+// FindVisibleUserByID returns the public fields of a user, or nil if there is
+// no such user, they are deactivated or they blocked the viewer. The deleted
+// user placeholder is visible, so clients can show who wrote its messages.
+func (r *userRepo) FindVisibleUserByID(ctx context.Context, id, viewerID uuid.UUID) (*User, error) {
+	query := `
+		SELECT id, username, display_name, bio, avatar_url, is_bot, created_at, updated_at
+		FROM users
+		WHERE id = $1 AND deactivated_at IS NULL AND ` + notBlockedByViewer
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user User
+
+	err := r.db.QueryRowContext(ctx, query, id, viewerID).Scan(&user.ID, &user.Username, &user.DisplayName, &user.Bio, &user.AvatarURL, &user.IsBot, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// SearchUsers finds active users whose username starts with or resembles
+// query, leaving out the viewer and users who blocked them. Prefix matches come
+// first, then the closest matches.
+func (r *userRepo) SearchUsers(ctx context.Context, query string, viewerID uuid.UUID, limit int) ([]*User, error) {
+	sqlQuery := `
+		SELECT id, username, display_name, bio, avatar_url, is_bot, created_at, updated_at
+		FROM users
+		WHERE (username ILIKE $3 OR username % $1) AND id <> $2
+			AND deactivated_at IS NULL AND deleted_at IS NULL AND ` + notBlockedByViewer + `
+		ORDER BY username ILIKE $3 DESC, similarity(username, $1) DESC, username
+		LIMIT $4
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, sqlQuery, query, viewerID, escapeLike(query)+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Bio, &user.AvatarURL, &user.IsBot, &user.CreatedAt, &user.UpdatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// escapeLike makes s match itself literally in a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// DeactivateUser blocks logins of a user and hides them from others. With a
+// deletionScheduledAt they are anonymized once that time has passed.
+func (r *userRepo) DeactivateUser(ctx context.Context, userID uuid.UUID, deletionScheduledAt *time.Time) error {
+	query := `
+		UPDATE users
+		SET deactivated_at = COALESCE(deactivated_at, now()), deletion_scheduled_at = $2, updated_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, userID, deletionScheduledAt)
+	return err
+}
+
+// ReactivateUser undoes a deactivation and cancels a scheduled deletion, as
+// long as the user has not been anonymized yet.
+func (r *userRepo) ReactivateUser(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET deactivated_at = NULL, deletion_scheduled_at = NULL, updated_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (r *userRepo) FindUsersDueForDeletion(ctx context.Context, limit int) ([]*User, error) {
+	query := `
+		SELECT id, avatar_url
+		FROM users
+		WHERE deletion_scheduled_at <= now() AND deleted_at IS NULL
+		ORDER BY deletion_scheduled_at
+		LIMIT $1
+	`
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.AvatarURL); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// AnonymizeUser deletes a user whose deletion is due. The row is kept, with
+// everything that identified the user removed, but the user's messages and
+// uploads move to the DeletedUserID placeholder. Their bots are scheduled
+// for deletion too. It returns false if the user is not due (anymore), and
+// the keys of unsent uploads and data exports that can be removed from the
+// blob store.
+func (r *userRepo) AnonymizeUser(ctx context.Context, userID uuid.UUID) (bool, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("failed to rollback transaction: %v", err)
+		}
+	}()
+
+	// Locking the row keeps a reactivation or another instance's job from
+	// running at the same time
+	query := `
+		SELECT id FROM users
+		WHERE id = $1 AND deletion_scheduled_at <= now() AND deleted_at IS NULL
+		FOR UPDATE
+	`
+	var id uuid.UUID
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&id)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return false, nil, nil
+		default:
+			return false, nil, err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM attachments WHERE uploader_id = $1 AND message_id IS NULL RETURNING blob_key, thumbnail_key`, userID)
+	if err != nil {
+		return false, nil, err
+	}
+	blobKeys := []string{}
+	for rows.Next() {
+		var blobKey string
+		var thumbnailKey *string
+		if err := rows.Scan(&blobKey, &thumbnailKey); err != nil {
+			rows.Close()
+			return false, nil, err
+		}
+		blobKeys = append(blobKeys, blobKey)
+		if thumbnailKey != nil {
+			blobKeys = append(blobKeys, *thumbnailKey)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+
+	// Data export archives hold everything the user is deleting
+	rows, err = tx.QueryContext(ctx, `DELETE FROM data_exports WHERE user_id = $1 RETURNING blob_key`, userID)
+	if err != nil {
+		return false, nil, err
+	}
+	for rows.Next() {
+		var blobKey *string
+		if err := rows.Scan(&blobKey); err != nil {
+			rows.Close()
+			return false, nil, err
+		}
+		if blobKey != nil {
+			blobKeys = append(blobKeys, *blobKey)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+
+	statements := []string{
+		`UPDATE messages SET author_id = '` + DeletedUserID.String() + `' WHERE author_id = $1`,
+		`UPDATE attachments SET uploader_id = '` + DeletedUserID.String() + `' WHERE uploader_id = $1`,
+		// Group channels go to the member who has been in them the longest
+		`UPDATE channels SET owner_id = COALESCE(
+			(SELECT user_id FROM channel_members WHERE channel_id = channels.id AND user_id <> $1 ORDER BY joined_at, id LIMIT 1),
+			'` + DeletedUserID.String() + `'
+		) WHERE owner_id = $1`,
+		`DELETE FROM channel_members WHERE user_id = $1`,
+		`DELETE FROM relationships WHERE user_id = $1 OR other_user_id = $1`,
+		`DELETE FROM sessions WHERE user_id = $1`,
+		`DELETE FROM refresh_tokens WHERE user_id = $1`,
+		`DELETE FROM api_tokens WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM mfa_recovery_codes WHERE user_id = $1`,
+		`DELETE FROM email_verification_tokens WHERE user_id = $1`,
+		`DELETE FROM password_reset_tokens WHERE user_id = $1`,
+		`UPDATE users SET deactivated_at = COALESCE(deactivated_at, now()), deletion_scheduled_at = now(), updated_at = now()
+		WHERE bot_owner_id = $1 AND deleted_at IS NULL`,
+		`UPDATE users
+		SET username = 'deleted-' || replace(id::text, '-', ''),
+			email = 'deleted-' || id || '@users.invalid',
+			password = '',
+			email_verified_at = NULL,
+			pending_email = NULL,
+			display_name = NULL,
+			bio = NULL,
+			avatar_url = NULL,
+			bot_owner_id = NULL,
+			deactivated_at = COALESCE(deactivated_at, now()),
+			deleted_at = now(),
+			updated_at = now()
+		WHERE id = $1`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement, userID); err != nil {
+			return false, nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, blobKeys, nil
+}
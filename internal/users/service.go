@@ -2,32 +2,100 @@ package users
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/alexedwards/argon2id"
+	"github.com/google/uuid"
 	"github.com/jakottelaar/relay-backend/config"
 	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/auth"
+	"github.com/jakottelaar/relay-backend/internal/blob"
+	"github.com/jakottelaar/relay-backend/internal/lockout"
+	"github.com/jakottelaar/relay-backend/internal/mail"
+	"github.com/jakottelaar/relay-backend/internal/mfa"
+	"github.com/jakottelaar/relay-backend/internal/oidc"
 )
 
 type UserService interface {
 	CreateUser(ctx context.Context, user *User) (*User, error)
 	GetUserByID(ctx context.Context, id string) (*User, error)
-	LoginUser(ctx context.Context, email, password string) (*LoginResponse, error)
+	GetPublicProfile(ctx context.Context, viewerID, userID uuid.UUID) (*User, error)
+	SearchUsers(ctx context.Context, viewerID uuid.UUID, query string, limit int) ([]*User, error)
+	LoginUser(ctx context.Context, email, password string, reactivate bool, client *auth.ClientInfo) (*LoginResponse, error)
+	LoginMFA(ctx context.Context, mfaToken, code string, client *auth.ClientInfo) (*LoginResponse, error)
+	LoginOIDC(ctx context.Context, providerName string, req *oidc.CallbackRequest, client *auth.ClientInfo) (*LoginResponse, error)
+	VerifyEmail(ctx context.Context, token string) error
+	ResendEmailVerification(ctx context.Context, userID uuid.UUID) error
+	ForgotPassword(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, token, password string) error
+	ChangePassword(ctx context.Context, claims *internal.JWTClaims, currentPassword, newPassword string) error
+	UpdateProfile(ctx context.Context, userID uuid.UUID, req *UpdateProfileRequest) (*User, error)
+	UploadAvatar(ctx context.Context, userID uuid.UUID, upload *blob.Upload) (*User, error)
+	DeleteAvatar(ctx context.Context, userID uuid.UUID) (*User, error)
+	DeactivateAccount(ctx context.Context, userID uuid.UUID, password string) error
+	RequestAccountDeletion(ctx context.Context, userID uuid.UUID, password string) (time.Time, error)
+	DeleteDueAccounts(ctx context.Context) error
+	CreateBot(ctx context.Context, ownerID uuid.UUID, username string) (*User, error)
+	GetBots(ctx context.Context, ownerID uuid.UUID) ([]*User, error)
+	DeleteBot(ctx context.Context, ownerID, botID uuid.UUID) error
+	CreateBotToken(ctx context.Context, ownerID, botID uuid.UUID, req *auth.CreateAPITokenRequest) (*auth.CreateAPITokenResponse, error)
+	GetBotTokens(ctx context.Context, ownerID, botID uuid.UUID) ([]*auth.APIToken, error)
+	RevokeBotToken(ctx context.Context, ownerID, botID, tokenID uuid.UUID) error
 }
 
 type userService struct {
-	repo UserRepo
-	cfg  config.Config
+	repo           UserRepo
+	authService    auth.AuthService
+	mfaService     mfa.MFAService
+	lockoutService lockout.LockoutService
+	oidcService    oidc.OIDCService
+	mailer         mail.Mailer
+	blobs          blob.BlobStore
+	signer         *internal.Signer
+	cfg            config.Config
+	passwordParams *argon2id.Params
+	// dummyPasswordHash is compared against when no account uses an email
+	// address, so a failed login takes as long whether or not the account
+	// exists. It is created on first use.
+	dummyPasswordHash func() (string, error)
 }
 
-func NewUserService(repo UserRepo, cfg config.Config) UserService {
+func NewUserService(repo UserRepo, authService auth.AuthService, mfaService mfa.MFAService, lockoutService lockout.LockoutService, oidcService oidc.OIDCService, mailer mail.Mailer, blobs blob.BlobStore, signer *internal.Signer, cfg config.Config) UserService {
+	passwordParams := &argon2id.Params{
+		Memory:      uint32(cfg.Argon2MemoryKiB),
+		Iterations:  uint32(cfg.Argon2Iterations),
+		Parallelism: uint8(cfg.Argon2Parallelism),
+		SaltLength:  argon2id.DefaultParams.SaltLength,
+		KeyLength:   argon2id.DefaultParams.KeyLength,
+	}
+
 	return &userService{
-		repo: repo,
-		cfg:  cfg,
+		repo:           repo,
+		authService:    authService,
+		mfaService:     mfaService,
+		lockoutService: lockoutService,
+		oidcService:    oidcService,
+		mailer:         mailer,
+		blobs:          blobs,
+		signer:         signer,
+		cfg:            cfg,
+		passwordParams: passwordParams,
+		dummyPasswordHash: sync.OnceValues(func() (string, error) {
+			return argon2id.CreateHash("dummy-password", passwordParams)
+		}),
 	}
 }
 
 func (s *userService) CreateUser(ctx context.Context, user *User) (*User, error) {
-	passwordHash, err := argon2id.CreateHash(user.Password, argon2id.DefaultParams)
+	passwordHash, err := s.hashPassword(user.Password)
 	if err != nil {
 		return nil, err
 	}
@@ -39,37 +107,284 @@ func (s *userService) CreateUser(ctx context.Context, user *User) (*User, error)
 		return nil, err
 	}
 
+	// The account is usable right away, so a failed email is not fatal; the
+	// user can ask for another one
+	if err := s.sendEmailVerification(ctx, savedUser, savedUser.Email); err != nil {
+		log.Printf("users: failed to send verification email to user %s: %v", savedUser.ID, err)
+	}
+
 	return savedUser, nil
 }
 
-func (s *userService) LoginUser(ctx context.Context, email, password string) (*LoginResponse, error) {
+// LoginUser checks the credentials of a user. Unknown email addresses and
+// wrong passwords get the same error and take the same time, and both count
+// towards locking out the account and the IP address.
+func (s *userService) LoginUser(ctx context.Context, email, password string, reactivate bool, client *auth.ClientInfo) (*LoginResponse, error) {
+	if err := s.lockoutService.Check(ctx, email, client.IPAddress); err != nil {
+		return nil, err
+	}
+
 	user, err := s.repo.FindUserByEmail(ctx, email)
 	if err != nil {
 		return nil, err
 	}
 
-	if user == nil {
-		return nil, internal.NewNotFoundError("user not found")
+	// Bots only authenticate with API tokens, and deleted users not at all
+	if user != nil && (user.IsBot || user.DeletedAt != nil) {
+		user = nil
 	}
 
-	match, err := argon2id.ComparePasswordAndHash(password, user.Password)
+	passwordHash, err := s.dummyPasswordHash()
 	if err != nil {
 		return nil, err
 	}
+	if user != nil {
+		passwordHash = user.Password
+	}
 
-	if !match {
+	match, params, err := argon2id.CheckHash(password, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || !match {
+		if err := s.lockoutService.RecordFailure(ctx, email, client.IPAddress); err != nil {
+			return nil, err
+		}
 		return nil, internal.NewUnauthorizedError("invalid credentials")
 	}
 
-	token, err := internal.GenerateJWT(user.ID.String(), s.cfg.JwtSecret, s.cfg.JwtExpirationSecond)
+	// This is the only time the plain password is known, so it is the only
+	// chance to bring a hash made with older parameters up to date
+	if weakerPasswordParams(params, s.passwordParams) {
+		if err := s.rehashPassword(ctx, user, password); err != nil {
+			log.Printf("users: failed to rehash password of user %s: %v", user.ID, err)
+		}
+	}
+
+	return s.completeLogin(ctx, user, reactivate, client)
+}
+
+// LoginOIDC logs in the user an identity provider vouches for. A user who
+// has not used the provider before is linked to the account with the same
+// email address, or gets a new account if there is none.
+func (s *userService) LoginOIDC(ctx context.Context, providerName string, req *oidc.CallbackRequest, client *auth.ClientInfo) (*LoginResponse, error) {
+	identity, err := s.oidcService.Callback(ctx, providerName, req)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.FindUserByIdentity(ctx, identity.Provider, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		user, err = s.linkOIDCIdentity(ctx, identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.completeLogin(ctx, user, req.Reactivate, client)
+}
+
+func (s *userService) linkOIDCIdentity(ctx context.Context, identity *oidc.Identity) (*User, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, internal.NewUnprocessableEntityError("Identity provider did not confirm an email address")
+	}
+
+	userIdentity := &UserIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+
+	existing, err := s.repo.FindUserByEmail(ctx, identity.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		// Anyone can sign up with an address they do not own, so linking to
+		// an unverified account would let whoever created it take over the
+		// identity
+		if existing.EmailVerifiedAt == nil {
+			return nil, internal.NewDuplicateError("An account with this email address already exists, log in with its password first")
+		}
+
+		userIdentity.UserID = existing.ID
+		if err := s.repo.SaveUserIdentity(ctx, userIdentity); err != nil {
+			return nil, err
+		}
+
+		return existing, nil
+	}
+
+	// The user can set a password later with the password reset flow
+	password, err := internal.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	passwordHash, err := s.hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	verifiedAt := time.Now()
+	baseUsername := oidcUsername(identity)
+
+	for attempt := 0; ; attempt++ {
+		username := baseUsername
+		if attempt > 0 {
+			suffix, err := randomDigits(4)
+			if err != nil {
+				return nil, err
+			}
+			username = baseUsername + "-" + suffix
+		}
+
+		user, err := s.repo.SaveUserWithIdentity(ctx, &User{
+			Username:        username,
+			Email:           identity.Email,
+			Password:        passwordHash,
+			EmailVerifiedAt: &verifiedAt,
+		}, userIdentity)
+
+		var serviceErr *internal.ServiceError
+		if errors.As(err, &serviceErr) && serviceErr.Message == "username already exists" && attempt < maxUsernameAttempts {
+			continue
+		}
+
+		return user, err
+	}
+}
+
+// completeLogin issues tokens to a user whose first factor has been checked,
+// or an MFA token if the user has to give a second factor.
+func (s *userService) completeLogin(ctx context.Context, user *User, reactivate bool, client *auth.ClientInfo) (*LoginResponse, error) {
+	if user.DeactivatedAt != nil && !reactivate {
+		return nil, internal.NewForbiddenError("Account is deactivated, log in with reactivate set to restore it")
+	}
+
+	mfaEnabled, err := s.mfaService.IsEnabled(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The failures of the account are only cleared once the second factor is
+	// given too, otherwise knowing the password would allow guessing codes
+	// without ever being locked out
+	if mfaEnabled {
+		// A deactivated account is only restored once the second factor is
+		// given too
+		claims := &mfaChallengeClaims{ChallengeID: uuid.New(), UserID: user.ID, Reactivate: user.DeactivatedAt != nil}
+		mfaToken, err := s.signer.Sign(mfaChallengePurpose, claims, mfaChallengeTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		return &LoginResponse{
+			UserID:      user.ID,
+			UserName:    user.Username,
+			MFARequired: true,
+			MFAToken:    mfaToken,
+		}, nil
+	}
+
+	if user.DeactivatedAt != nil {
+		if err := s.repo.ReactivateUser(ctx, user.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.issueLoginTokens(ctx, user, client)
+}
+
+// LoginMFA completes the login of a user with two-factor authentication, using
+// the MFA token from LoginUser and a code from their authenticator app or a
+// recovery code. Wrong codes count towards a lockout like wrong passwords.
+// Once a login succeeds, the MFA token cannot be used again.
+func (s *userService) LoginMFA(ctx context.Context, mfaToken, code string, client *auth.ClientInfo) (*LoginResponse, error) {
+	var claims mfaChallengeClaims
+	if err := s.signer.Verify(mfaChallengePurpose, mfaToken, &claims); err != nil || claims.ChallengeID == uuid.Nil {
+		return nil, internal.NewUnauthorizedError("Invalid or expired MFA token")
+	}
+
+	// Checked before the code, so a reused token does not use up a code
+	used, err := s.repo.IsMFAChallengeUsed(ctx, claims.ChallengeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if used {
+		return nil, internal.NewUnauthorizedError("Invalid or expired MFA token")
+	}
+
+	user, err := s.repo.FindUserByID(ctx, claims.UserID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || user.DeletedAt != nil {
+		return nil, internal.NewUnauthorizedError("Invalid or expired MFA token")
+	}
+
+	if user.DeactivatedAt != nil && !claims.Reactivate {
+		return nil, internal.NewForbiddenError("Account is deactivated, log in with reactivate set to restore it")
+	}
+
+	if err := s.lockoutService.Check(ctx, user.Email, client.IPAddress); err != nil {
+		return nil, err
+	}
+
+	valid, err := s.mfaService.Verify(ctx, user.ID, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if !valid {
+		if err := s.lockoutService.RecordFailure(ctx, user.Email, client.IPAddress); err != nil {
+			return nil, err
+		}
+		return nil, internal.NewUnauthorizedError("Invalid verification code")
+	}
+
+	// Only one of concurrent logins with the same token gets through
+	used, err = s.repo.UseMFAChallenge(ctx, claims.ChallengeID, user.ID, time.Now().Add(mfaChallengeTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	if !used {
+		return nil, internal.NewUnauthorizedError("Invalid or expired MFA token")
+	}
+
+	if user.DeactivatedAt != nil {
+		if err := s.repo.ReactivateUser(ctx, user.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.issueLoginTokens(ctx, user, client)
+}
+
+func (s *userService) issueLoginTokens(ctx context.Context, user *User, client *auth.ClientInfo) (*LoginResponse, error) {
+	if err := s.lockoutService.RecordSuccess(ctx, user.Email); err != nil {
+		log.Printf("users: failed to clear failed logins of user %s: %v", user.ID, err)
+	}
+
+	tokens, err := s.authService.IssueTokens(ctx, user.ID, client)
 	if err != nil {
 		return nil, err
 	}
 
 	return &LoginResponse{
-		UserID:      user.ID,
-		UserName:    user.Username,
-		AccessToken: token,
+		UserID:       user.ID,
+		UserName:     user.Username,
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
 	}, nil
 }
 
@@ -85,3 +400,707 @@ func (s *userService) GetUserByID(ctx context.Context, id string) (*User, error)
 
 	return user, nil
 }
+
+// GetPublicProfile returns another user's profile. Users who blocked the
+// viewer look like they do not exist.
+func (s *userService) GetPublicProfile(ctx context.Context, viewerID, userID uuid.UUID) (*User, error) {
+	user, err := s.repo.FindVisibleUserByID(ctx, userID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, internal.NewNotFoundError("user not found")
+	}
+
+	return user, nil
+}
+
+func (s *userService) SearchUsers(ctx context.Context, viewerID uuid.UUID, query string, limit int) ([]*User, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return []*User{}, nil
+	}
+
+	if limit <= 0 {
+		limit = defaultUserSearchLimit
+	}
+
+	return s.repo.SearchUsers(ctx, query, viewerID, limit)
+}
+
+func (s *userService) VerifyEmail(ctx context.Context, token string) error {
+	var claims emailVerificationClaims
+	if err := s.signer.Verify(emailVerificationPurpose, token, &claims); err != nil {
+		return internal.NewBadRequestError("Invalid or expired verification token")
+	}
+
+	verified, err := s.repo.VerifyEmail(ctx, claims.TokenID)
+	if err != nil {
+		return err
+	}
+
+	if !verified {
+		return internal.NewBadRequestError("Invalid or expired verification token")
+	}
+
+	return nil
+}
+
+func (s *userService) ResendEmailVerification(ctx context.Context, userID uuid.UUID) error {
+	user, err := s.repo.FindUserByID(ctx, userID.String())
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return internal.NewNotFoundError("user not found")
+	}
+
+	// A pending address is verified before the current one
+	email := user.Email
+	if user.PendingEmail != nil {
+		email = *user.PendingEmail
+	} else if user.EmailVerifiedAt != nil {
+		return internal.NewDuplicateError("Email is already verified")
+	}
+
+	latest, err := s.repo.FindLatestEmailVerificationToken(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if latest != nil && time.Since(latest.CreatedAt) < emailVerificationCooldown {
+		return internal.NewTooManyRequestsError("Verification email was sent recently, try again later")
+	}
+
+	return s.sendEmailVerification(ctx, user, email)
+}
+
+// sendEmailVerification sends a verification link to email, which is either
+// the current or the pending address of the user.
+func (s *userService) sendEmailVerification(ctx context.Context, user *User, email string) error {
+	token, err := s.repo.SaveEmailVerificationToken(ctx, &EmailVerificationToken{
+		UserID:    user.ID,
+		Email:     email,
+		ExpiresAt: time.Now().Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("save verification token: %w", err)
+	}
+
+	signed, err := s.signer.Sign(emailVerificationPurpose, &emailVerificationClaims{TokenID: token.ID}, emailVerificationTTL)
+	if err != nil {
+		return fmt.Errorf("sign verification token: %w", err)
+	}
+
+	link := s.cfg.AppURL + "/verify-email?token=" + url.QueryEscape(signed)
+
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"Please confirm your email address by opening the link below:\n\n"+
+		"%s\n\n"+
+		"The link expires in %d hours. If you did not create a Relay account, you can ignore this email.\n",
+		user.Username, link, int(emailVerificationTTL.Hours()))
+	if email != user.Email {
+		body = fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm the new email address of your Relay account by opening the link below:\n\n"+
+			"%s\n\n"+
+			"Your account keeps using its current address until then. The link expires in %d hours. "+
+			"If you did not ask for this, you can ignore this email.\n",
+			user.Username, link, int(emailVerificationTTL.Hours()))
+	}
+
+	err = s.mailer.Send(ctx, &mail.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body:    body,
+	})
+	if err != nil {
+		return fmt.Errorf("send verification email: %w", err)
+	}
+
+	return nil
+}
+
+// ForgotPassword emails a password reset link if an account uses the email
+// address. The result is the same either way, so it cannot be used to find
+// out which addresses have an account.
+func (s *userService) ForgotPassword(ctx context.Context, email string) error {
+	user, err := s.repo.FindUserByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	latest, err := s.repo.FindLatestPasswordResetToken(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	if latest != nil && time.Since(latest.CreatedAt) < passwordResetCooldown {
+		return nil
+	}
+
+	token, err := internal.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.repo.SavePasswordResetToken(ctx, &PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: internal.HashOpaqueToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sending takes noticeably longer than not sending, so it happens in the
+	// background to keep the response time the same for unknown addresses
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		if err := s.sendPasswordReset(ctx, user, token); err != nil {
+			log.Printf("users: failed to send password reset email to user %s: %v", user.ID, err)
+		}
+	}()
+
+	return nil
+}
+
+// ResetPassword sets a new password using the token from a reset email and
+// logs the user out everywhere. API tokens of the user and their bots are
+// revoked as well, since whoever had the old password could have made them.
+func (s *userService) ResetPassword(ctx context.Context, token, password string) error {
+	passwordHash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	userID, err := s.repo.ResetPassword(ctx, internal.HashOpaqueToken(token), passwordHash)
+	if err != nil {
+		return err
+	}
+
+	if userID == uuid.Nil {
+		return internal.NewBadRequestError("Invalid or expired reset token")
+	}
+
+	return s.authService.RevokeAllCredentials(ctx, userID)
+}
+
+// ChangePassword replaces the password of a logged in user who knows the
+// current one. Every other session of the user is logged out.
+func (s *userService) ChangePassword(ctx context.Context, claims *internal.JWTClaims, currentPassword, newPassword string) error {
+	user, err := s.repo.FindUserByID(ctx, claims.UserId)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return internal.NewNotFoundError("user not found")
+	}
+
+	match, err := argon2id.ComparePasswordAndHash(currentPassword, user.Password)
+	if err != nil {
+		return err
+	}
+
+	if !match {
+		return internal.NewForbiddenError("Current password is incorrect")
+	}
+
+	passwordHash, err := s.hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.UpdatePassword(ctx, user.ID, passwordHash); err != nil {
+		return err
+	}
+
+	return s.authService.LogoutOtherSessions(ctx, claims)
+}
+
+// CreateBot creates a bot account owned by ownerID. Bots have no mailbox and
+// no usable password; they act through the API tokens their owner creates.
+func (s *userService) CreateBot(ctx context.Context, ownerID uuid.UUID, username string) (*User, error) {
+	owner, err := s.repo.FindUserByID(ctx, ownerID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == nil {
+		return nil, internal.NewNotFoundError("User not found")
+	}
+
+	if owner.IsBot {
+		return nil, internal.NewForbiddenError("Bots cannot create bots")
+	}
+
+	password, err := internal.GenerateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	passwordHash, err := s.hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repo.SaveBot(ctx, &User{
+		Username:   username,
+		Email:      fmt.Sprintf("bot-%s@%s", uuid.NewString(), botEmailDomain),
+		Password:   passwordHash,
+		BotOwnerID: &ownerID,
+	})
+}
+
+func (s *userService) GetBots(ctx context.Context, ownerID uuid.UUID) ([]*User, error) {
+	return s.repo.FindBotsByOwnerID(ctx, ownerID)
+}
+
+// DeleteBot deletes a bot the same way accounts are deleted, so its messages
+// stay in the conversations they were sent to.
+func (s *userService) DeleteBot(ctx context.Context, ownerID, botID uuid.UUID) error {
+	bot, err := s.repo.ScheduleBotDeletion(ctx, botID, ownerID)
+	if err != nil {
+		return err
+	}
+
+	if bot == nil {
+		return internal.NewNotFoundError("Bot not found")
+	}
+
+	// The bot is deactivated already, so if this fails the deletion job
+	// finishes it later
+	if _, err := s.deleteAccount(ctx, bot); err != nil {
+		log.Printf("users: failed to delete bot %s: %v", bot.ID, err)
+	}
+
+	return nil
+}
+
+func (s *userService) CreateBotToken(ctx context.Context, ownerID, botID uuid.UUID, req *auth.CreateAPITokenRequest) (*auth.CreateAPITokenResponse, error) {
+	if err := s.checkBotOwner(ctx, ownerID, botID); err != nil {
+		return nil, err
+	}
+
+	return s.authService.CreateAPIToken(ctx, botID, req)
+}
+
+func (s *userService) GetBotTokens(ctx context.Context, ownerID, botID uuid.UUID) ([]*auth.APIToken, error) {
+	if err := s.checkBotOwner(ctx, ownerID, botID); err != nil {
+		return nil, err
+	}
+
+	return s.authService.GetAPITokens(ctx, botID)
+}
+
+func (s *userService) RevokeBotToken(ctx context.Context, ownerID, botID, tokenID uuid.UUID) error {
+	if err := s.checkBotOwner(ctx, ownerID, botID); err != nil {
+		return err
+	}
+
+	return s.authService.RevokeAPIToken(ctx, botID, tokenID)
+}
+
+// checkBotOwner answers with not found for bots of other users, so their ids
+// cannot be probed.
+func (s *userService) checkBotOwner(ctx context.Context, ownerID, botID uuid.UUID) error {
+	bot, err := s.repo.FindBot(ctx, botID, ownerID)
+	if err != nil {
+		return err
+	}
+
+	if bot == nil {
+		return internal.NewNotFoundError("Bot not found")
+	}
+
+	return nil
+}
+
+// UpdateProfile applies the changes in req. A new email address is kept as
+// pending until it is verified, and the current address is told about the
+// change. Setting the current address again cancels a pending change.
+func (s *userService) UpdateProfile(ctx context.Context, userID uuid.UUID, req *UpdateProfileRequest) (*User, error) {
+	user, err := s.repo.FindUserByID(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, internal.NewNotFoundError("user not found")
+	}
+
+	if req.Username != nil {
+		user.Username = *req.Username
+	}
+
+	if req.DisplayName != nil {
+		user.DisplayName = optionalString(*req.DisplayName)
+	}
+
+	if req.Bio != nil {
+		user.Bio = optionalString(*req.Bio)
+	}
+
+	oldAvatarURL := user.AvatarURL
+	if req.AvatarURL != nil {
+		if *req.AvatarURL != "" && !isWebURL(*req.AvatarURL) {
+			return nil, internal.NewUnprocessableEntityError("Invalid input: avatar_url must be an http or https URL")
+		}
+		user.AvatarURL = optionalString(*req.AvatarURL)
+	}
+
+	emailChanged := req.Email != nil && *req.Email != user.Email &&
+		(user.PendingEmail == nil || *req.Email != *user.PendingEmail)
+
+	if req.Email != nil && *req.Email == user.Email {
+		user.PendingEmail = nil
+	}
+
+	if emailChanged {
+		if user.IsBot {
+			return nil, internal.NewForbiddenError("Bots cannot change their email address")
+		}
+
+		match, err := argon2id.ComparePasswordAndHash(req.Password, user.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		if !match {
+			return nil, internal.NewForbiddenError("Password is incorrect")
+		}
+
+		existing, err := s.repo.FindUserByEmail(ctx, *req.Email)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != nil {
+			return nil, internal.NewDuplicateError("email already exists")
+		}
+
+		user.PendingEmail = req.Email
+	}
+
+	user, err = s.repo.UpdateProfile(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.AvatarURL != nil {
+		s.deleteUploadedAvatar(ctx, user.ID, oldAvatarURL, user.AvatarURL)
+	}
+
+	if emailChanged {
+		if err := s.sendEmailVerification(ctx, user, *user.PendingEmail); err != nil {
+			log.Printf("users: failed to send verification email to user %s: %v", user.ID, err)
+		}
+
+		if err := s.sendEmailChanged(ctx, user); err != nil {
+			log.Printf("users: failed to notify user %s of email change: %v", user.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+// UploadAvatar stores an uploaded image and makes it the user's avatar.
+func (s *userService) UploadAvatar(ctx context.Context, userID uuid.UUID, upload *blob.Upload) (*User, error) {
+	if !avatarContentTypes[upload.ContentType] {
+		return nil, internal.NewUnsupportedMediaTypeError("Avatar must be a PNG, JPEG, GIF or WebP image")
+	}
+
+	user, err := s.repo.FindUserByID(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, internal.NewNotFoundError("user not found")
+	}
+
+	// Every upload gets a new key, so cached copies of the old avatar are
+	// never served in its place
+	key := avatarKeyPrefix(user.ID) + uuid.NewString() + upload.Extension()
+	if err := s.blobs.Put(ctx, key, upload.Reader, upload.Size, upload.ContentType); err != nil {
+		return nil, fmt.Errorf("store avatar: %w", err)
+	}
+
+	oldAvatarURL := user.AvatarURL
+	avatarURL := s.blobs.URL(key)
+	user.AvatarURL = &avatarURL
+
+	user, err = s.repo.UpdateProfile(ctx, user)
+	if err != nil {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			log.Printf("users: failed to delete avatar %s: %v", key, err)
+		}
+		return nil, err
+	}
+
+	s.deleteUploadedAvatar(ctx, user.ID, oldAvatarURL, user.AvatarURL)
+
+	return user, nil
+}
+
+func (s *userService) DeleteAvatar(ctx context.Context, userID uuid.UUID) (*User, error) {
+	user, err := s.repo.FindUserByID(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, internal.NewNotFoundError("user not found")
+	}
+
+	oldAvatarURL := user.AvatarURL
+	user.AvatarURL = nil
+
+	user, err = s.repo.UpdateProfile(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	s.deleteUploadedAvatar(ctx, user.ID, oldAvatarURL, nil)
+
+	return user, nil
+}
+
+// DeactivateAccount blocks logins of a user and hides them from others until
+// they log in again with reactivate set. All their sessions end.
+func (s *userService) DeactivateAccount(ctx context.Context, userID uuid.UUID, password string) error {
+	return s.deactivate(ctx, userID, password, nil)
+}
+
+// RequestAccountDeletion deactivates a user and schedules the deletion of
+// their account after the grace period. Reactivating the account cancels it.
+func (s *userService) RequestAccountDeletion(ctx context.Context, userID uuid.UUID, password string) (time.Time, error) {
+	deletionScheduledAt := time.Now().Add(time.Duration(s.cfg.AccountDeletionGraceSecond) * time.Second).UTC()
+
+	if err := s.deactivate(ctx, userID, password, &deletionScheduledAt); err != nil {
+		return time.Time{}, err
+	}
+
+	return deletionScheduledAt, nil
+}
+
+func (s *userService) deactivate(ctx context.Context, userID uuid.UUID, password string, deletionScheduledAt *time.Time) error {
+	user, err := s.repo.FindUserByID(ctx, userID.String())
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return internal.NewNotFoundError("user not found")
+	}
+
+	match, err := argon2id.ComparePasswordAndHash(password, user.Password)
+	if err != nil {
+		return err
+	}
+
+	if !match {
+		return internal.NewForbiddenError("Password is incorrect")
+	}
+
+	if err := s.repo.DeactivateUser(ctx, user.ID, deletionScheduledAt); err != nil {
+		return err
+	}
+
+	return s.authService.LogoutAll(ctx, user.ID)
+}
+
+// DeleteDueAccounts anonymizes every user whose deletion grace period is
+// over. It is run periodically by a background job.
+func (s *userService) DeleteDueAccounts(ctx context.Context) error {
+	// Deleting users makes their bots due, so keep going until there is
+	// nothing left
+	for {
+		users, err := s.repo.FindUsersDueForDeletion(ctx, accountDeletionBatchSize)
+		if err != nil {
+			return fmt.Errorf("find users due for deletion: %w", err)
+		}
+
+		deletedAny := false
+		for _, user := range users {
+			deleted, err := s.deleteAccount(ctx, user)
+			if err != nil {
+				return err
+			}
+			deletedAny = deletedAny || deleted
+		}
+
+		if !deletedAny {
+			return nil
+		}
+	}
+}
+
+// deleteAccount anonymizes a user whose deletion is due and removes their
+// files. It returns false if the user was not due (anymore).
+func (s *userService) deleteAccount(ctx context.Context, user *User) (bool, error) {
+	deleted, blobKeys, err := s.repo.AnonymizeUser(ctx, user.ID)
+	if err != nil {
+		return false, fmt.Errorf("anonymize user %s: %w", user.ID, err)
+	}
+
+	if !deleted {
+		return false, nil
+	}
+
+	log.Printf("users: deleted account of user %s", user.ID)
+
+	// The user is gone already, leftover files are only logged
+	s.deleteUploadedAvatar(ctx, user.ID, user.AvatarURL, nil)
+	for _, key := range blobKeys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			log.Printf("users: failed to delete upload %s: %v", key, err)
+		}
+	}
+
+	return true, nil
+}
+
+// deleteUploadedAvatar removes a replaced avatar if it was uploaded rather
+// than linked. Failing to do so only leaves an orphaned blob behind.
+func (s *userService) deleteUploadedAvatar(ctx context.Context, userID uuid.UUID, oldURL, newURL *string) {
+	if oldURL == nil || (newURL != nil && *newURL == *oldURL) {
+		return
+	}
+
+	// Users can link any URL as their avatar, including someone else's
+	// uploaded avatar, so only files uploaded for this user are removed
+	key, ok := blob.KeyFromURL(s.blobs, *oldURL)
+	if !ok || !strings.HasPrefix(key, avatarKeyPrefix(userID)) {
+		return
+	}
+
+	if err := s.blobs.Delete(ctx, key); err != nil {
+		log.Printf("users: failed to delete avatar %s: %v", key, err)
+	}
+}
+
+// avatarKeyPrefix is where the avatars uploaded by a user are stored.
+func avatarKeyPrefix(userID uuid.UUID) string {
+	return blob.PublicPrefix + "avatars/" + userID.String() + "/"
+}
+
+// sendEmailChanged warns the current address about a pending change, so the
+// owner notices if someone else is taking over the account.
+func (s *userService) sendEmailChanged(ctx context.Context, user *User) error {
+	return s.mailer.Send(ctx, &mail.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to change the email address of your Relay account to %s. "+
+			"The change takes effect once the new address is confirmed.\n\n"+
+			"If you did not do this, reset your password and contact support.\n",
+			user.Username, *user.PendingEmail),
+	})
+}
+
+func (s *userService) sendPasswordReset(ctx context.Context, user *User, token string) error {
+	link := s.cfg.AppURL + "/reset-password?token=" + url.QueryEscape(token)
+
+	return s.mailer.Send(ctx, &mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your Relay account. Open the link below to choose a new one:\n\n"+
+			"%s\n\n"+
+			"The link expires in %d minutes. If you did not ask for this, you can ignore this email.\n",
+			user.Username, link, int(passwordResetTTL.Minutes())),
+	})
+}
+
+// rehashPassword replaces the hash of the password with one made with the
+// current parameters. The hash is only replaced if the password has not been
+// changed in the meantime.
+func (s *userService) rehashPassword(ctx context.Context, user *User, password string) error {
+	passwordHash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.ReplacePasswordHash(ctx, user.ID, user.Password, passwordHash)
+}
+
+// weakerPasswordParams reports whether current is at least as strong as
+// params in every parameter and stronger in at least one, so rehashing with
+// current is a strict upgrade. Hashes are never downgraded in any parameter,
+// so instances still running with older settings during a deploy do not undo
+// upgrades.
+func weakerPasswordParams(params, current *argon2id.Params) bool {
+	if current.Memory < params.Memory ||
+		current.Iterations < params.Iterations ||
+		current.Parallelism < params.Parallelism ||
+		current.SaltLength < params.SaltLength ||
+		current.KeyLength < params.KeyLength {
+		return false
+	}
+
+	return *current != *params
+}
+
+func (s *userService) hashPassword(password string) (string, error) {
+	return argon2id.CreateHash(password, s.passwordParams)
+}
+
+var usernameDisallowed = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// oidcUsername suggests a username for a user signing up through an identity
+// provider, based on what the provider knows about them.
+func oidcUsername(identity *oidc.Identity) string {
+	candidates := []string{identity.PreferredUsername, identity.Name, strings.Split(identity.Email, "@")[0]}
+
+	for _, candidate := range candidates {
+		username := usernameDisallowed.ReplaceAllString(candidate, "-")
+		username = strings.Trim(username, "-")
+		if len(username) > maxOIDCUsernameLength {
+			username = username[:maxOIDCUsernameLength]
+		}
+		if len(username) >= 3 {
+			return username
+		}
+	}
+
+	return "user"
+}
+
+// optionalString stores an empty string as NULL.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func randomDigits(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = '0' + b[i]%10
+	}
+
+	return string(b), nil
+}
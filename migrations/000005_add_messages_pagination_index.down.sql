@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_messages_channel_created_at_id;
\ No newline at end of file
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_messages_channel_created_at_id ON messages (channel_id, created_at, id);
\ No newline at end of file
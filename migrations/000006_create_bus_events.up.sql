@@ -0,0 +1,6 @@
+-- Events too large for a NOTIFY payload, kept only until every instance has read them
+CREATE UNLOGGED TABLE IF NOT EXISTS bus_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,11 @@
+-- Failed login attempts, counted per account and per IP address. The key is
+-- "account:<email>" or "ip:<address>", so unknown email addresses are counted
+-- the same way as existing ones.
+CREATE TABLE IF NOT EXISTS login_failures (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_failures_last_failure_at ON login_failures (last_failure_at);
@@ -0,0 +1,23 @@
+-- Bots are users that belong to a human owner and can only authenticate with
+-- API tokens
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS bot_owner_id UUID REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_users_bot_owner_id ON users (bot_owner_id) WHERE bot_owner_id IS NOT NULL;
+
+-- Long-lived tokens for integrations, either personal access tokens of a
+-- user or tokens of a bot
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens (user_id);
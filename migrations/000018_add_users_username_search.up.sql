@@ -0,0 +1,5 @@
+-- Trigram index for searching users by (part of) their username. It serves
+-- both prefix searches with ILIKE and similarity matches.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING gin (username gin_trgm_ops);
@@ -0,0 +1,23 @@
+ALTER TABLE channels
+    DROP CONSTRAINT IF EXISTS channels_owner_id_fkey,
+    ADD CONSTRAINT channels_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE attachments
+    DROP CONSTRAINT IF EXISTS attachments_uploader_id_fkey,
+    ADD CONSTRAINT attachments_uploader_id_fkey FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE messages
+    DROP CONSTRAINT IF EXISTS messages_author_id_fkey,
+    ADD CONSTRAINT messages_author_id_fkey FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE;
+
+UPDATE messages SET author_id = NULL WHERE author_id = '00000000-0000-0000-0000-000000000000';
+UPDATE channels SET owner_id = NULL WHERE owner_id = '00000000-0000-0000-0000-000000000000';
+DELETE FROM attachments WHERE uploader_id = '00000000-0000-0000-0000-000000000000';
+DELETE FROM users WHERE id = '00000000-0000-0000-0000-000000000000';
+
+DROP INDEX IF EXISTS idx_users_deletion_scheduled_at;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS deactivated_at,
+    DROP COLUMN IF EXISTS deletion_scheduled_at,
+    DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,29 @@
+-- Deactivated users cannot log in and are hidden from others. A deletion
+-- request deactivates the user and schedules their anonymization.
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users (deletion_scheduled_at)
+    WHERE deletion_scheduled_at IS NOT NULL AND deleted_at IS NULL;
+
+-- Messages of deleted users are attributed to this placeholder, so deleting
+-- a user never takes other people's conversations with it. It cannot log in.
+INSERT INTO users (id, username, email, password, display_name, deleted_at)
+VALUES ('00000000-0000-0000-0000-000000000000', 'Deleted User', 'deleted-user@users.invalid', '', 'Deleted User', now())
+ON CONFLICT (id) DO NOTHING;
+
+-- Users are anonymized rather than deleted. Should a user row be deleted
+-- anyway, it must not take messages, uploads or channels with it.
+ALTER TABLE messages
+    DROP CONSTRAINT IF EXISTS messages_author_id_fkey,
+    ADD CONSTRAINT messages_author_id_fkey FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE RESTRICT;
+
+ALTER TABLE attachments
+    DROP CONSTRAINT IF EXISTS attachments_uploader_id_fkey,
+    ADD CONSTRAINT attachments_uploader_id_fkey FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE RESTRICT;
+
+ALTER TABLE channels
+    DROP CONSTRAINT IF EXISTS channels_owner_id_fkey,
+    ADD CONSTRAINT channels_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE RESTRICT;
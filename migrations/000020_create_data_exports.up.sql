@@ -0,0 +1,22 @@
+-- Archives of everything a user has stored, built in the background when the
+-- user asks for one. The archive can be downloaded once.
+CREATE TABLE IF NOT EXISTS data_exports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN
+        ('pending', 'processing', 'ready', 'downloaded', 'expired', 'failed')),
+    blob_key TEXT,
+    size BIGINT,
+    started_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    downloaded_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports (user_id, created_at);
+
+-- A user has at most one export being built at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_data_exports_user_id_active ON data_exports (user_id) WHERE status IN ('pending', 'processing');
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_status ON data_exports (status, created_at) WHERE status IN ('pending', 'processing', 'ready', 'downloaded');
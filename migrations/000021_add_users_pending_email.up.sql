@@ -0,0 +1,3 @@
+-- A new email address is only used once it is verified, until then it is
+-- kept here
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email TEXT;
@@ -0,0 +1,2 @@
+-- Lets the messages of one author be read in order, e.g. for data exports
+CREATE INDEX IF NOT EXISTS idx_messages_author_created_at_id ON messages (author_id, created_at, id);
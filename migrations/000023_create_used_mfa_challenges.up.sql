@@ -0,0 +1,8 @@
+-- MFA challenges that were completed, so a challenge token cannot be used for
+-- a second login. Kept until the token would have expired anyway
+CREATE TABLE IF NOT EXISTS used_mfa_challenges (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
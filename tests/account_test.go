@@ -0,0 +1,253 @@
+package tests
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal/messages"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeactivateAccount(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	other := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+	otherHeaders := map[string]string{"Authorization": "Bearer " + other.AccessToken}
+
+	token := createAPIToken(t, app, "/api/v1/users/me/tokens", map[string]interface{}{
+		"name":   "cli",
+		"scopes": []string{"profile:read"},
+	}, headers)
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/bots", map[string]string{"username": "test-bot"}, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var botResponse struct {
+		Bot users.BotResponse `json:"bot"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &botResponse); err != nil {
+		t.Fatalf("Error unmarshalling bot response: %v", err)
+	}
+	botToken := createAPIToken(t, app, "/api/v1/bots/"+botResponse.Bot.ID.String()+"/tokens", map[string]interface{}{
+		"name":   "ci",
+		"scopes": []string{"profile:read"},
+	}, headers)
+	botHeaders := map[string]string{"Authorization": "Bot " + botToken.Token}
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/deactivate", map[string]interface{}{"password": "wrong-password"}, headers)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/deactivate", map[string]interface{}{"password": "test-password"}, map[string]string{
+		"Authorization": "Bot " + token.Token,
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	server := startTestServer(t, app)
+	conn, _, err := dialGateway(t, server, "?access_token="+user.AccessToken)
+	if err != nil {
+		t.Fatalf("Error dialing gateway: %v", err)
+	}
+	defer conn.Close()
+	assert.Equal(t, "hello", readGatewayPayload(t, conn)["op"])
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/deactivate", map[string]interface{}{"password": "test-password"}, headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// Open gateway connections are closed
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Error setting read deadline: %v", err)
+	}
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4001), "expected close code 4001, got %v", err)
+
+	// Every session ended and API tokens stop working
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, headers)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	refreshTokens(t, app, user.RefreshToken, http.StatusUnauthorized)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{"Authorization": "Bot " + token.Token})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Neither do the tokens of the user's bots
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, botHeaders)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Others cannot find the user anymore
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/"+user.ID.String(), nil, otherHeaders)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/search?q=test-username", nil, otherHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), user.ID.String())
+
+	sendFriendRequest(t, app, other.AccessToken, "test-username", http.StatusNotFound)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	}, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// A wrong password does not tell whether the account is deactivated
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "wrong-password",
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", users.LoginRequest{
+		Email:      "test-user@mail.com",
+		Password:   "test-password",
+		Reactivate: true,
+	}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/"+user.ID.String(), nil, otherHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{"Authorization": "Bot " + token.Token})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, botHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	loginUser(t, app, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+}
+
+func TestDeleteAccount(t *testing.T) {
+	var cfg *config.Config
+	app, cleanup := setupTestApp(t, func(c *config.Config) {
+		c.AccountDeletionGraceSecond = 0
+		c.AccountDeletionIntervalSecond = 1
+		cfg = c
+	})
+	defer cleanup()
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	other := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+	otherHeaders := map[string]string{"Authorization": "Bearer " + other.AccessToken}
+
+	channelID := getDMChannelID(t, app, user.AccessToken, other.ID.String())
+	sendMessage(t, app, user.AccessToken, channelID, "goodbye", http.StatusCreated)
+	sendMessage(t, app, other.AccessToken, channelID, "see you", http.StatusCreated)
+	sendFriendRequest(t, app, user.AccessToken, "test-username2", http.StatusCreated)
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/bots", map[string]interface{}{"username": "test-bot"}, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/deletion", map[string]interface{}{"password": "test-password"}, headers)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Contains(t, w.Body.String(), "deletion_scheduled_at")
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var remaining int
+		err := db.QueryRow(`SELECT count(*) FROM users WHERE (id = $1 OR bot_owner_id = $1) AND deleted_at IS NULL`, user.ID).Scan(&remaining)
+		if err != nil {
+			t.Fatalf("Error reading users: %v", err)
+		}
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Account was not deleted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Nothing identifying is left
+	var username, email, password string
+	err = db.QueryRow(`SELECT username, email, password FROM users WHERE id = $1`, user.ID).Scan(&username, &email, &password)
+	if err != nil {
+		t.Fatalf("Error reading user: %v", err)
+	}
+	assert.NotEqual(t, "test-username", username)
+	assert.NotEqual(t, "test-user@mail.com", email)
+	assert.Empty(t, password)
+
+	// The conversation stays, with the messages attributed to the placeholder
+	w = performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages", nil, otherHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var page struct {
+		Messages []messages.MessageResponse `json:"messages"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Error unmarshalling messages response: %v", err)
+	}
+	if assert.Len(t, page.Messages, 2) {
+		assert.Equal(t, other.ID, page.Messages[0].AuthorID)
+		assert.Equal(t, uuid.Nil, page.Messages[1].AuthorID)
+		assert.Equal(t, "goodbye", page.Messages[1].Content)
+	}
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/"+uuid.Nil.String(), nil, otherHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"display_name":"Deleted User"`)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/"+user.ID.String(), nil, otherHeaders)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/relationships", nil, otherHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), user.ID.String())
+
+	var memberships int
+	err = db.QueryRow(`SELECT count(*) FROM channel_members WHERE user_id = $1`, user.ID).Scan(&memberships)
+	if err != nil {
+		t.Fatalf("Error reading channel members: %v", err)
+	}
+	assert.Equal(t, 0, memberships)
+
+	// The account cannot be restored and its email address is free again
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", users.LoginRequest{
+		Email:      "test-user@mail.com",
+		Password:   "test-password",
+		Reactivate: true,
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+}
@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jakottelaar/relay-backend/internal/messages"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageAttachments(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user1 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	user3 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username3",
+		Email:    "test-user3@mail.com",
+		Password: "test-password",
+	})
+
+	channelID := getDMChannelID(t, app, user1.AccessToken, user2.ID.String())
+	attachmentsPath := "/api/v1/channels/" + channelID + "/attachments"
+	headers1 := map[string]string{"Authorization": "Bearer " + user1.AccessToken}
+	headers2 := map[string]string{"Authorization": "Bearer " + user2.AccessToken}
+	headers3 := map[string]string{"Authorization": "Bearer " + user3.AccessToken}
+
+	uploadAttachment := func(headers map[string]string, filename string, content []byte) messages.AttachmentResponse {
+		w := uploadFile(t, app, attachmentsPath, filename, content, headers)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response struct {
+			Attachment messages.AttachmentResponse `json:"attachment"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Error unmarshalling attachment response: %v", err)
+		}
+		return response.Attachment
+	}
+
+	// Only channel members can upload
+	w := uploadFile(t, app, attachmentsPath, "image.png", testPNG(t, 8, 8), headers3)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	image := uploadAttachment(headers1, "screenshot.png", testPNG(t, 1200, 600))
+	assert.Equal(t, "screenshot.png", image.Filename)
+	assert.Equal(t, "image/png", image.ContentType)
+	assert.Equal(t, 1200, *image.Width)
+	assert.Equal(t, 600, *image.Height)
+	assert.NotNil(t, image.ThumbnailURL)
+
+	logs := uploadAttachment(headers1, "server.log", []byte("level=info msg=started\n"))
+	assert.Equal(t, "text/plain; charset=utf-8", logs.ContentType)
+	assert.Nil(t, logs.Width)
+	assert.Nil(t, logs.ThumbnailURL)
+
+	other := uploadAttachment(headers2, "other.log", []byte("mine\n"))
+
+	// Attachments must be unused uploads of the author
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/"+channelID+"/messages", map[string]interface{}{
+		"content":        "look",
+		"attachment_ids": []string{other.ID.String()},
+	}, headers1)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/"+channelID+"/messages", map[string]interface{}{
+		"attachment_ids": []string{image.ID.String(), logs.ID.String()},
+	}, headers1)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/"+channelID+"/messages", map[string]interface{}{
+		"content":        "again",
+		"attachment_ids": []string{image.ID.String()},
+	}, headers1)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// The other member gets download links with the messages
+	w = performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages", nil, headers2)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var page struct {
+		Messages []messages.MessageResponse `json:"messages"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Error unmarshalling messages response: %v", err)
+	}
+
+	attachments := page.Messages[0].Attachments
+	if assert.Len(t, attachments, 2) {
+		assert.Equal(t, image.ID, attachments[0].ID)
+		assert.Equal(t, logs.ID, attachments[1].ID)
+	}
+
+	w = performRequest(t, app, http.MethodGet, attachments[0].URL, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline"))
+	assert.Equal(t, testPNG(t, 1200, 600), w.Body.Bytes())
+
+	w = performRequest(t, app, http.MethodGet, *attachments[0].ThumbnailURL, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	thumbnail, err := png.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, thumbnail.Width)
+		assert.Equal(t, 200, thumbnail.Height)
+	}
+
+	w = performRequest(t, app, http.MethodGet, attachments[1].URL, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename=server.log`, w.Header().Get("Content-Disposition"))
+
+	// Links are bound to one attachment and cannot be forged
+	token := attachments[0].URL[strings.Index(attachments[0].URL, "?"):]
+	w = performRequest(t, app, http.MethodGet, "/api/v1/attachments/"+logs.ID.String()+token, nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/attachments/"+image.ID.String()+"/thumbnail"+token, nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/attachments/"+image.ID.String(), nil, headers3)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, attachments[0].URL+"x", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Attachments are not public blobs
+	w = performRequest(t, app, http.MethodGet, "/blobs/attachments/"+channelID+"/"+image.ID.String()+".png", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Non-members cannot get links through the messages
+	w = performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages", nil, headers3)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
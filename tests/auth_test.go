@@ -0,0 +1,374 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal"
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func refreshTokens(t *testing.T, app *infra.App, refreshToken string, wantStatus int) (string, string) {
+	payload := map[string]interface{}{
+		"refresh_token": refreshToken,
+	}
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/refresh", payload, nil)
+	assert.Equal(t, wantStatus, w.Code)
+	if w.Code != http.StatusOK {
+		return "", ""
+	}
+
+	var response map[string]map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling refresh response: %v", err)
+	}
+
+	return response["result"]["access_token"], response["result"]["refresh_token"]
+}
+
+func TestRefreshTokens(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	accessToken, rotated := refreshTokens(t, app, user.RefreshToken, http.StatusOK)
+	assert.NotEmpty(t, accessToken)
+	assert.NotEqual(t, user.RefreshToken, rotated)
+
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + accessToken,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Replaying the already rotated token revokes every token of its family
+	refreshTokens(t, app, user.RefreshToken, http.StatusUnauthorized)
+	refreshTokens(t, app, rotated, http.StatusUnauthorized)
+
+	// Logging in again starts a new family
+	_, loginRefreshToken := loginUserTokens(t, app, users.LoginRequest{
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+	refreshTokens(t, app, loginRefreshToken, http.StatusOK)
+
+	t.Run("unknown refresh token", func(t *testing.T) {
+		refreshTokens(t, app, "not-a-refresh-token", http.StatusUnauthorized)
+	})
+
+	t.Run("missing refresh token", func(t *testing.T) {
+		w := performRequest(t, app, http.MethodPost, "/api/v1/auth/refresh", map[string]interface{}{}, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestLogout(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	otherAccessToken, otherRefreshToken := loginUserTokens(t, app, users.LoginRequest{
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+	payload := map[string]interface{}{"refresh_token": user.RefreshToken}
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/logout", payload, headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, headers)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	refreshTokens(t, app, user.RefreshToken, http.StatusUnauthorized)
+
+	// Other sessions of the user are not affected
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + otherAccessToken,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	refreshTokens(t, app, otherRefreshToken, http.StatusOK)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/logout", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogoutAll(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	otherAccessToken, otherRefreshToken := loginUserTokens(t, app, users.LoginRequest{
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+	apiTokens := createPersonalAndBotTokens(t, app, headers)
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/logout-all", nil, headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// API tokens of the user and their bots are revoked too
+	for _, header := range apiTokens {
+		w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{"Authorization": header})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	for _, accessToken := range []string{user.AccessToken, otherAccessToken} {
+		w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+			"Authorization": "Bearer " + accessToken,
+		})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	refreshTokens(t, app, user.RefreshToken, http.StatusUnauthorized)
+	refreshTokens(t, app, otherRefreshToken, http.StatusUnauthorized)
+}
+
+// TestLogoutAllRevocationBoundary covers access tokens without a session,
+// which are only revoked by their issue time. iat has second precision, so
+// tokens issued up to and including the second of the revocation are revoked.
+func TestLogoutAllRevocationBoundary(t *testing.T) {
+	var cfg *config.Config
+	app, cleanup := setupTestApp(t, func(c *config.Config) {
+		cfg = c
+	})
+	defer cleanup()
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	keys, err := internal.NewKeySet(cfg)
+	if err != nil {
+		t.Fatalf("Error loading keys: %v", err)
+	}
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/logout-all", nil, map[string]string{
+		"Authorization": "Bearer " + user.AccessToken,
+	})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	var revokedAt time.Time
+	if err := db.QueryRow(`SELECT revoked_at FROM user_token_revocations WHERE user_id = $1`, user.ID).Scan(&revokedAt); err != nil {
+		t.Fatalf("Error reading revocation: %v", err)
+	}
+	revokedSecond := revokedAt.Truncate(time.Second)
+
+	tests := []struct {
+		name       string
+		issuedAt   time.Time
+		wantStatus int
+	}{
+		{name: "issued the second before", issuedAt: revokedSecond.Add(-time.Second), wantStatus: http.StatusUnauthorized},
+		{name: "issued the same second", issuedAt: revokedSecond, wantStatus: http.StatusUnauthorized},
+		{name: "issued the second after", issuedAt: revokedSecond.Add(time.Second), wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := keys.Sign(&internal.JWTClaims{
+				UserId: user.ID.String(),
+				RegisteredClaims: jwt.RegisteredClaims{
+					IssuedAt:  jwt.NewNumericDate(tt.issuedAt),
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				},
+			})
+			if err != nil {
+				t.Fatalf("Error signing token: %v", err)
+			}
+
+			w := performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+				"Authorization": "Bearer " + token,
+			})
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	otherAccessToken, otherRefreshToken := loginUserTokens(t, app, users.LoginRequest{
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/me/sessions", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Sessions []struct {
+			ID      string `json:"id"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling sessions response: %v", err)
+	}
+	assert.Len(t, response.Sessions, 2)
+
+	var otherSessionID string
+	for _, session := range response.Sessions {
+		if !session.Current {
+			otherSessionID = session.ID
+		}
+	}
+	assert.NotEmpty(t, otherSessionID)
+
+	tests := []struct {
+		name       string
+		sessionID  string
+		wantStatus int
+	}{
+		{
+			name:       "revoke other session",
+			sessionID:  otherSessionID,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "already revoked session",
+			sessionID:  otherSessionID,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "invalid session id",
+			sessionID:  "invalid",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodDelete, "/api/v1/users/me/sessions/"+tt.sessionID, nil, headers)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	// The revoked device can no longer use or renew its tokens
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + otherAccessToken,
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	refreshTokens(t, app, otherRefreshToken, http.StatusUnauthorized)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me/sessions", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling sessions response: %v", err)
+	}
+	assert.Len(t, response.Sessions, 1)
+}
+
+func TestJWKS(t *testing.T) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "signing_key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app, cleanup := setupTestApp(t, func(cfg *config.Config) {
+		cfg.JwtSigningKeyFile = keyFile
+	})
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	w := performRequest(t, app, http.MethodGet, "/.well-known/jwks.json", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Alg     string `json:"alg"`
+			X       string `json:"x"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("Error unmarshalling JWKS: %v", err)
+	}
+	if !assert.Len(t, jwks.Keys, 1) {
+		return
+	}
+	assert.Equal(t, "OKP", jwks.Keys[0].KeyType)
+	assert.Equal(t, "EdDSA", jwks.Keys[0].Alg)
+
+	publicKey, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anyone holding the published key can verify the access token
+	token, err := jwt.Parse(user.AccessToken, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwks.Keys[0].KeyID, token.Header["kid"])
+		return ed25519.PublicKey(publicKey), nil
+	}, jwt.WithValidMethods([]string{"EdDSA"}))
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + user.AccessToken,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,249 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jakottelaar/relay-backend/internal/blob"
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a stand-in for an S3 compatible service like MinIO. It keeps
+// objects in memory and only accepts signed requests.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func newFakeS3(t *testing.T) *httptest.Server {
+	f := &fakeS3{objects: map[string][]byte{}, types: map[string]string{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		f.types[r.URL.Path] = r.Header.Get("Content-Type")
+	case http.MethodGet:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[r.URL.Path])
+		_, _ = w.Write(body)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Error encoding PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func uploadFile(t *testing.T, app *infra.App, path, filename string, content []byte, headers map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("Error creating form file: %v", err)
+	}
+	if _, err := part.Write(content); err != nil {
+		t.Fatalf("Error writing form file: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Error closing multipart writer: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	w := httptest.NewRecorder()
+	app.HttpServer.Handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestS3BlobStore(t *testing.T) {
+	server := newFakeS3(t)
+	ctx := context.Background()
+
+	store, err := blob.NewS3Store(server.URL, "us-east-1", "relay", "test-key", "test-secret", "")
+	if err != nil {
+		t.Fatalf("Error creating S3 store: %v", err)
+	}
+
+	assert.Equal(t, server.URL+"/relay/public/a.png", store.URL("public/a.png"))
+
+	content := testPNG(t, 4, 4)
+	err = store.Put(ctx, "public/a.png", bytes.NewReader(content), int64(len(content)), "image/png")
+	assert.NoError(t, err)
+
+	r, err := store.Get(ctx, "public/a.png")
+	if err != nil {
+		t.Fatalf("Error getting blob: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, content, got)
+
+	assert.NoError(t, store.Delete(ctx, "public/a.png"))
+	assert.NoError(t, store.Delete(ctx, "public/a.png"))
+
+	_, err = store.Get(ctx, "public/a.png")
+	assert.True(t, errors.Is(err, blob.ErrNotFound))
+
+	err = store.Put(ctx, "../escape", bytes.NewReader(content), int64(len(content)), "image/png")
+	assert.Error(t, err)
+
+	badStore, err := blob.NewS3Store(server.URL, "us-east-1", "relay", "wrong-key", "test-secret", "")
+	if err != nil {
+		t.Fatalf("Error creating S3 store: %v", err)
+	}
+	err = badStore.Put(ctx, "public/a.png", bytes.NewReader(content), int64(len(content)), "image/png")
+	assert.Error(t, err)
+}
+
+func TestUploadAvatar(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	// The claimed type does not matter, the contents do
+	w := uploadFile(t, app, "/api/v1/users/me/avatar", "avatar.png", []byte("<html><script>alert(1)</script></html>"), headers)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w = uploadFile(t, app, "/api/v1/users/me/avatar", "avatar.png", make([]byte, 6<<20), headers)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/avatar", nil, headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	content := testPNG(t, 32, 32)
+	w = uploadFile(t, app, "/api/v1/users/me/avatar", "avatar.png", content, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		User users.ProfileResponse `json:"user"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling profile response: %v", err)
+	}
+
+	avatarURL := *response.User.AvatarURL
+	assert.True(t, strings.HasPrefix(avatarURL, "http://localhost:8080/blobs/public/avatars/"+user.ID.String()+"/"))
+	assert.True(t, strings.HasSuffix(avatarURL, ".png"))
+
+	avatarPath := strings.TrimPrefix(avatarURL, "http://localhost:8080")
+	w = performRequest(t, app, http.MethodGet, avatarPath, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// Replacing the avatar removes the old file
+	w = uploadFile(t, app, "/api/v1/users/me/avatar", "avatar.png", testPNG(t, 16, 16), headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, avatarPath, nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/users/me/avatar", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"avatar_url":null`)
+
+	// Linking someone else's avatar and replacing it leaves their file alone
+	other := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+	otherHeaders := map[string]string{"Authorization": "Bearer " + other.AccessToken}
+
+	w = uploadFile(t, app, "/api/v1/users/me/avatar", "avatar.png", content, otherHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling profile response: %v", err)
+	}
+	otherAvatarURL := *response.User.AvatarURL
+	otherAvatarPath := strings.TrimPrefix(otherAvatarURL, "http://localhost:8080")
+
+	w = performRequest(t, app, http.MethodPatch, "/api/v1/users/me", map[string]string{"avatar_url": otherAvatarURL}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodPatch, "/api/v1/users/me", map[string]string{"avatar_url": ""}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodPatch, "/api/v1/users/me", map[string]string{"avatar_url": otherAvatarURL}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/users/me/avatar", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, otherAvatarPath, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// Only public blobs are served
+	w = performRequest(t, app, http.MethodGet, "/blobs/attachments/x.png", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/blobs/public/../attachments/x.png", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
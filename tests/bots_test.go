@@ -0,0 +1,329 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jakottelaar/relay-backend/internal/auth"
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func createAPIToken(t *testing.T, app *infra.App, path string, payload interface{}, headers map[string]string) *auth.CreateAPITokenResponse {
+	w := performRequest(t, app, http.MethodPost, path, payload, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Token auth.CreateAPITokenResponse `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling token response: %v", err)
+	}
+
+	return &response.Token
+}
+
+// createPersonalAndBotTokens creates a personal API token and a token for a
+// new bot of the user, and returns the Authorization headers for both.
+func createPersonalAndBotTokens(t *testing.T, app *infra.App, headers map[string]string) []string {
+	token := createAPIToken(t, app, "/api/v1/users/me/tokens", map[string]interface{}{
+		"name":   "cli",
+		"scopes": []string{"profile:read"},
+	}, headers)
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/bots", map[string]string{"username": "test-bot"}, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var botResponse struct {
+		Bot users.BotResponse `json:"bot"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &botResponse); err != nil {
+		t.Fatalf("Error unmarshalling bot response: %v", err)
+	}
+
+	botToken := createAPIToken(t, app, "/api/v1/bots/"+botResponse.Bot.ID.String()+"/tokens", map[string]interface{}{
+		"name":   "ci",
+		"scopes": []string{"profile:read"},
+	}, headers)
+
+	headerValues := []string{"Bot " + token.Token, "Bot " + botToken.Token}
+	for _, header := range headerValues {
+		w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{"Authorization": header})
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	return headerValues
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/users/me/tokens", map[string]interface{}{
+		"name":            "ci",
+		"scopes":          []string{"profile:read"},
+		"expires_in_days": 0,
+	}, headers)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	token := createAPIToken(t, app, "/api/v1/users/me/tokens", map[string]interface{}{
+		"name":            "ci",
+		"scopes":          []string{"profile:read"},
+		"expires_in_days": 30,
+	}, headers)
+	assert.True(t, strings.HasPrefix(token.Token, "relay_"))
+	assert.Equal(t, []string{"profile:read"}, token.Scopes)
+	assert.NotNil(t, token.ExpiresAt)
+
+	botHeaders := map[string]string{"Authorization": "Bot " + token.Token}
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, botHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), user.ID.String())
+
+	// The token is not a JWT
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{"Authorization": "Bearer " + token.Token})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Account management needs the user themselves
+	w = performRequest(t, app, http.MethodPut, "/api/v1/users/me/password", map[string]string{
+		"current_password": "test-password",
+		"new_password":     "new-test-password",
+	}, botHeaders)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/tokens", map[string]string{"name": "other"}, botHeaders)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/logout", nil, botHeaders)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me/tokens", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), token.ID.String())
+	assert.NotContains(t, w.Body.String(), token.Token)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/users/me/tokens/"+token.ID.String(), nil, headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/users/me/tokens/"+token.ID.String(), nil, headers)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, botHeaders)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestBots(t *testing.T) {
+	app, mailDir, cleanup := setupTestAppWithMailDir(t)
+	defer cleanup()
+
+	owner := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	other := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	ownerHeaders := map[string]string{"Authorization": "Bearer " + owner.AccessToken}
+	otherHeaders := map[string]string{"Authorization": "Bearer " + other.AccessToken}
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/bots", map[string]string{"username": "test-username2"}, ownerHeaders)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/bots", map[string]string{"username": "ci-bot"}, ownerHeaders)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var botResponse struct {
+		Bot users.BotResponse `json:"bot"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &botResponse); err != nil {
+		t.Fatalf("Error unmarshalling bot response: %v", err)
+	}
+	botID := botResponse.Bot.ID.String()
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/bots", nil, ownerHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), botID)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/bots", nil, otherHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"bots":[]}`, w.Body.String())
+
+	// Only the owner manages the bot's tokens
+	w = performRequest(t, app, http.MethodPost, "/api/v1/bots/"+botID+"/tokens", map[string]string{"name": "ci"}, otherHeaders)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	token := createAPIToken(t, app, "/api/v1/bots/"+botID+"/tokens", map[string]interface{}{
+		"name":   "ci",
+		"scopes": []string{"profile:read", "messages:write"},
+	}, ownerHeaders)
+	botHeaders := map[string]string{"Authorization": "Bot " + token.Token}
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, botHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var profileResponse struct {
+		User users.ProfileResponse `json:"user"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &profileResponse); err != nil {
+		t.Fatalf("Error unmarshalling profile response: %v", err)
+	}
+	assert.True(t, profileResponse.User.IsBot)
+	assert.Equal(t, "ci-bot", profileResponse.User.Username)
+
+	// Bots cannot log in with a password, even one that was never set
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", users.LoginRequest{
+		Email:    profileResponse.User.Email,
+		Password: "test-password",
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// A bot posts into channels it is a member of
+	verifyTestUserEmail(t, app, mailDir, "test-user@mail.com")
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/groups", map[string]interface{}{
+		"name":               "test-group",
+		"channel_member_ids": []string{botID},
+	}, ownerHeaders)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var channelResponse map[string]map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &channelResponse); err != nil {
+		t.Fatalf("Error unmarshalling channel response: %v", err)
+	}
+	channelID := channelResponse["channel"]["id"].(string)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/"+channelID+"/messages", map[string]string{
+		"content": "build passed",
+	}, botHeaders)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages", nil, ownerHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "build passed")
+
+	// Bots cannot create bots
+	w = performRequest(t, app, http.MethodPost, "/api/v1/bots", map[string]string{"username": "other-bot"}, botHeaders)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/bots/"+botID+"/tokens/"+token.ID.String(), nil, ownerHeaders)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, botHeaders)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/bots/"+botID, nil, otherHeaders)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/bots/"+botID, nil, ownerHeaders)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/bots", nil, ownerHeaders)
+	assert.JSONEq(t, `{"bots":[]}`, w.Body.String())
+
+	// The bot's messages stay, attributed to the deleted user placeholder
+	w = performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages", nil, ownerHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "build passed")
+	assert.Contains(t, w.Body.String(), `"author_id":"00000000-0000-0000-0000-000000000000"`)
+	assert.NotContains(t, w.Body.String(), botID)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/bots/"+botID, nil, ownerHeaders)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTokenScopes(t *testing.T) {
+	app, mailDir, cleanup := setupTestAppWithMailDir(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	member := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	tests := []struct {
+		name   string
+		scopes []string
+	}{
+		{name: "error: no scopes", scopes: nil},
+		{name: "error: unknown scope", scopes: []string{"messages:read", "admin"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodPost, "/api/v1/users/me/tokens", map[string]interface{}{
+				"name":   "ci",
+				"scopes": tt.scopes,
+			}, headers)
+			assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		})
+	}
+
+	verifyTestUserEmail(t, app, mailDir, "test-user@mail.com")
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/channels/groups", map[string]interface{}{
+		"name":               "test-group",
+		"channel_member_ids": []string{member.ID.String()},
+	}, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var channelResponse map[string]map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &channelResponse); err != nil {
+		t.Fatalf("Error unmarshalling channel response: %v", err)
+	}
+	channelID := channelResponse["channel"]["id"].(string)
+
+	token := createAPIToken(t, app, "/api/v1/users/me/tokens", map[string]interface{}{
+		"name":   "reader",
+		"scopes": []string{"messages:read", "channels:read"},
+	}, headers)
+	botHeaders := map[string]string{"Authorization": "Bot " + token.Token}
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/channels", nil, botHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages", nil, botHeaders)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/"+channelID+"/messages", map[string]string{
+		"content": "hello",
+	}, botHeaders)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"error":"token is missing the messages:write scope"}`, w.Body.String())
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/relationships", nil, botHeaders)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, botHeaders)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Access tokens from logging in are not limited
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/"+channelID+"/messages", map[string]string{
+		"content": "hello",
+	}, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"encoding/json"
 	"net/http"
 	"testing"
 
@@ -59,3 +60,111 @@ func TestCreateDMChannel(t *testing.T) {
 	}
 
 }
+
+func TestAddChannelMember(t *testing.T) {
+	app, mailDir, cleanup := setupTestAppWithMailDir(t)
+	defer cleanup()
+
+	owner := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	member := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	newMember := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username3",
+		Email:    "test-user3@mail.com",
+		Password: "test-password",
+	})
+
+	verifyTestUserEmail(t, app, mailDir, "test-user@mail.com")
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/channels/groups", map[string]interface{}{
+		"name":               "test-group",
+		"channel_member_ids": []string{member.ID.String()},
+	}, map[string]string{
+		"Authorization": "Bearer " + owner.AccessToken,
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response map[string]map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling channel response: %v", err)
+	}
+	groupID := response["channel"]["id"].(string)
+
+	dmID := getDMChannelID(t, app, owner.AccessToken, member.ID.String())
+
+	tests := []struct {
+		name       string
+		token      string
+		channelID  string
+		userID     string
+		wantStatus int
+	}{
+		{
+			name:       "error: not the owner",
+			token:      member.AccessToken,
+			channelID:  groupID,
+			userID:     newMember.ID.String(),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "error: not a member",
+			token:      newMember.AccessToken,
+			channelID:  groupID,
+			userID:     newMember.ID.String(),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "error: dm channel",
+			token:      owner.AccessToken,
+			channelID:  dmID,
+			userID:     newMember.ID.String(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "valid add member",
+			token:      owner.AccessToken,
+			channelID:  groupID,
+			userID:     newMember.ID.String(),
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "error: already a member",
+			token:      owner.AccessToken,
+			channelID:  groupID,
+			userID:     newMember.ID.String(),
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "error: unknown user",
+			token:      owner.AccessToken,
+			channelID:  groupID,
+			userID:     "00000000-0000-0000-0000-000000000000",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{
+				"Authorization": "Bearer " + tt.token,
+			}
+
+			w := performRequest(t, app, http.MethodPost, "/api/v1/channels/"+tt.channelID+"/members", map[string]interface{}{
+				"user_id": tt.userID,
+			}, headers)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal/exports"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataExport(t *testing.T) {
+	var cfg *config.Config
+	app, cleanup := setupTestApp(t, func(c *config.Config) {
+		cfg = c
+	})
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	other := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	sendFriendRequest(t, app, user.AccessToken, "test-username2", http.StatusCreated)
+	channelID := getDMChannelID(t, app, user.AccessToken, other.ID.String())
+	sendMessage(t, app, user.AccessToken, channelID, "first", http.StatusCreated)
+	sendMessage(t, app, other.AccessToken, channelID, "not mine", http.StatusCreated)
+	sendMessage(t, app, user.AccessToken, channelID, "second", http.StatusCreated)
+
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/me/export", nil, headers)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	token := createAPIToken(t, app, "/api/v1/users/me/tokens", map[string]interface{}{
+		"name":   "cli",
+		"scopes": []string{"profile:read"},
+	}, headers)
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/export", nil, map[string]string{"Authorization": "Bot " + token.Token})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	requestExport := func() exports.DataExportResponse {
+		w := performRequest(t, app, http.MethodPost, "/api/v1/users/me/export", nil, headers)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		var response struct {
+			Export exports.DataExportResponse `json:"export"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Error unmarshalling export response: %v", err)
+		}
+		return response.Export
+	}
+
+	// Asking again while the export is being built returns the same one
+	export := requestExport()
+	assert.Equal(t, "pending", export.Status)
+	assert.Nil(t, export.DownloadURL)
+	assert.Equal(t, export.ID, requestExport().ID)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w := performRequest(t, app, http.MethodGet, "/api/v1/users/me/export", nil, headers)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Export exports.DataExportResponse `json:"export"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Error unmarshalling export response: %v", err)
+		}
+		export = response.Export
+
+		if export.Status != "pending" && export.Status != "processing" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Export was not built")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, "ready", export.Status)
+	if !assert.NotNil(t, export.DownloadURL) {
+		return
+	}
+
+	// The link is bound to the export
+	w = performRequest(t, app, http.MethodGet, *export.DownloadURL+"x", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// A download whose archive cannot be read does not use up the link
+	archiveDir := filepath.Join(cfg.BlobDir, "exports", user.ID.String())
+	if err := os.Rename(archiveDir, archiveDir+".moved"); err != nil {
+		t.Fatalf("Error moving archive: %v", err)
+	}
+
+	w = performRequest(t, app, http.MethodGet, *export.DownloadURL, nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me/export", nil, headers)
+	assert.Contains(t, w.Body.String(), `"status":"ready"`)
+
+	if err := os.Rename(archiveDir+".moved", archiveDir); err != nil {
+		t.Fatalf("Error restoring archive: %v", err)
+	}
+
+	w = performRequest(t, app, http.MethodGet, *export.DownloadURL, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+
+	files := readZip(t, w.Body.Bytes())
+
+	var profile exports.ProfileExport
+	if err := json.Unmarshal(files["profile.json"], &profile); err != nil {
+		t.Fatalf("Error unmarshalling profile: %v", err)
+	}
+	assert.Equal(t, user.ID, profile.ID)
+	assert.Equal(t, "test-user@mail.com", profile.Email)
+
+	var relationships []exports.RelationshipExport
+	if err := json.Unmarshal(files["relationships.json"], &relationships); err != nil {
+		t.Fatalf("Error unmarshalling relationships: %v", err)
+	}
+	if assert.Len(t, relationships, 1) {
+		assert.Equal(t, other.ID, relationships[0].UserID)
+		assert.Equal(t, "outgoing", relationships[0].RelationshipStatus)
+	}
+
+	var channels []exports.ChannelMembershipExport
+	if err := json.Unmarshal(files["channels.json"], &channels); err != nil {
+		t.Fatalf("Error unmarshalling channels: %v", err)
+	}
+	if assert.Len(t, channels, 1) {
+		assert.Equal(t, channelID, channels[0].ChannelID.String())
+	}
+
+	var messages []exports.MessageExport
+	if err := json.Unmarshal(files["messages.json"], &messages); err != nil {
+		t.Fatalf("Error unmarshalling messages: %v", err)
+	}
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "first", messages[0].Content)
+		assert.Equal(t, "second", messages[1].Content)
+	}
+
+	// The link works once
+	w = performRequest(t, app, http.MethodGet, *export.DownloadURL, nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me/export", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"downloaded"`)
+	assert.NotContains(t, w.Body.String(), "download_url")
+
+	// A new export can be requested afterwards
+	assert.NotEqual(t, export.ID, requestExport().ID)
+}
+
+func readZip(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Error reading zip: %v", err)
+	}
+
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Error opening %s: %v", f.Name, err)
+		}
+
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", f.Name, err)
+		}
+		files[f.Name] = content
+	}
+
+	return files
+}
@@ -0,0 +1,459 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestServer(t *testing.T, app *infra.App) *httptest.Server {
+	server := httptest.NewServer(app.HttpServer.Handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialGateway(t *testing.T, server *httptest.Server, query string) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/gateway" + query
+	return websocket.DefaultDialer.Dial(url, nil)
+}
+
+func readGatewayPayload(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Error setting read deadline: %v", err)
+	}
+
+	var payload map[string]interface{}
+	if err := conn.ReadJSON(&payload); err != nil {
+		t.Fatalf("Error reading gateway payload: %v", err)
+	}
+
+	return payload
+}
+
+func TestGatewayConnect(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	server := startTestServer(t, app)
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	t.Run("error: missing token", func(t *testing.T) {
+		_, resp, err := dialGateway(t, server, "")
+		assert.Error(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("error: invalid token", func(t *testing.T) {
+		_, resp, err := dialGateway(t, server, "?access_token=invalid")
+		assert.Error(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("hello and heartbeat", func(t *testing.T) {
+		conn, _, err := dialGateway(t, server, "?access_token="+user.AccessToken)
+		if err != nil {
+			t.Fatalf("Error dialing gateway: %v", err)
+		}
+		defer conn.Close()
+
+		hello := readGatewayPayload(t, conn)
+		assert.Equal(t, "hello", hello["op"])
+		data := hello["d"].(map[string]interface{})
+		assert.NotEmpty(t, data["session_id"])
+		assert.NotZero(t, data["heartbeat_interval"])
+
+		if err := conn.WriteJSON(map[string]interface{}{"op": "heartbeat"}); err != nil {
+			t.Fatalf("Error writing heartbeat: %v", err)
+		}
+		ack := readGatewayPayload(t, conn)
+		assert.Equal(t, "heartbeat_ack", ack["op"])
+	})
+}
+
+func TestGatewayDispatchesEvents(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	server := startTestServer(t, app)
+
+	user1 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	conn, _, err := dialGateway(t, server, "?access_token="+user2.AccessToken)
+	if err != nil {
+		t.Fatalf("Error dialing gateway: %v", err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "hello", readGatewayPayload(t, conn)["op"])
+
+	t.Run("friend request received", func(t *testing.T) {
+		sendFriendRequest(t, app, user1.AccessToken, user2.Username, http.StatusCreated)
+
+		payload := readGatewayPayload(t, conn)
+		assert.Equal(t, "dispatch", payload["op"])
+		assert.Equal(t, "FRIEND_REQUEST_RECEIVED", payload["t"])
+		assert.Equal(t, user1.ID.String(), payload["d"].(map[string]interface{})["user_id"])
+	})
+
+	var channelID string
+	t.Run("channel created", func(t *testing.T) {
+		channelID = getDMChannelID(t, app, user1.AccessToken, user2.ID.String())
+
+		payload := readGatewayPayload(t, conn)
+		assert.Equal(t, "CHANNEL_CREATED", payload["t"])
+		assert.Equal(t, channelID, payload["d"].(map[string]interface{})["id"])
+	})
+
+	t.Run("message created", func(t *testing.T) {
+		sendMessage(t, app, user1.AccessToken, channelID, "hello", http.StatusCreated)
+
+		payload := readGatewayPayload(t, conn)
+		assert.Equal(t, "MESSAGE_CREATED", payload["t"])
+		assert.Equal(t, "hello", payload["d"].(map[string]interface{})["content"])
+	})
+}
+
+// TestGatewayAcrossInstances runs two instances on the same database, so
+// events published on one reach clients connected to the other through the
+// Postgres bus.
+func TestGatewayAcrossInstances(t *testing.T) {
+	var cfg *config.Config
+	appA, cleanup := setupTestApp(t, func(c *config.Config) {
+		c.EventBus = "postgres"
+		cfg = c
+	})
+	defer cleanup()
+
+	appB, err := infra.NewApp(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Error creating second app: %v", err)
+	}
+	defer appB.Close()
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	server := startTestServer(t, appA)
+
+	user1 := createTestUser(t, appB, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, appA, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	conn, _, err := dialGateway(t, server, "?access_token="+user2.AccessToken)
+	if err != nil {
+		t.Fatalf("Error dialing gateway: %v", err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "hello", readGatewayPayload(t, conn)["op"])
+
+	sendFriendRequest(t, appB, user1.AccessToken, user2.Username, http.StatusCreated)
+
+	payload := readGatewayPayload(t, conn)
+	assert.Equal(t, "FRIEND_REQUEST_RECEIVED", payload["t"])
+	assert.Equal(t, user1.ID.String(), payload["d"].(map[string]interface{})["user_id"])
+
+	channelID := getDMChannelID(t, appB, user1.AccessToken, user2.ID.String())
+
+	payload = readGatewayPayload(t, conn)
+	assert.Equal(t, "CHANNEL_CREATED", payload["t"])
+	assert.Equal(t, channelID, payload["d"].(map[string]interface{})["id"])
+
+	// Events too large for a NOTIFY payload go through bus_events
+	content := strings.Repeat("😀", 2000)
+	sendMessage(t, appB, user1.AccessToken, channelID, content, http.StatusCreated)
+
+	payload = readGatewayPayload(t, conn)
+	assert.Equal(t, "MESSAGE_CREATED", payload["t"])
+	assert.Equal(t, content, payload["d"].(map[string]interface{})["content"])
+
+	var stored int
+	if err := db.QueryRow(`SELECT count(*) FROM bus_events`).Scan(&stored); err != nil {
+		t.Fatalf("Error reading bus events: %v", err)
+	}
+	assert.Equal(t, 1, stored)
+
+	// Each event is delivered once
+	sendMessage(t, appB, user1.AccessToken, channelID, "hello", http.StatusCreated)
+
+	payload = readGatewayPayload(t, conn)
+	assert.Equal(t, "MESSAGE_CREATED", payload["t"])
+	assert.Equal(t, "hello", payload["d"].(map[string]interface{})["content"])
+}
+
+func TestGatewayResume(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	server := startTestServer(t, app)
+
+	user1 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	conn, _, err := dialGateway(t, server, "?access_token="+user2.AccessToken)
+	if err != nil {
+		t.Fatalf("Error dialing gateway: %v", err)
+	}
+
+	hello := readGatewayPayload(t, conn)
+	sessionID := hello["d"].(map[string]interface{})["session_id"].(string)
+
+	channelID := getDMChannelID(t, app, user1.AccessToken, user2.ID.String())
+	created := readGatewayPayload(t, conn)
+	assert.Equal(t, "CHANNEL_CREATED", created["t"])
+	assert.Equal(t, float64(1), created["s"])
+
+	// Drop the connection and miss an event while offline
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	sendMessage(t, app, user1.AccessToken, channelID, "while you were away", http.StatusCreated)
+
+	t.Run("resume replays missed events", func(t *testing.T) {
+		conn, _, err := dialGateway(t, server, "?access_token="+user2.AccessToken+"&session_id="+sessionID+"&seq=1")
+		if err != nil {
+			t.Fatalf("Error dialing gateway: %v", err)
+		}
+		defer conn.Close()
+
+		hello := readGatewayPayload(t, conn)
+		assert.Equal(t, "hello", hello["op"])
+		assert.Equal(t, sessionID, hello["d"].(map[string]interface{})["session_id"])
+
+		missed := readGatewayPayload(t, conn)
+		assert.Equal(t, "MESSAGE_CREATED", missed["t"])
+		assert.Equal(t, float64(2), missed["s"])
+
+		assert.Equal(t, "resumed", readGatewayPayload(t, conn)["op"])
+	})
+
+	t.Run("unknown session asks the client to resync", func(t *testing.T) {
+		conn, _, err := dialGateway(t, server, "?access_token="+user1.AccessToken+"&session_id="+sessionID+"&seq=1")
+		if err != nil {
+			t.Fatalf("Error dialing gateway: %v", err)
+		}
+		defer conn.Close()
+
+		assert.Equal(t, "invalid_session", readGatewayPayload(t, conn)["op"])
+
+		hello := readGatewayPayload(t, conn)
+		assert.Equal(t, "hello", hello["op"])
+		assert.NotEqual(t, sessionID, hello["d"].(map[string]interface{})["session_id"])
+	})
+}
+
+func TestGatewayClosedOnLogoutAll(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	server := startTestServer(t, app)
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	conn, _, err := dialGateway(t, server, "?access_token="+user.AccessToken)
+	if err != nil {
+		t.Fatalf("Error dialing gateway: %v", err)
+	}
+	defer conn.Close()
+
+	hello := readGatewayPayload(t, conn)
+	sessionID := hello["d"].(map[string]interface{})["session_id"].(string)
+
+	_, reader := openEventStream(t, server, user.AccessToken, "")
+	assert.Equal(t, "hello", readSSEEvent(t, reader)["event"])
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/logout-all", nil, map[string]string{
+		"Authorization": "Bearer " + user.AccessToken,
+	})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// The WebSocket is closed with the session revoked code
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Error setting read deadline: %v", err)
+	}
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, 4001), "expected close code 4001, got %v", err)
+
+	// The event stream ends
+	ended := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Event stream was not closed")
+	}
+
+	// The session cannot be resumed, not even after logging in again
+	accessToken := loginUser(t, app, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	resumed, _, err := dialGateway(t, server, "?access_token="+accessToken+"&session_id="+sessionID+"&seq=0")
+	if err != nil {
+		t.Fatalf("Error dialing gateway: %v", err)
+	}
+	defer resumed.Close()
+
+	assert.Equal(t, "invalid_session", readGatewayPayload(t, resumed)["op"])
+}
+
+func readSSEEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event stream: %v", err)
+		}
+
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			if len(event) > 0 {
+				return event
+			}
+			continue
+		}
+
+		if field, value, found := strings.Cut(line, ":"); found && field != "" {
+			event[field] = value
+		}
+	}
+}
+
+func openEventStream(t *testing.T, server *httptest.Server, token, lastEventID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/events", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error opening event stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestEventStream(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	server := startTestServer(t, app)
+
+	user1 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	resp, reader := openEventStream(t, server, user2.AccessToken, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	hello := readSSEEvent(t, reader)
+	assert.Equal(t, "hello", hello["event"])
+
+	channelID := getDMChannelID(t, app, user1.AccessToken, user2.ID.String())
+	created := readSSEEvent(t, reader)
+	assert.Equal(t, "dispatch", created["event"])
+	assert.Contains(t, created["data"], "CHANNEL_CREATED")
+
+	// Drop the stream and miss an event while offline
+	resp.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	sendMessage(t, app, user1.AccessToken, channelID, "while you were away", http.StatusCreated)
+
+	t.Run("resume with Last-Event-ID", func(t *testing.T) {
+		_, reader := openEventStream(t, server, user2.AccessToken, created["id"])
+
+		assert.Equal(t, "hello", readSSEEvent(t, reader)["event"])
+
+		missed := readSSEEvent(t, reader)
+		assert.Equal(t, "dispatch", missed["event"])
+		assert.Contains(t, missed["data"], "while you were away")
+
+		assert.Equal(t, "resumed", readSSEEvent(t, reader)["event"])
+	})
+
+	t.Run("error: invalid Last-Event-ID", func(t *testing.T) {
+		resp, _ := openEventStream(t, server, user2.AccessToken, "invalid")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("error: missing token", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/v1/events")
+		if err != nil {
+			t.Fatalf("Error opening event stream: %v", err)
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
@@ -0,0 +1,346 @@
+package tests
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+var mailTokenPattern = regexp.MustCompile(`token=(\S+)`)
+
+// setupTestAppWithMailDir starts an app whose emails are written to the
+// returned directory.
+func setupTestAppWithMailDir(t *testing.T) (*infra.App, string, func()) {
+	mailDir := t.TempDir()
+
+	app, cleanup := setupTestApp(t, func(cfg *config.Config) {
+		cfg.MailDir = mailDir
+	})
+
+	return app, mailDir, cleanup
+}
+
+// readMails returns the emails sent to an address, oldest first.
+func readMails(t *testing.T, mailDir, to string) []string {
+	entries, err := os.ReadDir(mailDir)
+	if err != nil {
+		t.Fatalf("Error reading mail directory: %v", err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	mails := []string{}
+	for _, name := range names {
+		content, err := os.ReadFile(filepath.Join(mailDir, name))
+		if err != nil {
+			t.Fatalf("Error reading mail: %v", err)
+		}
+		if strings.Contains(string(content), "To: "+to+"\r\n") {
+			mails = append(mails, string(content))
+		}
+	}
+
+	return mails
+}
+
+// waitForMails waits until n emails were sent to an address, for emails
+// sent in the background.
+func waitForMails(t *testing.T, mailDir, to string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(readMails(t, mailDir, to)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d mails to %s", n, to)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// lastMailToken returns the token from the link in the latest email sent to
+// an address.
+func lastMailToken(t *testing.T, mailDir, to string) string {
+	mails := readMails(t, mailDir, to)
+	if len(mails) == 0 {
+		t.Fatalf("No mail sent to %s", to)
+	}
+
+	match := mailTokenPattern.FindStringSubmatch(mails[len(mails)-1])
+	if match == nil {
+		t.Fatalf("No token found in mail: %s", mails[len(mails)-1])
+	}
+
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatalf("Error unescaping token: %v", err)
+	}
+
+	return token
+}
+
+// verifyTestUserEmail verifies an address with the link from the latest
+// email sent to it.
+func verifyTestUserEmail(t *testing.T, app *infra.App, mailDir, email string) {
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email", map[string]interface{}{
+		"token": lastMailToken(t, mailDir, email),
+	}, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	app, mailDir, cleanup := setupTestAppWithMailDir(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	group := map[string]interface{}{
+		"name":               "test-group",
+		"channel_member_ids": []string{},
+	}
+
+	// Creating groups needs a verified email address
+	w := performRequest(t, app, http.MethodPost, "/api/v1/channels/groups", group, headers)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	token := lastMailToken(t, mailDir, "user1@mail.com")
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{
+			name:       "valid token",
+			token:      token,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "token already used",
+			token:      token,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "tampered token",
+			token:      token + "x",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid token",
+			token:      "invalid",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := map[string]interface{}{"token": tt.token}
+			w := performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email", payload, nil)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"email_verified":true`)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email/resend", nil, headers)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/channels/groups", group, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestResendEmailVerification(t *testing.T) {
+	app, mailDir, cleanup := setupTestAppWithMailDir(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"email_verified":false`)
+
+	// The registration email was just sent
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email/resend", nil, headers)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Len(t, readMails(t, mailDir, "user1@mail.com"), 1)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email/resend", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPasswordReset(t *testing.T) {
+	app, mailDir, cleanup := setupTestAppWithMailDir(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	apiTokens := createPersonalAndBotTokens(t, app, map[string]string{"Authorization": "Bearer " + user.AccessToken})
+
+	// Unknown addresses get the same response, but no email
+	for _, email := range []string{"user1@mail.com", "unknown@mail.com"} {
+		payload := map[string]interface{}{"email": email}
+		w := performRequest(t, app, http.MethodPost, "/api/v1/auth/password/forgot", payload, nil)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	// One verification and one reset email
+	waitForMails(t, mailDir, "user1@mail.com", 2)
+	assert.Empty(t, readMails(t, mailDir, "unknown@mail.com"))
+
+	token := lastMailToken(t, mailDir, "user1@mail.com")
+
+	tests := []struct {
+		name       string
+		payload    map[string]interface{}
+		wantStatus int
+	}{
+		{
+			name:       "short password",
+			payload:    map[string]interface{}{"token": token, "password": "short"},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "invalid token",
+			payload:    map[string]interface{}{"token": "invalid", "password": "new-password"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "valid reset",
+			payload:    map[string]interface{}{"token": token, "password": "new-password"},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "token already used",
+			payload:    map[string]interface{}{"token": token, "password": "other-password"},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodPost, "/api/v1/auth/password/reset", tt.payload, nil)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	// Existing sessions were logged out
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + user.AccessToken,
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	refreshTokens(t, app, user.RefreshToken, http.StatusUnauthorized)
+
+	// So were API tokens made by whoever knew the old password
+	for _, header := range apiTokens {
+		w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{"Authorization": header})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+		"email":    "user1@mail.com",
+		"password": "password",
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	loginUser(t, app, users.LoginRequest{
+		Email:    "user1@mail.com",
+		Password: "new-password",
+	})
+}
+
+func TestChangeEmail(t *testing.T) {
+	app, mailDir, cleanup := setupTestAppWithMailDir(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "user1",
+		Email:    "user1@mail.com",
+		Password: "password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email", map[string]interface{}{
+		"token": lastMailToken(t, mailDir, "user1@mail.com"),
+	}, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = performRequest(t, app, http.MethodPatch, "/api/v1/users/me", map[string]interface{}{
+		"email":    "user1-new@mail.com",
+		"password": "wrong-password",
+	}, headers)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodPatch, "/api/v1/users/me", map[string]interface{}{
+		"email":    "user1-new@mail.com",
+		"password": "password",
+	}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"email":"user1@mail.com"`)
+	assert.Contains(t, w.Body.String(), `"pending_email":"user1-new@mail.com"`)
+	assert.Contains(t, w.Body.String(), `"email_verified":true`)
+
+	// The old address is told about the change
+	waitForMails(t, mailDir, "user1@mail.com", 2)
+	mails := readMails(t, mailDir, "user1@mail.com")
+	assert.Contains(t, mails[1], "user1-new@mail.com")
+
+	// The new address is not used before it is verified
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", users.LoginRequest{
+		Email:    "user1-new@mail.com",
+		Password: "password",
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	waitForMails(t, mailDir, "user1-new@mail.com", 1)
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email", map[string]interface{}{
+		"token": lastMailToken(t, mailDir, "user1-new@mail.com"),
+	}, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, headers)
+	assert.Contains(t, w.Body.String(), `"email":"user1-new@mail.com"`)
+	assert.Contains(t, w.Body.String(), `"pending_email":null`)
+	assert.Contains(t, w.Body.String(), `"email_verified":true`)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", users.LoginRequest{
+		Email:    "user1@mail.com",
+		Password: "password",
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	loginUser(t, app, users.LoginRequest{
+		Email:    "user1-new@mail.com",
+		Password: "password",
+	})
+}
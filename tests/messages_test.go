@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func getDMChannelID(t *testing.T, app *infra.App, token, targetUserID string) string {
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/"+targetUserID+"/dm", nil, map[string]string{
+		"Authorization": "Bearer " + token,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling channel response: %v", err)
+	}
+
+	channel, ok := response["channel"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Channel not found in response: %v", response)
+	}
+
+	return channel["id"].(string)
+}
+
+func sendMessage(t *testing.T, app *infra.App, token, channelID, content string, wantStatus int) {
+	w := performRequest(t, app, http.MethodPost, "/api/v1/channels/"+channelID+"/messages", map[string]interface{}{
+		"content": content,
+	}, map[string]string{
+		"Authorization": "Bearer " + token,
+	})
+	assert.Equal(t, wantStatus, w.Code)
+}
+
+func TestCreateMessage(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user1 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	user3 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username3",
+		Email:    "test-user3@mail.com",
+		Password: "test-password",
+	})
+
+	channelID := getDMChannelID(t, app, user1.AccessToken, user2.ID.String())
+
+	tests := []struct {
+		name       string
+		token      string
+		channelID  string
+		payload    map[string]interface{}
+		wantStatus int
+	}{
+		{
+			name:       "valid message from channel owner",
+			token:      user1.AccessToken,
+			channelID:  channelID,
+			payload:    map[string]interface{}{"content": "hello"},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "valid message from other member",
+			token:      user2.AccessToken,
+			channelID:  channelID,
+			payload:    map[string]interface{}{"content": "hi there"},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "error: non member",
+			token:      user3.AccessToken,
+			channelID:  channelID,
+			payload:    map[string]interface{}{"content": "let me in"},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "error: invalid channel id",
+			token:      user1.AccessToken,
+			channelID:  "invalid-channel-id",
+			payload:    map[string]interface{}{"content": "hello"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "error: missing content",
+			token:      user1.AccessToken,
+			channelID:  channelID,
+			payload:    map[string]interface{}{},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{
+				"Authorization": "Bearer " + tt.token,
+			}
+
+			w := performRequest(t, app, http.MethodPost, "/api/v1/channels/"+tt.channelID+"/messages", tt.payload, headers)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetChannelMessages(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user1 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	user3 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username3",
+		Email:    "test-user3@mail.com",
+		Password: "test-password",
+	})
+
+	channelID := getDMChannelID(t, app, user1.AccessToken, user2.ID.String())
+	sendMessage(t, app, user1.AccessToken, channelID, "first", http.StatusCreated)
+	sendMessage(t, app, user2.AccessToken, channelID, "second", http.StatusCreated)
+
+	tests := []struct {
+		name         string
+		token        string
+		wantStatus   int
+		wantMessages int
+	}{
+		{
+			name:         "member reads messages",
+			token:        user2.AccessToken,
+			wantStatus:   http.StatusOK,
+			wantMessages: 2,
+		},
+		{
+			name:       "error: non member",
+			token:      user3.AccessToken,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{
+				"Authorization": "Bearer " + tt.token,
+			}
+
+			w := performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages", nil, headers)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+				return
+			}
+
+			if tt.wantStatus == http.StatusOK {
+				var response map[string][]map[string]interface{}
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+					t.Fatalf("Error unmarshalling messages response: %v", err)
+				}
+				assert.Len(t, response["messages"], tt.wantMessages)
+			}
+		})
+	}
+}
+
+func TestGetChannelMessagesPagination(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user1 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	user2 := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	channelID := getDMChannelID(t, app, user1.AccessToken, user2.ID.String())
+	for _, content := range []string{"one", "two", "three", "four", "five"} {
+		sendMessage(t, app, user1.AccessToken, channelID, content, http.StatusCreated)
+	}
+
+	headers := map[string]string{
+		"Authorization": "Bearer " + user1.AccessToken,
+	}
+
+	getPage := func(t *testing.T, query string) ([]map[string]interface{}, interface{}) {
+		w := performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages"+query, nil, headers)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Messages   []map[string]interface{} `json:"messages"`
+			NextCursor interface{}              `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Error unmarshalling messages response: %v", err)
+		}
+		return response.Messages, response.NextCursor
+	}
+
+	t.Run("first page returns newest messages and a cursor", func(t *testing.T) {
+		messages, nextCursor := getPage(t, "?limit=2")
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "five", messages[0]["content"])
+		assert.Equal(t, "four", messages[1]["content"])
+		assert.Equal(t, messages[1]["id"], nextCursor)
+	})
+
+	t.Run("before cursor walks back through history", func(t *testing.T) {
+		_, cursor := getPage(t, "?limit=2")
+		messages, nextCursor := getPage(t, "?limit=2&before="+cursor.(string))
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "three", messages[0]["content"])
+		assert.Equal(t, "two", messages[1]["content"])
+
+		messages, nextCursor = getPage(t, "?limit=2&before="+nextCursor.(string))
+		assert.Len(t, messages, 1)
+		assert.Equal(t, "one", messages[0]["content"])
+		assert.Nil(t, nextCursor)
+	})
+
+	t.Run("after cursor returns newer messages", func(t *testing.T) {
+		all, _ := getPage(t, "")
+		oldestID := all[len(all)-1]["id"].(string)
+
+		messages, nextCursor := getPage(t, "?limit=2&after="+oldestID)
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "three", messages[0]["content"])
+		assert.Equal(t, "two", messages[1]["content"])
+		assert.Equal(t, messages[0]["id"], nextCursor)
+	})
+
+	t.Run("around cursor centers on the message", func(t *testing.T) {
+		all, _ := getPage(t, "")
+		middleID := all[2]["id"].(string)
+
+		messages, _ := getPage(t, "?limit=3&around="+middleID)
+		assert.Len(t, messages, 3)
+		assert.Equal(t, "four", messages[0]["content"])
+		assert.Equal(t, "three", messages[1]["content"])
+		assert.Equal(t, "two", messages[2]["content"])
+	})
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{
+			name:       "error: multiple cursors",
+			query:      "?before=2024-01-01T00:00:00Z&after=2024-01-01T00:00:00Z",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "error: invalid cursor",
+			query:      "?before=not-a-cursor",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "error: limit too large",
+			query:      "?limit=500",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "timestamp cursor",
+			query:      "?before=2999-01-01T00:00:00Z",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodGet, "/api/v1/channels/"+channelID+"/messages"+tt.query, nil, headers)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
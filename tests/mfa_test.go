@@ -0,0 +1,223 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/mfa"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	code, err := mfa.TOTPCode(secret, at)
+	if err != nil {
+		t.Fatalf("Error generating TOTP code: %v", err)
+	}
+	return code
+}
+
+// enableTOTP enrolls the user and returns the secret and recovery codes.
+func enableTOTP(t *testing.T, app *infra.App, headers map[string]string) (string, []string) {
+	w := performRequest(t, app, http.MethodPost, "/api/v1/users/me/mfa/totp", nil, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var enrollResponse struct {
+		TOTP mfa.EnrollTOTPResponse `json:"totp"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollResponse); err != nil {
+		t.Fatalf("Error unmarshalling enroll response: %v", err)
+	}
+
+	secret := enrollResponse.TOTP.Secret
+	assert.True(t, strings.HasPrefix(enrollResponse.TOTP.ProvisioningURI, "otpauth://totp/Relay:"))
+	assert.Contains(t, enrollResponse.TOTP.ProvisioningURI, "secret="+secret)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/mfa/totp/confirm", map[string]string{
+		"code": totpCode(t, secret, time.Now()),
+	}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var confirmResponse struct {
+		Result mfa.ConfirmTOTPResponse `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmResponse); err != nil {
+		t.Fatalf("Error unmarshalling confirm response: %v", err)
+	}
+
+	return secret, confirmResponse.Result.RecoveryCodes
+}
+
+// loginMFAChallenge logs in a user with two-factor authentication enabled and
+// returns the MFA token.
+func loginMFAChallenge(t *testing.T, app *infra.App, req users.LoginRequest) string {
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/login", req, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Result users.LoginResponse `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error unmarshalling login response: %v", err)
+	}
+
+	assert.True(t, resp.Result.MFARequired)
+	assert.Empty(t, resp.Result.AccessToken)
+	assert.NotEmpty(t, resp.Result.MFAToken)
+
+	return resp.Result.MFAToken
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	// Nothing to confirm before enrolling
+	w := performRequest(t, app, http.MethodPost, "/api/v1/users/me/mfa/totp/confirm", map[string]string{"code": "123456"}, headers)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/mfa/totp", nil, headers)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// A wrong code does not enable anything
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/mfa/totp/confirm", map[string]string{"code": "000000"}, headers)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// Enrolling again replaces the unconfirmed secret
+	secret, recoveryCodes := enableTOTP(t, app, headers)
+	assert.Len(t, recoveryCodes, 10)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me/mfa", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"mfa":{"enabled":true,"remaining_recovery_codes":10}}`, w.Body.String())
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/users/me/mfa/totp", nil, headers)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Disabling needs a valid code
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/users/me/mfa/totp", map[string]string{"code": "000000"}, headers)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// The code used to confirm cannot be used again, the next one can
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/users/me/mfa/totp", map[string]string{
+		"code": totpCode(t, secret, time.Now()),
+	}, headers)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(t, app, http.MethodDelete, "/api/v1/users/me/mfa/totp", map[string]string{
+		"code": totpCode(t, secret, time.Now().Add(30*time.Second)),
+	}, headers)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me/mfa", nil, headers)
+	assert.JSONEq(t, `{"mfa":{"enabled":false,"remaining_recovery_codes":0}}`, w.Body.String())
+
+	// Without two-factor authentication, login returns tokens right away
+	loginUser(t, app, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+}
+
+func TestMFALogin(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+	secret, recoveryCodes := enableTOTP(t, app, headers)
+
+	loginRequest := users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	}
+
+	mfaToken := loginMFAChallenge(t, app, loginRequest)
+
+	tests := []struct {
+		name       string
+		payload    map[string]interface{}
+		wantStatus int
+	}{
+		{
+			name:       "missing code",
+			payload:    map[string]interface{}{"mfa_token": mfaToken},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid mfa token",
+			payload:    map[string]interface{}{"mfa_token": "invalid", "code": "123456"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong code",
+			payload:    map[string]interface{}{"mfa_token": mfaToken, "code": "000000"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong recovery code",
+			payload:    map[string]interface{}{"mfa_token": mfaToken, "code": "aaaaa-aaaaa"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "valid code",
+			payload: map[string]interface{}{
+				"mfa_token": mfaToken,
+				"code":      totpCode(t, secret, time.Now().Add(30*time.Second)),
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "mfa token already used",
+			payload:    map[string]interface{}{"mfa_token": mfaToken, "code": recoveryCodes[1]},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "valid recovery code",
+			payload:    map[string]interface{}{"mfa_token": loginMFAChallenge(t, app, loginRequest), "code": strings.ToUpper(recoveryCodes[0])},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "used recovery code",
+			payload:    map[string]interface{}{"mfa_token": loginMFAChallenge(t, app, loginRequest), "code": recoveryCodes[0]},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodPost, "/api/v1/auth/login/mfa", tt.payload, nil)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// The MFA token cannot be used as an access token
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + mfaToken,
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// The rejected reuse of the MFA token did not use up a recovery code
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me/mfa", nil, headers)
+	assert.JSONEq(t, `{"mfa":{"enabled":true,"remaining_recovery_codes":9}}`, w.Body.String())
+}
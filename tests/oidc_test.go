@@ -0,0 +1,447 @@
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal/infra"
+	"github.com/jakottelaar/relay-backend/internal/oidc"
+	"github.com/jakottelaar/relay-backend/internal/users"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	mockOIDCClientID     = "relay-test"
+	mockOIDCClientSecret = "relay-test-secret"
+)
+
+// mockOIDCUser is the account a user logs in with at the mock issuer.
+type mockOIDCUser struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+type mockOIDCAuthorization struct {
+	user          mockOIDCUser
+	nonce         string
+	codeChallenge string
+	redirectURI   string
+}
+
+// mockOIDCIssuer is a minimal OpenID Connect provider. Instead of showing a
+// login page, authorize returns the code the provider would redirect with.
+type mockOIDCIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]*mockOIDCAuthorization
+}
+
+func newMockOIDCIssuer(t *testing.T) *mockOIDCIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	issuer := &mockOIDCIssuer{
+		t:     t,
+		key:   key,
+		codes: make(map[string]*mockOIDCAuthorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc("/token", issuer.handleToken)
+	mux.HandleFunc("/jwks", issuer.handleJWKS)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (m *mockOIDCIssuer) provider(name string) config.OIDCProvider {
+	return config.OIDCProvider{
+		Name:         name,
+		Issuer:       m.server.URL,
+		ClientID:     mockOIDCClientID,
+		ClientSecret: mockOIDCClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+		RedirectURL:  "http://localhost:3000/oidc/" + name + "/callback",
+	}
+}
+
+// authorize logs the user in at the issuer and returns the code and state of
+// the redirect back to the app.
+func (m *mockOIDCIssuer) authorize(authorizationURL string, user mockOIDCUser) (string, string) {
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		m.t.Fatalf("Error parsing authorization URL: %v", err)
+	}
+
+	query := u.Query()
+	assert.Equal(m.t, m.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(m.t, "code", query.Get("response_type"))
+	assert.Equal(m.t, mockOIDCClientID, query.Get("client_id"))
+	assert.Equal(m.t, "S256", query.Get("code_challenge_method"))
+	assert.NotEmpty(m.t, query.Get("nonce"))
+	assert.NotEmpty(m.t, query.Get("state"))
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		m.t.Fatalf("Error generating code: %v", err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+
+	m.mu.Lock()
+	m.codes[code] = &mockOIDCAuthorization{
+		user:          user,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		redirectURI:   query.Get("redirect_uri"),
+	}
+	m.mu.Unlock()
+
+	return code, query.Get("state")
+}
+
+func (m *mockOIDCIssuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 m.server.URL,
+		"authorization_endpoint": m.server.URL + "/authorize",
+		"token_endpoint":         m.server.URL + "/token",
+		"jwks_uri":               m.server.URL + "/jwks",
+	})
+}
+
+func (m *mockOIDCIssuer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *mockOIDCIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != mockOIDCClientID || clientSecret != mockOIDCClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// Codes can only be used once
+	m.mu.Lock()
+	authorization, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != authorization.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                m.server.URL,
+		"sub":                authorization.user.Subject,
+		"aud":                mockOIDCClientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              authorization.nonce,
+		"email":              authorization.user.Email,
+		"email_verified":     authorization.user.EmailVerified,
+		"preferred_username": authorization.user.PreferredUsername,
+	})
+	token.Header["kid"] = "mock-key"
+
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// startOIDCLogin starts a login with a provider and returns the authorization
+// URL and login token.
+func startOIDCLogin(t *testing.T, app *infra.App, provider string) (string, string) {
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/oidc/"+provider+"/authorize", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Result oidc.AuthorizeResponse `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error unmarshalling authorize response: %v", err)
+	}
+
+	return resp.Result.AuthorizationURL, resp.Result.LoginToken
+}
+
+// loginOIDC logs a user in at the mock issuer and completes the login.
+func loginOIDC(t *testing.T, app *infra.App, issuer *mockOIDCIssuer, user mockOIDCUser, wantStatus int) *users.LoginResponse {
+	authorizationURL, loginToken := startOIDCLogin(t, app, "mock")
+	code, state := issuer.authorize(authorizationURL, user)
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/oidc/mock/callback", map[string]string{
+		"code":        code,
+		"state":       state,
+		"login_token": loginToken,
+	}, nil)
+	assert.Equal(t, wantStatus, w.Code)
+	if w.Code != wantStatus {
+		t.Errorf("Expected status %d but got %d: %s", wantStatus, w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Result users.LoginResponse `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error unmarshalling login response: %v", err)
+	}
+
+	return &resp.Result
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockOIDCIssuer(t)
+
+	app, cleanup := setupTestApp(t, func(cfg *config.Config) {
+		cfg.OIDCProviders = []config.OIDCProvider{issuer.provider("mock")}
+	})
+	defer cleanup()
+
+	w := performRequest(t, app, http.MethodGet, "/api/v1/auth/oidc/providers", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"providers":["mock"]}`, w.Body.String())
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/oidc/unknown/authorize", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	oidcUser := mockOIDCUser{
+		Subject:           "subject-1",
+		Email:             "test-oidc@mail.com",
+		EmailVerified:     true,
+		PreferredUsername: "test-oidc",
+	}
+
+	// The first login creates an account with a verified email address
+	first := loginOIDC(t, app, issuer, oidcUser, http.StatusOK)
+	assert.Equal(t, "test-oidc", first.UserName)
+	assert.NotEmpty(t, first.AccessToken)
+	assert.NotEmpty(t, first.RefreshToken)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + first.AccessToken,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"email_verified":true`)
+
+	// Later logins use the same account, even if the email changed
+	oidcUser.Email = "test-oidc-changed@mail.com"
+	second := loginOIDC(t, app, issuer, oidcUser, http.StatusOK)
+	assert.Equal(t, first.UserID, second.UserID)
+
+	// A taken username gets a suffix
+	other := loginOIDC(t, app, issuer, mockOIDCUser{
+		Subject:           "subject-2",
+		Email:             "test-oidc2@mail.com",
+		EmailVerified:     true,
+		PreferredUsername: "test-oidc",
+	}, http.StatusOK)
+	assert.NotEqual(t, first.UserID, other.UserID)
+	assert.Regexp(t, `^test-oidc-\d{4}$`, other.UserName)
+
+	// An unverified email address cannot be used to sign up
+	loginOIDC(t, app, issuer, mockOIDCUser{
+		Subject: "subject-3",
+		Email:   "test-oidc3@mail.com",
+	}, http.StatusUnprocessableEntity)
+}
+
+func TestOIDCLinkExistingAccount(t *testing.T) {
+	issuer := newMockOIDCIssuer(t)
+
+	mailDir := t.TempDir()
+
+	app, cleanup := setupTestApp(t, func(cfg *config.Config) {
+		cfg.MailDir = mailDir
+		cfg.OIDCProviders = []config.OIDCProvider{issuer.provider("mock")}
+	})
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	oidcUser := mockOIDCUser{
+		Subject:       "subject-1",
+		Email:         "test-user@mail.com",
+		EmailVerified: true,
+	}
+
+	// Until the account has verified its email address, it could belong to
+	// someone else who registered with it
+	loginOIDC(t, app, issuer, oidcUser, http.StatusConflict)
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/verify-email", map[string]string{
+		"token": lastMailToken(t, mailDir, "test-user@mail.com"),
+	}, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	resp := loginOIDC(t, app, issuer, oidcUser, http.StatusOK)
+	assert.Equal(t, user.ID, resp.UserID)
+
+	// The password still works
+	loginUser(t, app, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+}
+
+func TestOIDCCallbackValidation(t *testing.T) {
+	issuer := newMockOIDCIssuer(t)
+
+	app, cleanup := setupTestApp(t, func(cfg *config.Config) {
+		cfg.OIDCProviders = []config.OIDCProvider{issuer.provider("mock")}
+	})
+	defer cleanup()
+
+	oidcUser := mockOIDCUser{
+		Subject:       "subject-1",
+		Email:         "test-oidc@mail.com",
+		EmailVerified: true,
+	}
+
+	authorizationURL, loginToken := startOIDCLogin(t, app, "mock")
+	code, state := issuer.authorize(authorizationURL, oidcUser)
+	_, otherLoginToken := startOIDCLogin(t, app, "mock")
+
+	tests := []struct {
+		name       string
+		payload    map[string]string
+		wantStatus int
+	}{
+		{
+			name:       "missing login token",
+			payload:    map[string]string{"code": code, "state": state},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid login token",
+			payload:    map[string]string{"code": code, "state": state, "login_token": "invalid"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "login token of another login",
+			payload:    map[string]string{"code": code, "state": state, "login_token": otherLoginToken},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong code",
+			payload:    map[string]string{"code": "wrong", "state": state, "login_token": loginToken},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodPost, "/api/v1/auth/oidc/mock/callback", tt.payload, nil)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestOIDCReactivateAccount(t *testing.T) {
+	issuer := newMockOIDCIssuer(t)
+
+	var cfg *config.Config
+	app, cleanup := setupTestApp(t, func(c *config.Config) {
+		c.OIDCProviders = []config.OIDCProvider{issuer.provider("mock")}
+		cfg = c
+	})
+	defer cleanup()
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	oidcUser := mockOIDCUser{
+		Subject:           "subject-1",
+		Email:             "test-oidc@mail.com",
+		EmailVerified:     true,
+		PreferredUsername: "test-oidc",
+	}
+	first := loginOIDC(t, app, issuer, oidcUser, http.StatusOK)
+
+	// The account has no usable password, so the provider is the only way
+	// back in
+	if _, err := db.Exec(`UPDATE users SET deactivated_at = now() WHERE id = $1`, first.UserID); err != nil {
+		t.Fatalf("Error deactivating user: %v", err)
+	}
+
+	loginOIDC(t, app, issuer, oidcUser, http.StatusForbidden)
+
+	authorizationURL, loginToken := startOIDCLogin(t, app, "mock")
+	code, state := issuer.authorize(authorizationURL, oidcUser)
+
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/oidc/mock/callback", map[string]interface{}{
+		"code":        code,
+		"state":       state,
+		"login_token": loginToken,
+		"reactivate":  true,
+	}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	second := loginOIDC(t, app, issuer, oidcUser, http.StatusOK)
+	assert.Equal(t, first.UserID, second.UserID)
+}
@@ -23,7 +23,9 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
-func setupTestApp(t *testing.T) (*infra.App, func()) {
+// setupTestApp starts an app against a fresh database. Options can adjust
+// the default test config before the app is created.
+func setupTestApp(t *testing.T, options ...func(cfg *config.Config)) (*infra.App, func()) {
 	ctx := context.Background()
 
 	postgresReq := testcontainers.ContainerRequest{
@@ -76,11 +78,32 @@ func setupTestApp(t *testing.T) (*infra.App, func()) {
 	}
 
 	cfg := &config.Config{
-		Environment:         "test",
-		Port:                8080,
-		DSN:                 postgresDSN,
-		JwtSecret:           "test_secret",
-		JwtExpirationSecond: 3600,
+		Environment:                   "test",
+		Port:                          8080,
+		DSN:                           postgresDSN,
+		JwtSecret:                     "test_secret",
+		JwtExpirationSecond:           3600,
+		RefreshTokenExpirationSecond:  86400,
+		EventBus:                      "postgres",
+		SigningSecret:                 "test_signing_secret",
+		AppURL:                        "http://localhost:3000",
+		MailDriver:                    "file",
+		MailDir:                       t.TempDir(),
+		MailFrom:                      "Relay <no-reply@relay.test>",
+		Argon2MemoryKiB:               64 * 1024,
+		Argon2Iterations:              1,
+		Argon2Parallelism:             2,
+		BlobDriver:                    "local",
+		BlobDir:                       t.TempDir(),
+		BlobPublicURL:                 "http://localhost:8080/blobs",
+		AccountDeletionGraceSecond:    30 * 24 * 3600,
+		AccountDeletionIntervalSecond: 3600,
+		DataExportIntervalSecond:      1,
+		DataExportTTLSecond:           3600,
+	}
+
+	for _, option := range options {
+		option(cfg)
 	}
 
 	app, err := infra.NewApp(ctx, cfg)
@@ -144,14 +167,20 @@ func createTestUser(t *testing.T, app *infra.App, req users.RegisterRequest) *us
 	}
 
 	return &users.RegisterResponse{
-		ID:          ID,
-		Username:    resp["username"].(string),
-		Email:       resp["email"].(string),
-		AccessToken: resp["access_token"].(string),
+		ID:           ID,
+		Username:     resp["username"].(string),
+		Email:        resp["email"].(string),
+		AccessToken:  resp["access_token"].(string),
+		RefreshToken: resp["refresh_token"].(string),
 	}
 }
 
 func loginUser(t *testing.T, app *infra.App, req users.LoginRequest) string {
+	accessToken, _ := loginUserTokens(t, app, req)
+	return accessToken
+}
+
+func loginUserTokens(t *testing.T, app *infra.App, req users.LoginRequest) (string, string) {
 	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/login", req, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
 
@@ -171,7 +200,12 @@ func loginUser(t *testing.T, app *infra.App, req users.LoginRequest) string {
 		t.Fatalf("Token not found in response: %v", signInResponse)
 	}
 
-	return token
+	refreshToken, ok := result["refresh_token"].(string)
+	if !ok {
+		t.Fatalf("Refresh token not found in response: %v", signInResponse)
+	}
+
+	return token, refreshToken
 }
 
 func performRequest(t *testing.T, app *infra.App, method, path string, payload interface{}, headers map[string]string) *httptest.ResponseRecorder {
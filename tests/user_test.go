@@ -1,9 +1,18 @@
 package tests
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/google/uuid"
+	"github.com/jakottelaar/relay-backend/config"
+	"github.com/jakottelaar/relay-backend/internal/infra"
 	"github.com/jakottelaar/relay-backend/internal/users"
 	"github.com/stretchr/testify/assert"
 )
@@ -175,7 +184,15 @@ func TestUserLogin(t *testing.T) {
 				"email":    "test-nonexistinguser@mail.com",
 				"password": "test-password",
 			},
-			wantStatus: http.StatusNotFound,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong password",
+			payload: map[string]interface{}{
+				"email":    "test-user@mail.com",
+				"password": "wrong-password",
+			},
+			wantStatus: http.StatusUnauthorized,
 		},
 	}
 
@@ -190,3 +207,435 @@ func TestUserLogin(t *testing.T) {
 		})
 	}
 }
+
+func TestLoginLockout(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	// Unknown emails and wrong passwords cannot be told apart
+	unknown := performRequest(t, app, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+		"email":    "test-nonexistinguser@mail.com",
+		"password": "test-password",
+	}, nil)
+	wrong := performRequest(t, app, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+		"email":    "test-user@mail.com",
+		"password": "wrong-password",
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+	assert.Equal(t, unknown.Code, wrong.Code)
+	assert.Equal(t, unknown.Body.String(), wrong.Body.String())
+
+	for i := 0; i < 4; i++ {
+		w := performRequest(t, app, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+			"email":    "test-user@mail.com",
+			"password": "wrong-password",
+		}, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	// After five failures the account is locked, even for the right password
+	w := performRequest(t, app, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+		"email":    "test-user@mail.com",
+		"password": "test-password",
+	}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// Other accounts can still log in from the same address
+	loginUser(t, app, users.LoginRequest{
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	// Until the address itself has failed too often
+	for i := 0; i < 14; i++ {
+		w := performRequest(t, app, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+			"email":    fmt.Sprintf("test-unknown%d@mail.com", i),
+			"password": "test-password",
+		}, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	w = performRequest(t, app, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+		"email":    "test-user2@mail.com",
+		"password": "test-password",
+	}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestChangePassword(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	otherAccessToken, otherRefreshToken := loginUserTokens(t, app, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	tests := []struct {
+		name       string
+		payload    map[string]interface{}
+		wantStatus int
+	}{
+		{
+			name: "missing current password",
+			payload: map[string]interface{}{
+				"new_password": "new-password",
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "short new password",
+			payload: map[string]interface{}{
+				"current_password": "test-password",
+				"new_password":     "short",
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "wrong current password",
+			payload: map[string]interface{}{
+				"current_password": "wrong-password",
+				"new_password":     "new-password",
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "valid change",
+			payload: map[string]interface{}{
+				"current_password": "test-password",
+				"new_password":     "new-password",
+			},
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodPut, "/api/v1/users/me/password", tt.payload, headers)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// The session that changed the password stays logged in, others do not
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, map[string]string{
+		"Authorization": "Bearer " + otherAccessToken,
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	refreshTokens(t, app, otherRefreshToken, http.StatusUnauthorized)
+
+	loginUser(t, app, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "new-password",
+	})
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	var cfg *config.Config
+	app, cleanup := setupTestApp(t, func(c *config.Config) {
+		cfg = c
+	})
+	defer cleanup()
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	passwordHash := func() string {
+		var hash string
+		err := db.QueryRow(`SELECT password FROM users WHERE email = $1`, "test-user@mail.com").Scan(&hash)
+		if err != nil {
+			t.Fatalf("Error reading password hash: %v", err)
+		}
+		return hash
+	}
+
+	createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	assert.True(t, strings.HasPrefix(passwordHash(), "$argon2id$v=19$m=65536,t=1,p=2$"))
+
+	// Raise the cost, as a new deployment would
+	upgradedCfg := *cfg
+	upgradedCfg.Argon2Iterations = 2
+	upgradedApp, err := infra.NewApp(context.Background(), &upgradedCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upgradedApp.Close()
+
+	// A failed login does not touch the hash
+	w := performRequest(t, upgradedApp, http.MethodPost, "/api/v1/auth/login", map[string]interface{}{
+		"email":    "test-user@mail.com",
+		"password": "wrong-password",
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.True(t, strings.HasPrefix(passwordHash(), "$argon2id$v=19$m=65536,t=1,p=2$"))
+
+	loginUser(t, upgradedApp, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	assert.True(t, strings.HasPrefix(passwordHash(), "$argon2id$v=19$m=65536,t=2,p=2$"))
+
+	// The upgraded hash still works with the old configuration, which does
+	// not downgrade it
+	loginUser(t, app, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	assert.True(t, strings.HasPrefix(passwordHash(), "$argon2id$v=19$m=65536,t=2,p=2$"))
+
+	// Settings that are stronger in one parameter but weaker in another do
+	// not replace the hash either
+	mixedCfg := *cfg
+	mixedCfg.Argon2Iterations = 3
+	mixedCfg.Argon2Parallelism = 1
+	mixedApp, err := infra.NewApp(context.Background(), &mixedCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mixedApp.Close()
+
+	loginUser(t, mixedApp, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	assert.True(t, strings.HasPrefix(passwordHash(), "$argon2id$v=19$m=65536,t=2,p=2$"))
+
+	// Raising only the parallelism is an upgrade
+	parallelCfg := upgradedCfg
+	parallelCfg.Argon2Parallelism = 4
+	parallelApp, err := infra.NewApp(context.Background(), &parallelCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parallelApp.Close()
+
+	loginUser(t, parallelApp, users.LoginRequest{
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+	assert.True(t, strings.HasPrefix(passwordHash(), "$argon2id$v=19$m=65536,t=2,p=4$"))
+}
+
+func TestUpdateProfile(t *testing.T) {
+	app, cleanup := setupTestApp(t)
+	defer cleanup()
+
+	user := createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username",
+		Email:    "test-user@mail.com",
+		Password: "test-password",
+	})
+
+	createTestUser(t, app, users.RegisterRequest{
+		Username: "test-username2",
+		Email:    "test-user2@mail.com",
+		Password: "test-password",
+	})
+
+	headers := map[string]string{"Authorization": "Bearer " + user.AccessToken}
+
+	tests := []struct {
+		name       string
+		payload    map[string]interface{}
+		wantStatus int
+	}{
+		{
+			name:       "error: username taken",
+			payload:    map[string]interface{}{"username": "test-username2"},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "error: username too short",
+			payload:    map[string]interface{}{"username": "ab"},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "error: avatar not a web URL",
+			payload:    map[string]interface{}{"avatar_url": "javascript:alert(1)"},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "error: email change without password",
+			payload:    map[string]interface{}{"email": "new@mail.com"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "error: email taken",
+			payload:    map[string]interface{}{"email": "test-user2@mail.com", "password": "test-password"},
+			wantStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(t, app, http.MethodPatch, "/api/v1/users/me", tt.payload, headers)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	w := performRequest(t, app, http.MethodPatch, "/api/v1/users/me", map[string]interface{}{
+		"username":     "new-username",
+		"display_name": "New Name",
+		"bio":          "Hello",
+		"avatar_url":   "https://cdn.example.com/avatar.png",
+	}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		User users.ProfileResponse `json:"user"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Error unmarshalling profile response: %v", err)
+	}
+	assert.Equal(t, "new-username", response.User.Username)
+	assert.Equal(t, "New Name", *response.User.DisplayName)
+	assert.Equal(t, "Hello", *response.User.Bio)
+	assert.Equal(t, "https://cdn.example.com/avatar.png", *response.User.AvatarURL)
+	assert.Equal(t, "test-user@mail.com", response.User.Email)
+
+	// Fields that are not set stay, empty ones are removed
+	w = performRequest(t, app, http.MethodPatch, "/api/v1/users/me", map[string]interface{}{
+		"bio": "",
+	}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/me", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"display_name":"New Name"`)
+	assert.Contains(t, w.Body.String(), `"bio":null`)
+}
+
+func TestPublicProfileAndSearch(t *testing.T) {
+	var cfg *config.Config
+	app, cleanup := setupTestApp(t, func(c *config.Config) {
+		cfg = c
+	})
+	defer cleanup()
+
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	viewer := createTestUser(t, app, users.RegisterRequest{
+		Username: "viewer",
+		Email:    "viewer@mail.com",
+		Password: "test-password",
+	})
+	alice := createTestUser(t, app, users.RegisterRequest{
+		Username: "alice",
+		Email:    "alice@mail.com",
+		Password: "test-password",
+	})
+	alicia := createTestUser(t, app, users.RegisterRequest{
+		Username: "alicia",
+		Email:    "alicia@mail.com",
+		Password: "test-password",
+	})
+	blocker := createTestUser(t, app, users.RegisterRequest{
+		Username: "alice_blocks",
+		Email:    "blocker@mail.com",
+		Password: "test-password",
+	})
+	createTestUser(t, app, users.RegisterRequest{
+		Username: "bob",
+		Email:    "bob@mail.com",
+		Password: "test-password",
+	})
+
+	_, err = db.Exec(`
+		INSERT INTO relationships (user_id, other_user_id, relationship_status)
+		VALUES ($1, $2, 'blocked'), ($2, $1, 'blocked_other')
+	`, blocker.ID, viewer.ID)
+	if err != nil {
+		t.Fatalf("Error blocking user: %v", err)
+	}
+
+	headers := map[string]string{"Authorization": "Bearer " + viewer.AccessToken}
+
+	w := performRequest(t, app, http.MethodGet, "/api/v1/users/"+alice.ID.String(), nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username":"alice"`)
+	assert.NotContains(t, w.Body.String(), "alice@mail.com")
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/"+blocker.ID.String(), nil, headers)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/"+uuid.NewString(), nil, headers)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/not-a-uuid", nil, headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	search := func(query string) []string {
+		w := performRequest(t, app, http.MethodGet, "/api/v1/users/search?q="+url.QueryEscape(query), nil, headers)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Users []users.PublicProfileResponse `json:"users"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Error unmarshalling search response: %v", err)
+		}
+
+		usernames := []string{}
+		for _, user := range response.Users {
+			usernames = append(usernames, user.Username)
+		}
+		return usernames
+	}
+
+	// Prefix matches come first, users who blocked the viewer never show up
+	assert.Equal(t, []string{"alice", "alicia"}, search("ali"))
+	assert.Equal(t, []string{"alice", "alicia"}, search("ALI"))
+	assert.Equal(t, "alicia", search("alicia")[0])
+	assert.Contains(t, search("alicea"), "alice")
+	assert.Empty(t, search("%"))
+	assert.Empty(t, search("viewer"))
+
+	// Blocking only hides users from the ones they blocked
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/search?q=alice_", nil, map[string]string{
+		"Authorization": "Bearer " + alicia.AccessToken,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username":"alice_blocks"`)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/search", nil, headers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(t, app, http.MethodGet, "/api/v1/users/search?q=a&limit=500", nil, headers)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}